@@ -3,57 +3,136 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/konorlevich/test_task_s3/internal/config"
+	"github.com/konorlevich/test_task_s3/internal/metrics"
 	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
 	"github.com/konorlevich/test_task_s3/internal/rest-service/handler"
+	restMetrics "github.com/konorlevich/test_task_s3/internal/rest-service/metrics"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/compression"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/encryption"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/webhooks"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
 )
 
-var port = "8080"
-var dbFile = database.DefaultFile
-var chunkNum = database.DefaultChunkNum
-
-func init() {
-	p := os.Getenv("REST_PORT")
-	if p != "" {
-		port = p
+func main() {
+	loader := config.NewLoader("rest-service", os.Args[1:])
+	cfg := config.DefaultRest()
+	if err := loader.Load(cfg); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.WithError(err).Fatal("failed to load config")
 	}
-
-	d := os.Getenv("DB_FILE")
-	if d != "" {
-		dbFile = d
+	if loader.Print {
+		if err := config.Print(os.Stdout, cfg); err != nil {
+			log.WithError(err).Fatal("failed to print config")
+		}
+		return
 	}
 
-	c, err := strconv.Atoi(os.Getenv("CHUNK_NUM"))
-	if err != nil && c != 0 {
-		chunkNum = c
-	}
-}
-
-func main() {
-	l := log.New().WithFields(log.Fields{
-		"rest_port": port,
-		"db_file":   dbFile,
-		"chunk_num": chunkNum,
+	logger := log.New()
+	level, _ := log.ParseLevel(cfg.LogLevel)
+	logger.SetLevel(level)
+	l := logger.WithFields(log.Fields{
+		"rest_port":        cfg.Port,
+		"db_file":          cfg.DBFile,
+		"chunk_num":        cfg.ChunkNum,
+		"min_chunk_size":   cfg.MinChunkSize,
+		"max_chunk_size":   cfg.MaxChunkSize,
+		"inline_size":      cfg.InlineSize,
+		"compression":      cfg.Compression,
+		"compression_dirs": cfg.CompressionDirs,
+		"key_file":         cfg.KeyFile,
+		"gc_interval":      time.Duration(cfg.GCInterval).String(),
+		"webhook_hosts":    cfg.WebhookHosts,
+		"replicas":         cfg.Replicas,
+		"placement":        cfg.Placement,
+		"spread_domain":    cfg.SpreadDomain,
+		"spread_policy":    cfg.SpreadPolicy,
+		"degraded_policy":  cfg.DegradedPolicy,
+		"config_file":      loader.File,
 	})
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 	defer l.Println("got interruption signal")
 
-	db, err := database.NewDb(dbFile)
+	compressionPolicy, err := compression.ParsePolicy(cfg.Compression, cfg.CompressionDirs)
+	if err != nil {
+		l.WithError(err).Fatal("failed to parse compression settings")
+	}
+
+	var keys *encryption.Keyring
+	if cfg.KeyFile != "" {
+		if keys, err = encryption.LoadKeyring(cfg.KeyFile); err != nil {
+			l.WithError(err).Fatal("failed to load master keys")
+		}
+	}
+
+	chunking := storage.ChunkPolicy{
+		Servers:    cfg.ChunkNum,
+		MinSize:    cfg.MinChunkSize,
+		MaxSize:    cfg.MaxChunkSize,
+		InlineSize: cfg.InlineSize,
+		Replicas:   cfg.Replicas,
+	}
+	if chunking.Degraded, err = storage.ParseDegraded(cfg.DegradedPolicy); err != nil {
+		l.WithError(err).Fatal("failed to parse degraded policy")
+	}
+	limits := handler.NewLimits(cfg.MaxUploadSize)
+	config.OnReload(ctx, func() {
+		next := config.DefaultRest()
+		if err := loader.Load(next); err != nil {
+			l.WithError(err).Error("config isn't reloaded")
+			return
+		}
+		level, _ := log.ParseLevel(next.LogLevel)
+		logger.SetLevel(level)
+		limits.SetMaxUploadSize(next.MaxUploadSize)
+		l.WithFields(log.Fields{
+			"log_level":       next.LogLevel,
+			"max_upload_size": next.MaxUploadSize,
+		}).Info("config reloaded, other settings are applied on restart")
+	})
+
+	db, err := database.NewDb(cfg.DBFile)
 	if err != nil {
 		l.WithError(err).Fatal("failed to open database")
 	}
-	server := &http.Server{Addr: ":" + port, Handler: handler.NewHandler(database.NewRepository(db), chunkNum, l)}
+	repo := database.NewRepository(db)
+	prometheus.MustRegister(restMetrics.NewServerUsageCollector(repo, l))
+	fs := files.NewFiles(l)
+	targets := webhooks.NewTargets(strings.Split(cfg.WebhookHosts, ",")...)
+	placement, err := storage.ParsePlacement(cfg.Placement)
+	if err != nil {
+		l.WithError(err).Fatal("failed to parse placement settings")
+	}
+	spread, err := storage.ParseSpread(cfg.SpreadDomain, cfg.SpreadPolicy)
+	if err != nil {
+		l.WithError(err).Fatal("failed to parse spread settings")
+	}
+	s := storage.NewServer(repo, fs, webhooks.NewSender(targets), keys, placement, spread, l)
+	go s.RunBackground(ctx, time.Duration(cfg.GCInterval))
+	go s.RunRepair(ctx, time.Duration(cfg.RepairInterval), chunking, cfg.RepairRate)
+	server := &http.Server{
+		Addr:    ":" + cfg.Port,
+		Handler: tracing.Middleware(l, metrics.Instrument(handler.NewHandler(repo, s, fs, chunking, compressionPolicy, keys, cfg.AdminToken, cfg.NodeToken, limits, targets, l))),
+	}
 
 	go func() {
-		l.Printf("listening to port %s\n", port)
+		l.Printf("listening to port %s\n", cfg.Port)
 		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			l.WithError(err).Fatal("listen and serve returned err")
 		}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 
 	log "github.com/sirupsen/logrus"
 
@@ -11,47 +12,68 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/konorlevich/test_task_s3/internal/config"
+	"github.com/konorlevich/test_task_s3/internal/metrics"
 	"github.com/konorlevich/test_task_s3/internal/storage-service/handler"
 	"github.com/konorlevich/test_task_s3/internal/storage-service/register"
 	"github.com/konorlevich/test_task_s3/internal/storage-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
 )
 
-var (
-	port               = "8080"
-	restServiceBaseUrl = ""
-	storagePath        = "/var/storage"
-)
-
-func init() {
-	p := os.Getenv("STORAGE_PORT")
-	if p != "" {
-		port = p
-	}
-	r := os.Getenv("REST_SERVICE_URL")
-	if r != "" {
-		restServiceBaseUrl = r
+func main() {
+	loader := config.NewLoader("storage-service", os.Args[1:])
+	cfg := config.DefaultStorage()
+	if err := loader.Load(cfg); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.WithError(err).Fatal("failed to load config")
 	}
-	s := os.Getenv("STORAGE_PATH")
-	if s != "" {
-		storagePath = s
+	if loader.Print {
+		if err := config.Print(os.Stdout, cfg); err != nil {
+			log.WithError(err).Fatal("failed to print config")
+		}
+		return
 	}
-}
 
-func main() {
-	l := log.New().WithFields(log.Fields{
-		"port":                  port,
-		"rest_service_base_url": restServiceBaseUrl,
-		"storage_path":          storagePath,
+	logger := log.New()
+	level, _ := log.ParseLevel(cfg.LogLevel)
+	logger.SetLevel(level)
+	l := logger.WithFields(log.Fields{
+		"port":                  cfg.Port,
+		"rest_service_base_url": cfg.RestServiceURL,
+		"storage_path":          cfg.Path,
+		"durability":            cfg.Durability,
+		"scrub_interval":        time.Duration(cfg.ScrubInterval).String(),
+		"zone":                  cfg.Zone,
+		"rack":                  cfg.Rack,
+		"config_file":           loader.File,
 	})
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 	defer l.Info("got interruption signal")
-	s, err := storage.NewStorage(storagePath, l)
+	config.OnReload(ctx, func() {
+		next := config.DefaultStorage()
+		if err := loader.Load(next); err != nil {
+			l.WithError(err).Error("config isn't reloaded")
+			return
+		}
+		level, _ := log.ParseLevel(next.LogLevel)
+		logger.SetLevel(level)
+		l.WithField("log_level", next.LogLevel).Info("config reloaded, other settings are applied on restart")
+	})
+
+	d, err := storage.ParseDurability(cfg.Durability)
 	if err != nil {
 		l.Fatal(err)
 	}
-	server := &http.Server{Addr: ":" + port, Handler: handler.NewHandler(s)}
+	s, err := storage.NewStorage(cfg.Path, d, l)
+	if err != nil {
+		l.Fatal(err)
+	}
+	server := &http.Server{Addr: ":" + cfg.Port, Handler: tracing.Middleware(l, metrics.Instrument(handler.NewHandler(s, l)))}
 
 	go func() {
 		l.Info("listen and serve")
@@ -71,14 +93,18 @@ func main() {
 		l.WithError(err).Fatal("can't get server name")
 	}
 
-	l = l.WithField("server_url", restServiceBaseUrl)
-	restServiceUrl, err := url.Parse(restServiceBaseUrl)
+	l = l.WithField("server_url", cfg.RestServiceURL)
+	restServiceUrl, err := url.Parse(cfg.RestServiceURL)
 	if err != nil {
 		l.WithError(err).Fatal("can't parse register server url", err)
 	}
 	l.Info("registering the service ", restServiceUrl.String())
-	if err = register.Register(restServiceUrl, hostname, port); err != nil {
+	topology := register.Topology{Zone: cfg.Zone, Rack: cfg.Rack, Host: cfg.Host}
+	if err = register.Register(restServiceUrl, hostname, cfg.Port, topology); err != nil {
 		l.Fatalf("can't register on server %s: %s\n", hostname, err)
 	}
+	if cfg.ScrubInterval > 0 {
+		go s.RunScrubber(ctx, time.Duration(cfg.ScrubInterval), cfg.ScrubRate, register.DamageReporter(restServiceUrl, hostname, cfg.Port, cfg.NodeToken))
+	}
 	<-ctx.Done()
 }
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// EnvConfigFile points to the config file when -config isn't set
+const EnvConfigFile = "CONFIG_FILE"
+
+const redacted = "<redacted>"
+
+var (
+	ErrInvalidConfig   = errors.New("invalid config")
+	ErrCantReadConfig  = errors.New("can't read config file")
+	ErrCantParseConfig = errors.New("can't parse config file")
+	ErrBadValue        = errors.New("bad value")
+)
+
+// Config is a settings struct of a command.
+//
+// Its fields are described with tags:
+//
+//	json:"name"     the key in the config file and the name of the flag
+//	env:"NAME"      the environment variable
+//	usage:"text"    the flag description
+//	secret:"true"   the value is hidden by Print
+//
+// string, bool, int, int64 and Duration fields are supported
+type Config interface {
+	Validate() error
+}
+
+// Loader reads a Config from, in order of precedence:
+// command line flags, environment variables, the config file and the defaults the struct already has
+type Loader struct {
+	name string
+	args []string
+
+	// File is the config file, from -config or CONFIG_FILE. Empty if there is none
+	File string
+	// Print is set by -print-config, the command should print the config and exit
+	Print bool
+}
+
+func NewLoader(name string, args []string) *Loader {
+	return &Loader{name: name, args: args}
+}
+
+// Load fills cfg and validates it. It can be called again with a fresh struct to reload the settings
+func (l *Loader) Load(cfg Config) error {
+	fields, err := fieldsOf(cfg)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet(l.name, flag.ContinueOnError)
+	fs.StringVar(&l.File, "config", os.Getenv(EnvConfigFile), "config file (JSON), env "+EnvConfigFile)
+	fs.BoolVar(&l.Print, "print-config", false, "print the resulting config and exit")
+	flags := map[string]string{}
+	for _, f := range fields {
+		name := f.name
+		usage := f.usage
+		if f.env != "" {
+			usage += ", env " + f.env
+		}
+		fs.Func(name, usage, func(s string) error {
+			flags[name] = s
+			return nil
+		})
+	}
+	if err := fs.Parse(l.args); err != nil {
+		return err
+	}
+
+	if l.File != "" {
+		if err := readFile(l.File, cfg); err != nil {
+			return err
+		}
+	}
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		// empty variables are taken as unset, like compose leaves them
+		if s := os.Getenv(f.env); s != "" {
+			if err := f.set(s); err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrBadValue, f.env, err)
+			}
+		}
+	}
+	for _, f := range fields {
+		if s, ok := flags[f.name]; ok {
+			if err := f.set(s); err != nil {
+				return fmt.Errorf("%w: -%s: %w", ErrBadValue, f.name, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	return nil
+}
+
+// Print writes cfg as a config file, secrets are hidden
+func Print(w io.Writer, cfg Config) error {
+	v := reflect.New(reflect.TypeOf(cfg).Elem())
+	v.Elem().Set(reflect.ValueOf(cfg).Elem())
+	fields, err := fieldsOf(v.Interface().(Config))
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.secret && !f.v.IsZero() {
+			f.v.SetString(redacted)
+		}
+	}
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	return e.Encode(v.Interface())
+}
+
+// OnReload calls reload on every SIGHUP until ctx is done
+func OnReload(ctx context.Context, reload func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c:
+				reload()
+			}
+		}
+	}()
+}
+
+func readFile(p string, cfg Config) error {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCantReadConfig, err)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(cfg); err != nil {
+		return fmt.Errorf("%w %s: %w", ErrCantParseConfig, p, err)
+	}
+	return nil
+}
+
+// Duration is a time.Duration written as "30s" or "1h" in the config file, the flags and the environment
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+type field struct {
+	name   string
+	env    string
+	usage  string
+	secret bool
+	v      reflect.Value
+}
+
+func fieldsOf(cfg Config) ([]*field, error) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config must be a pointer to a struct, got %T", cfg)
+	}
+	v = v.Elem()
+	var fields []*field
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		name := sf.Tag.Get("json")
+		if name == "" || name == "-" {
+			continue
+		}
+		switch sf.Type.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int64:
+		default:
+			return nil, fmt.Errorf("config field %s has unsupported type %s", sf.Name, sf.Type)
+		}
+		fields = append(fields, &field{
+			name:   name,
+			env:    sf.Tag.Get("env"),
+			usage:  sf.Tag.Get("usage"),
+			secret: sf.Tag.Get("secret") == "true",
+			v:      v.Field(i),
+		})
+	}
+	return fields, nil
+}
+
+func (f *field) set(s string) error {
+	switch {
+	case f.v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", s)
+		}
+		f.v.SetInt(int64(d))
+	case f.v.Kind() == reflect.String:
+		f.v.SetString(s)
+	case f.v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a bool", s)
+		}
+		f.v.SetBool(b)
+	default:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		f.v.SetInt(n)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	p := path.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatalf("can't write config file: %s", err)
+	}
+	return p
+}
+
+func TestLoader_Load(t *testing.T) {
+	file := writeConfig(t, `{"port": "9000", "chunk_num": 3, "db_file": "file.db"}`)
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    func(c *Rest)
+		wantErr error
+	}{
+		{name: "defaults", want: func(c *Rest) {}},
+		{
+			name: "file",
+			args: []string{"-config", file},
+			want: func(c *Rest) { c.Port, c.ChunkNum, c.DBFile = "9000", 3, "file.db" },
+		},
+		{
+			name: "env over file",
+			args: []string{"-config", file},
+			env:  map[string]string{"CHUNK_NUM": "4", "REST_PORT": ""},
+			want: func(c *Rest) { c.Port, c.ChunkNum, c.DBFile = "9000", 4, "file.db" },
+		},
+		{
+			name: "flags over env",
+			env:  map[string]string{"CONFIG_FILE": file, "CHUNK_NUM": "4"},
+			args: []string{"-chunk_num", "5", "-admin_token", "secret"},
+			want: func(c *Rest) { c.Port, c.ChunkNum, c.DBFile, c.AdminToken = "9000", 5, "file.db", "secret" },
+		},
+		{name: "bad env", env: map[string]string{"CHUNK_NUM": "six"}, wantErr: ErrBadValue},
+		{name: "bad flag", args: []string{"-max_upload_size", "1Mb"}, wantErr: ErrBadValue},
+		{name: "duration", env: map[string]string{"GC_INTERVAL": "90s"}, want: func(c *Rest) { c.GCInterval = Duration(90 * time.Second) }},
+		{name: "bad duration", args: []string{"-gc_interval", "90"}, wantErr: ErrBadValue},
+		{name: "invalid", args: []string{"-chunk_num", "0"}, wantErr: ErrInvalidConfig},
+		{name: "missing file", args: []string{"-config", path.Join(t.TempDir(), "missing")}, wantErr: ErrCantReadConfig},
+		{name: "unknown key", args: []string{"-config", writeConfig(t, `{"chunks": 3}`)}, wantErr: ErrCantParseConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			got := DefaultRest()
+			err := NewLoader("test", tt.args).Load(got)
+			assert.ErrorIs(t, err, tt.wantErr)
+			if tt.wantErr == nil {
+				want := DefaultRest()
+				tt.want(want)
+				assert.Equal(t, want, got)
+			}
+		})
+	}
+}
+
+func TestRest_Validate(t *testing.T) {
+	c := &Rest{Port: "http", ChunkNum: -1, LogLevel: "loud", Compression: "zip", MaxUploadSize: -1, RepairRate: -1, Placement: "random", SpreadDomain: "row", DegradedPolicy: "maybe"}
+	err := c.Validate()
+	for _, key := range []string{"port", "db_file", "chunk_num", "log_level", "compression", "max_upload_size", "gc_interval", "replicas", "repair_interval", "repair_rate", "placement", "spread", "degraded_policy"} {
+		assert.Contains(t, err.Error(), key+":")
+	}
+	assert.NoError(t, DefaultRest().Validate())
+}
+
+func TestStorage_Validate(t *testing.T) {
+	c := DefaultStorage()
+	c.Durability, c.ScrubInterval, c.ScrubRate = "fast", -1, -1
+	err := c.Validate()
+	for _, key := range []string{"rest_service_url", "durability", "scrub_interval", "scrub_rate"} {
+		assert.Contains(t, err.Error(), key+":")
+	}
+
+	c.RestServiceURL, c.Durability, c.ScrubInterval, c.ScrubRate = "http://rest-service:8080/storage/register", "file", 0, 0
+	assert.NoError(t, c.Validate())
+}
+
+func TestPrint(t *testing.T) {
+	c := DefaultRest()
+	c.AdminToken = "secret"
+	loader := NewLoader("test", []string{"-print-config"})
+	assert.NoError(t, loader.Load(c))
+	assert.True(t, loader.Print)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, Print(out, c))
+	assert.NotContains(t, out.String(), "secret")
+	assert.Contains(t, out.String(), redacted)
+	assert.Equal(t, "secret", c.AdminToken)
+
+	// the output can be read back as a config file
+	got := DefaultRest()
+	assert.NoError(t, NewLoader("test", []string{"-config", writeConfig(t, strings.ReplaceAll(out.String(), redacted, "secret"))}).Load(got))
+	assert.Equal(t, c, got)
+}
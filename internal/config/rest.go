@@ -0,0 +1,105 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/compression"
+)
+
+// Rest is the rest-service config. LogLevel and MaxUploadSize are reloaded on SIGHUP
+type Rest struct {
+	Port            string   `json:"port" env:"REST_PORT" usage:"port to listen"`
+	DBFile          string   `json:"db_file" env:"DB_FILE" usage:"sqlite database file"`
+	ChunkNum        int      `json:"chunk_num" env:"CHUNK_NUM" usage:"number of servers a file is spread over"`
+	MinChunkSize    int64    `json:"min_chunk_size" env:"MIN_CHUNK_SIZE" usage:"smaller files are cut into fewer chunks"`
+	MaxChunkSize    int64    `json:"max_chunk_size" env:"MAX_CHUNK_SIZE" usage:"bigger files are cut into more chunks than servers"`
+	InlineSize      int64    `json:"inline_size" env:"INLINE_SIZE" usage:"smaller files are kept in the database, 0 disables it"`
+	Compression     string   `json:"compression" env:"COMPRESSION" usage:"default compression: gzip, flate or empty"`
+	CompressionDirs string   `json:"compression_dirs" env:"COMPRESSION_DIRS" usage:"compression per dir: logs=gzip,images="`
+	KeyFile         string   `json:"key_file" env:"KEY_FILE" usage:"master keys file, files are stored unencrypted without it"`
+	AdminToken      string   `json:"admin_token" env:"ADMIN_TOKEN" usage:"token for the admin endpoints, they are disabled without it" secret:"true"`
+	NodeToken       string   `json:"node_token" env:"NODE_TOKEN" usage:"token the storage servers send their reports with, the reports are refused without it" secret:"true"`
+	LogLevel        string   `json:"log_level" env:"LOG_LEVEL" usage:"log level"`
+	MaxUploadSize   int64    `json:"max_upload_size" env:"MAX_UPLOAD_SIZE" usage:"max upload request size in bytes, 0 is unlimited"`
+	GCInterval      Duration `json:"gc_interval" env:"GC_INTERVAL" usage:"how often the chunks of removed files are deleted from the storage servers"`
+	WebhookHosts    string   `json:"webhook_hosts" env:"WEBHOOK_HOSTS" usage:"internal hosts allowed as webhook targets: hooks.local,10.0.0.5"`
+	Replicas        int      `json:"replicas" env:"REPLICAS" usage:"copies of every chunk, kept on different storage servers"`
+	RepairInterval  Duration `json:"repair_interval" env:"REPAIR_INTERVAL" usage:"how often the chunks with missing copies are repaired"`
+	RepairRate      int64    `json:"repair_rate" env:"REPAIR_RATE" usage:"bytes a second the repair sends, 0 is unlimited"`
+	Placement       string   `json:"placement" env:"PLACEMENT" usage:"how the servers for new chunks are chosen: least-loaded, weighted-random, round-robin or rendezvous"`
+	SpreadDomain    string   `json:"spread_domain" env:"SPREAD_DOMAIN" usage:"failure domain the servers of a file are spread over: zone, rack, host or empty"`
+	SpreadPolicy    string   `json:"spread_policy" env:"SPREAD_POLICY" usage:"with fewer domains than servers: strict fails, best-effort shares the domains"`
+	DegradedPolicy  string   `json:"degraded_policy" env:"DEGRADED_POLICY" usage:"with fewer active servers than chunk_num: reject fails uploads with 503, accept shares the servers and spreads the chunks later"`
+}
+
+func DefaultRest() *Rest {
+	return &Rest{
+		Port:           "8080",
+		DBFile:         database.DefaultFile,
+		ChunkNum:       database.DefaultChunkNum,
+		MinChunkSize:   storage.DefaultMinChunkSize,
+		MaxChunkSize:   storage.DefaultMaxChunkSize,
+		InlineSize:     storage.DefaultInlineSize,
+		LogLevel:       log.InfoLevel.String(),
+		GCInterval:     Duration(storage.DefaultGCInterval),
+		Replicas:       1,
+		RepairInterval: Duration(storage.DefaultRepairInterval),
+		Placement:      storage.PlacementLeastLoaded,
+		SpreadPolicy:   storage.SpreadBestEffort,
+		DegradedPolicy: storage.DegradedReject,
+	}
+}
+
+func (c *Rest) Validate() error {
+	var errs []error
+	errs = append(errs, validatePort(c.Port), validateLogLevel(c.LogLevel))
+	if c.DBFile == "" {
+		errs = append(errs, errors.New("db_file: must be set"))
+	}
+	if c.ChunkNum < 1 {
+		errs = append(errs, fmt.Errorf("chunk_num: must be at least 1, got %d", c.ChunkNum))
+	}
+	if c.MinChunkSize < 1 {
+		errs = append(errs, fmt.Errorf("min_chunk_size: must be at least 1, got %d", c.MinChunkSize))
+	}
+	if c.MaxChunkSize < c.MinChunkSize {
+		errs = append(errs, fmt.Errorf("max_chunk_size: must be at least min_chunk_size %d, got %d", c.MinChunkSize, c.MaxChunkSize))
+	}
+	if c.InlineSize < 0 {
+		errs = append(errs, fmt.Errorf("inline_size: can't be negative, got %d", c.InlineSize))
+	}
+	if _, err := compression.ParsePolicy(c.Compression, c.CompressionDirs); err != nil {
+		errs = append(errs, fmt.Errorf("compression: %w", err))
+	}
+	if _, err := storage.ParsePlacement(c.Placement); err != nil {
+		errs = append(errs, fmt.Errorf("placement: %w", err))
+	}
+	if _, err := storage.ParseSpread(c.SpreadDomain, c.SpreadPolicy); err != nil {
+		errs = append(errs, fmt.Errorf("spread: %w", err))
+	}
+	if _, err := storage.ParseDegraded(c.DegradedPolicy); err != nil {
+		errs = append(errs, fmt.Errorf("degraded_policy: %w", err))
+	}
+	if c.MaxUploadSize < 0 {
+		errs = append(errs, fmt.Errorf("max_upload_size: can't be negative, got %d", c.MaxUploadSize))
+	}
+	if c.GCInterval <= 0 {
+		errs = append(errs, fmt.Errorf("gc_interval: must be positive, got %s", time.Duration(c.GCInterval)))
+	}
+	if c.Replicas < 1 {
+		errs = append(errs, fmt.Errorf("replicas: must be at least 1, got %d", c.Replicas))
+	}
+	if c.RepairInterval <= 0 {
+		errs = append(errs, fmt.Errorf("repair_interval: must be positive, got %s", time.Duration(c.RepairInterval)))
+	}
+	if c.RepairRate < 0 {
+		errs = append(errs, fmt.Errorf("repair_rate: can't be negative, got %d", c.RepairRate))
+	}
+	return errors.Join(errs...)
+}
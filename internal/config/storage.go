@@ -0,0 +1,61 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/storage-service/storage"
+)
+
+// Storage is the storage-service config. LogLevel is reloaded on SIGHUP
+type Storage struct {
+	Port           string   `json:"port" env:"STORAGE_PORT" usage:"port to listen"`
+	RestServiceURL string   `json:"rest_service_url" env:"REST_SERVICE_URL" usage:"rest-service url to register on"`
+	Path           string   `json:"path" env:"STORAGE_PATH" usage:"dir to keep chunks in"`
+	Durability     string   `json:"durability" env:"STORAGE_DURABILITY" usage:"chunk fsync mode: full, file or none"`
+	NodeToken      string   `json:"node_token" env:"NODE_TOKEN" usage:"token to send the reports to rest-service with, the same as rest-service has" secret:"true"`
+	LogLevel       string   `json:"log_level" env:"LOG_LEVEL" usage:"log level"`
+	ScrubInterval  Duration `json:"scrub_interval" env:"STORAGE_SCRUB_INTERVAL" usage:"how often the chunks are checked against their checksums, 0 disables it"`
+	ScrubRate      int64    `json:"scrub_rate" env:"STORAGE_SCRUB_RATE" usage:"bytes a second the scrubber reads, 0 is unlimited"`
+	Zone           string   `json:"zone" env:"STORAGE_ZONE" usage:"zone the server is in, the chunks of a file are spread over the zones"`
+	Rack           string   `json:"rack" env:"STORAGE_RACK" usage:"rack the server is in"`
+	Host           string   `json:"host" env:"STORAGE_HOST" usage:"physical host the server is on, the server's hostname by default"`
+}
+
+func DefaultStorage() *Storage {
+	return &Storage{
+		Port:     "8080",
+		Path:     "/var/storage",
+		LogLevel: log.InfoLevel.String(),
+		// a pass reads every chunk, at the default rate a node with 1TB takes about a day
+		ScrubInterval: Duration(24 * time.Hour),
+		ScrubRate:     16 << 20,
+	}
+}
+
+func (c *Storage) Validate() error {
+	var errs []error
+	errs = append(errs, validatePort(c.Port), validateLogLevel(c.LogLevel))
+	if c.RestServiceURL == "" {
+		errs = append(errs, errors.New("rest_service_url: must be set"))
+	} else if _, err := url.Parse(c.RestServiceURL); err != nil {
+		errs = append(errs, fmt.Errorf("rest_service_url: %w", err))
+	}
+	if c.Path == "" {
+		errs = append(errs, errors.New("path: must be set"))
+	}
+	if _, err := storage.ParseDurability(c.Durability); err != nil {
+		errs = append(errs, fmt.Errorf("durability: %w", err))
+	}
+	if c.ScrubInterval < 0 {
+		errs = append(errs, fmt.Errorf("scrub_interval: must not be negative, got %s", time.Duration(c.ScrubInterval)))
+	}
+	if c.ScrubRate < 0 {
+		errs = append(errs, fmt.Errorf("scrub_rate: must not be negative, got %d", c.ScrubRate))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func validatePort(p string) error {
+	if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("port: must be a number from 1 to 65535, got %q", p)
+	}
+	return nil
+}
+
+func validateLogLevel(level string) error {
+	if _, err := log.ParseLevel(level); err != nil {
+		return fmt.Errorf("log_level: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const routeUnmatched = "unmatched"
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	duration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status code.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 9), // 1ms - 65s
+	}, []string{"route", "method", "code"})
+	bytesIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_request_bytes_total",
+		Help: "Bytes received in request bodies by route.",
+	}, []string{"route"})
+	bytesOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_response_bytes_total",
+		Help: "Bytes sent in response bodies by route.",
+	}, []string{"route"})
+)
+
+// Handler serves the metrics in Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Instrument counts requests, latency and bytes of every route of the mux.
+// The route is the mux pattern, so the label values stay bounded
+func Instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = routeUnmatched
+		}
+		start := time.Now()
+		body := &countingReader{r: r.Body}
+		r.Body = body
+		w := &responseWriter{ResponseWriter: rw, status: http.StatusOK}
+
+		mux.ServeHTTP(w, r)
+
+		code := strconv.Itoa(w.status)
+		requests.WithLabelValues(route, r.Method, code).Inc()
+		duration.WithLabelValues(route, r.Method, code).Observe(time.Since(start).Seconds())
+		bytesIn.WithLabelValues(route).Add(float64(body.n))
+		bytesOut.WithLabelValues(route).Add(float64(w.n))
+	})
+}
+
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrument(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /object/{name}", func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write(body[:2])
+	})
+	h := Instrument(mux)
+
+	for _, name := range []string{"a", "b"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/object/"+name, strings.NewReader("12345")))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nothing", nil))
+
+	const route = "POST /object/{name}"
+	assert.Equal(t, 2.0, testutil.ToFloat64(requests.WithLabelValues(route, "POST", "201")))
+	assert.Equal(t, 10.0, testutil.ToFloat64(bytesIn.WithLabelValues(route)))
+	assert.Equal(t, 4.0, testutil.ToFloat64(bytesOut.WithLabelValues(route)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues(routeUnmatched, "GET", "404")))
+}
@@ -2,11 +2,20 @@ package database
 
 import uuid "github.com/google/uuid"
 
+// Chunk is a copy of a part of a file on a server, the copies of a chunk have the same Number and are kept on different servers
 type Chunk struct {
 	ID       uuid.UUID `gorm:"type:uuid;primaryKey;default:(gen_random_uuid())"`
-	FileID   uuid.UUID `gorm:"index:,unique,composite:file_chunk"`
+	FileID   uuid.UUID `gorm:"index:,unique,composite:file_chunk_copy"`
 	File     File
-	ServerID uuid.UUID
+	ServerID uuid.UUID `gorm:"index:,unique,composite:file_chunk_copy"`
 	Server   *Server
-	Number   uint `gorm:"index:,unique,composite:file_chunk"`
+	Number   uint `gorm:"index:,unique,composite:file_chunk_copy"`
+	// Compression is the algorithm the chunk is stored with, empty for raw data
+	Compression string
+	// Offset is where the chunk starts in the file
+	Offset int64 `gorm:"column:chunk_offset"`
+	// Size is the logical size of the chunk, offsets in the file are counted with it
+	Size int64
+	// StoredSize is the size of the chunk on the storage server
+	StoredSize int64
 }
@@ -0,0 +1,26 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DamageCorrupt = "corrupt"
+	DamageMissing = "missing"
+)
+
+// DamagedChunk is a chunk a storage server found corrupt or lost, it waits here to be repaired.
+// A chunk is reported once per server, a later report updates it
+type DamagedChunk struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey;default:(gen_random_uuid())" json:"id"`
+	ServerID  uuid.UUID `gorm:"index:,unique,composite:server_chunk" json:"server_id"`
+	Server    *Server   `json:"-"`
+	User      string    `json:"username"`
+	BlobID    uuid.UUID `gorm:"type:uuid;index:,unique,composite:server_chunk" json:"blob_id"`
+	Number    uint      `gorm:"index:,unique,composite:server_chunk" json:"number"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -41,7 +41,6 @@ func init() {
 
 func NewDb(file string) (*gorm.DB, error) {
 	_ = os.Mkdir(path.Dir(file), fs.ModePerm)
-	_, _ = os.Create(file)
 	conn, err := sql.Open(CustomDriverName, file)
 	if err != nil {
 		return nil, err
@@ -59,8 +58,52 @@ func NewDb(file string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = db.AutoMigrate(&Server{}, &Chunk{})
-	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Server{})
-	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Chunk{})
+	hasUsage := db.Migrator().HasTable(&Usage{})
+	hasLoad := db.Migrator().HasTable(&ServerLoad{})
+	hasLayout := db.Migrator().HasColumn(&File{}, "ChunkCount")
+	hasBlobs := db.Migrator().HasColumn(&File{}, "BlobID")
+	err = db.AutoMigrate(&Server{}, &File{}, &Chunk{}, &Quota{}, &Usage{}, &Garbage{}, &Operation{}, &LifecycleRule{}, &Webhook{}, &Delivery{}, &DamagedChunk{}, &ServerLoad{})
+	if err == nil && !hasUsage {
+		err = rebuildUsage(db)
+	}
+	if err == nil && !hasLayout {
+		err = rebuildLayout(db)
+	}
+	if err == nil && !hasBlobs {
+		// files stored before copies were added keep their content under their own id
+		err = db.Exec(`UPDATE files SET blob_id = id`).Error
+	}
+	if err == nil && db.Migrator().HasIndex(&Chunk{}, "idx_chunks_file_chunk") {
+		// a chunk had a single copy before replication was added
+		err = db.Migrator().DropIndex(&Chunk{}, "idx_chunks_file_chunk")
+	}
+	if err == nil && !hasLoad {
+		err = rebuildLoad(db)
+	}
 	return db, err
 }
+
+// rebuildUsage counts files stored before usage tracking was added
+func rebuildUsage(db *gorm.DB) error {
+	return db.Exec(`INSERT INTO usages (user, dir, bytes, objects)
+		SELECT user, '', sum(size), count(*) FROM files GROUP BY user
+		UNION ALL
+		SELECT user, dir, sum(size), count(*) FROM files GROUP BY user, dir`).Error
+}
+
+// rebuildLoad counts the chunks stored before the servers' load was tracked
+func rebuildLoad(db *gorm.DB) error {
+	return db.Exec(`INSERT INTO server_loads (server_id, chunks, bytes)
+		SELECT server_id, count(*), sum(stored_size) FROM ` + storedChunks + ` GROUP BY server_id`).Error
+}
+
+// rebuildLayout fills the layout of files stored before it was recorded, the chunks were cut in order
+func rebuildLayout(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`UPDATE files SET chunk_count = (SELECT count(*) FROM chunks WHERE chunks.file_id = files.id)`).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`UPDATE chunks SET chunk_offset = (
+			SELECT coalesce(sum(c.size), 0) FROM chunks c WHERE c.file_id = chunks.file_id AND c.number < chunks.number)`).Error
+	})
+}
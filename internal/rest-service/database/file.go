@@ -1,11 +1,96 @@
 package database
 
-import "github.com/google/uuid"
+import (
+	"maps"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
+)
+
+// File is an object of a user, its key is split into Dir, the path of the dirs it's in, and Name.
+// Dir is empty for an object without dirs
 type File struct {
 	ID     uuid.UUID `gorm:"type:uuid;primaryKey;default:(gen_random_uuid())"`
 	User   string    `gorm:"index:,unique,composite:user_file"`
 	Dir    string    `gorm:"index:,unique,composite:user_file"`
 	Name   string    `gorm:"index:,unique,composite:user_file"`
 	Chunks []*Chunk  `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	// BlobID is the id the content is stored with on the storage servers and sealed with.
+	// A copy shares the content of the file, so the chunks stay until no file refers to them
+	BlobID uuid.UUID `gorm:"type:uuid;index"`
+	// Size is the declared size of the file, it is counted in the owner's Usage
+	Size int64
+	// ETag is the hex encoded sha256 of the content, empty for files saved before it was counted
+	ETag string
+	// ChunkCount is the number of chunks the file was cut into, the chunks keep their offsets and sizes.
+	// An empty file has no chunks
+	ChunkCount int
+	// Degraded is set for a file stored on fewer servers than it should be, as there weren't enough of them.
+	// Its chunks are spread out once more servers are active
+	Degraded bool `gorm:"not null;default:false;index"`
+	// Inline is set for small files kept here instead of the storage servers.
+	// InlineData is the file as a chunk would keep it: compressed with InlineCompression and encrypted
+	Inline            bool
+	InlineData        []byte
+	InlineCompression string
+	// KeyID is the master key the data key is wrapped with, empty for files stored unencrypted
+	KeyID      string `gorm:"index"`
+	WrappedKey []byte
+
+	// RetainUntil and LegalHold lock the file, it can't be removed or replaced before RetainUntil or while LegalHold is set.
+	// Only the admin sets them, a copy isn't locked
+	RetainUntil *time.Time
+	LegalHold   bool `gorm:"not null;default:false"`
+
+	ContentType string
+	// Metadata is set by the user with X-Meta-* headers
+	Metadata  map[string]string `gorm:"serializer:json"`
+	CreatedAt time.Time
+	// ModifiedAt changes when the content or the metadata is changed, key rotation doesn't count
+	ModifiedAt time.Time
+}
+
+// copyTo returns a new record of the file under the dir and the name, it shares the content of the file
+func (f *File) copyTo(dir, name string) *File {
+	c := *f
+	c.ID, c.Dir, c.Name = uuid.New(), dir, name
+	c.CreatedAt, c.ModifiedAt = time.Time{}, time.Time{}
+	c.RetainUntil, c.LegalHold = nil, false
+	c.Metadata = maps.Clone(f.Metadata)
+	c.Chunks = make([]*Chunk, len(f.Chunks))
+	for i, chunk := range f.Chunks {
+		cc := *chunk
+		cc.ID, cc.FileID, cc.File = uuid.Nil, c.ID, File{}
+		c.Chunks[i] = &cc
+	}
+	return &c
+}
+
+// Locked tells if the file can't be removed or replaced at now, a missing file isn't locked
+func (f *File) Locked(now time.Time) bool {
+	return f != nil && (f.LegalHold || f.RetainUntil != nil && now.Before(*f.RetainUntil))
+}
+
+// TopDir is the first dir of the path, quotas and usage are counted for it
+func TopDir(dir string) string {
+	top, _, _ := strings.Cut(dir, "/")
+	return top
+}
+
+// JoinKey joins the dir and the name of a file back into its key
+func JoinKey(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// SplitKey splits a normalised key into the dir and the name
+func SplitKey(key string) (string, string) {
+	i := strings.LastIndexByte(key, '/')
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
 }
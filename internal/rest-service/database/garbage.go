@@ -0,0 +1,22 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Garbage is the content of removed files left on a storage server.
+// It's recorded when no file refers to the content any more and deleted from the server in the background
+type Garbage struct {
+	ID       uuid.UUID `gorm:"type:uuid;primaryKey;default:(gen_random_uuid())"`
+	ServerID uuid.UUID `gorm:"index"`
+	Server   *Server
+	User     string
+	BlobID   uuid.UUID `gorm:"type:uuid;index"`
+	// Number is the only chunk of the blob to delete, nil for all of them
+	Number *uint
+	// Attempts counts the failed deletions, a server that is down doesn't hold back the others
+	Attempts  int
+	CreatedAt time.Time
+}
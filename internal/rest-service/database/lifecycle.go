@@ -0,0 +1,22 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LifecycleRule expires the files of a user in Prefix and its nested dirs, an empty Prefix covers all the files.
+// A file expires ExpireDays after it was created, overwriting or copying a file creates it anew
+type LifecycleRule struct {
+	ID         uuid.UUID `gorm:"type:uuid;primaryKey;default:(gen_random_uuid())" json:"id"`
+	User       string    `gorm:"index" json:"-"`
+	Prefix     string    `json:"prefix"`
+	ExpireDays int       `json:"expire_days"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ExpiredBefore is the creation time the files expire before at now
+func (r *LifecycleRule) ExpiredBefore(now time.Time) time.Time {
+	return now.AddDate(0, 0, -r.ExpireDays)
+}
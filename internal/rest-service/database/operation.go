@@ -0,0 +1,46 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	OperationPending = "pending"
+	OperationRunning = "running"
+	OperationDone    = "done"
+	OperationFailed  = "failed"
+)
+
+// OperationDelete removes files, see OperationRequest
+const OperationDelete = "delete"
+
+// Operation is a job a user started to run in the background, it's kept with its report when it's finished.
+// A running operation is resumed after a restart
+type Operation struct {
+	ID        uuid.UUID         `gorm:"type:uuid;primaryKey;default:(gen_random_uuid())" json:"id"`
+	User      string            `gorm:"index" json:"-"`
+	Kind      string            `json:"kind"`
+	Status    string            `gorm:"index" json:"status"`
+	Request   *OperationRequest `gorm:"serializer:json" json:"request"`
+	Report    *OperationReport  `gorm:"serializer:json" json:"report"`
+	Error     string            `json:"error,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// OperationRequest is what a delete operation removes: the Keys, or everything under the Prefix dir
+type OperationRequest struct {
+	Keys   []string `json:"keys,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+}
+
+// OperationReport is the result of an operation, it's updated as the operation goes
+type OperationReport struct {
+	Deleted int `json:"deleted"`
+	// Missing are the keys that weren't found
+	Missing []string `json:"missing,omitempty"`
+	// Failed are the keys that weren't removed, with the reasons
+	Failed map[string]string `json:"failed,omitempty"`
+}
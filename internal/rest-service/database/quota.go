@@ -0,0 +1,18 @@
+package database
+
+// Quota limits what a user can store. Dir is empty for the user-wide quota, zero limits mean no limit
+type Quota struct {
+	User       string `gorm:"primaryKey" json:"user"`
+	Dir        string `gorm:"primaryKey" json:"dir"`
+	MaxBytes   int64  `json:"max_bytes"`
+	MaxObjects int64  `json:"max_objects"`
+}
+
+// Usage is what a user stores, for the user in total (empty Dir) and per dir.
+// It's updated with every file added or removed, so checking a quota doesn't need to scan files or chunks
+type Usage struct {
+	User    string `gorm:"primaryKey" json:"user"`
+	Dir     string `gorm:"primaryKey" json:"dir"`
+	Bytes   int64  `json:"bytes"`
+	Objects int64  `json:"objects"`
+}
@@ -0,0 +1,23 @@
+package database
+
+import "github.com/google/uuid"
+
+// StoredChunk is a chunk as the storage servers keep it, the files sharing the blob share it
+type StoredChunk struct {
+	User   string
+	BlobID uuid.UUID
+	Number uint
+}
+
+// AtRiskChunk is a stored chunk with fewer healthy copies than needed.
+// A copy is healthy when its server isn't dead and no damage is reported for it
+type AtRiskChunk struct {
+	StoredChunk
+	Healthy int
+}
+
+// ChunkCopy is a copy of a stored chunk with its server, Damaged is set when the server reported it
+type ChunkCopy struct {
+	Chunk   *Chunk
+	Damaged bool
+}
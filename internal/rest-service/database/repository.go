@@ -1,7 +1,12 @@
 package database
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"time"
+	"unicode/utf8"
 
 	"github.com/mattn/go-sqlite3"
 
@@ -11,11 +16,21 @@ import (
 )
 
 var (
-	ErrRecordNotFound        = errors.New("record not found")
-	ErrDuplicated            = errors.New("record duplicated")
-	ErrUnexpectedServerCount = errors.New("unexpected server count")
+	ErrRecordNotFound = errors.New("record not found")
+	ErrDuplicated     = errors.New("record duplicated")
+	ErrServerNotEmpty = errors.New("server keeps chunks")
+
+	ErrBytesQuotaExceeded   = errors.New("storage quota exceeded")
+	ErrObjectsQuotaExceeded = errors.New("object count quota exceeded")
+
+	ErrObjectLocked       = errors.New("object is locked")
+	ErrRetentionShortened = errors.New("retention can't be shortened")
 )
 
+// storedChunks are the chunks as the storage servers keep them, copies of a file share them
+const storedChunks = `(SELECT DISTINCT chunks.server_id, files.blob_id, chunks.number, chunks.stored_size
+	FROM chunks JOIN files ON files.id = chunks.file_id) AS chunks`
+
 type Repository struct {
 	db *gorm.DB
 }
@@ -24,65 +39,1196 @@ func NewRepository(db *gorm.DB) *Repository {
 	return &Repository{db: db}
 }
 
-func (r *Repository) AddServer(name, port string) (uuid.UUID, error) {
-	s := &Server{Name: name, Port: port}
+// AddServer registers a storage server, a server registering again after a restart keeps its id and gets the new topology
+func (r *Repository) AddServer(name, port string, topology Topology) (uuid.UUID, error) {
+	s := &Server{}
+	err := r.db.
+		Where(&Server{Name: name, Port: port}).
+		Assign(map[string]any{"zone": topology.Zone, "rack": topology.Rack, "host": topology.Host}).
+		FirstOrCreate(s).Error
+
+	return s.ID, checkError(err)
+}
+
+// GetActiveServers returns the active servers with what they keep, the excluded servers aren't taken
+func (r *Repository) GetActiveServers(exclude ...uuid.UUID) ([]*ServerUsage, error) {
+	var res []*ServerUsage
+	q := r.serverUsage().Where("servers.state = ?", ServerActive)
+	if len(exclude) > 0 {
+		q = q.Where("servers.id NOT IN ?", exclude)
+	}
+	err := q.Order("servers.id").Find(&res).Error
 
-	return s.ID, checkError(r.db.Create(s).Error)
+	return res, checkError(err)
 }
 
-func (r *Repository) GetLeastLoadedServers(num int) ([]*Server, error) {
-	var res []*Server
-	tx := r.db.
+func (r *Repository) serverUsage() *gorm.DB {
+	return r.db.
 		Model(&Server{}).
-		Select("servers.id,servers.name,servers.port, count(chunks.id) as chunk_count").
-		Joins("left join chunks on servers.id = chunks.server_id").
-		Group("servers.id").
-		Order(clause.OrderByColumn{Column: clause.Column{Name: "chunk_count"}, Desc: false}).
-		Limit(num).
-		Find(&res)
+		Select("servers.id,servers.name,servers.port,servers.state,servers.zone,servers.rack,servers.host, coalesce(server_loads.chunks, 0) as chunks, coalesce(server_loads.bytes, 0) as bytes").
+		Joins("left join server_loads on servers.id = server_loads.server_id")
+}
+
+func (r *Repository) GetServerUsage() ([]*ServerUsage, error) {
+	var res []*ServerUsage
+	err := r.serverUsage().Find(&res).Error
 
-	if len(res) != num {
-		return nil, ErrUnexpectedServerCount
+	return res, checkError(err)
+}
+
+// SetServerState sets the state of the server, it returns ErrRecordNotFound for an unknown server
+func (r *Repository) SetServerState(id uuid.UUID, state string) error {
+	res := r.db.Model(&Server{ID: id}).Update("state", state)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrRecordNotFound
 	}
-	return res, tx.Error
+	return checkError(res.Error)
+}
+
+// GetServersByState returns the servers in the state
+func (r *Repository) GetServersByState(state string) ([]*Server, error) {
+	var servers []*Server
+	err := r.db.Where(map[string]any{"state": state}).Find(&servers).Error
+
+	return servers, checkError(err)
+}
+
+// GetServerChunks returns up to limit chunks the server keeps, ordered by the blob and the number.
+// The listing starts after the chunk afterNumber of afterBlob
+func (r *Repository) GetServerChunks(serverID, afterBlob uuid.UUID, afterNumber uint, limit int) ([]*StoredChunk, error) {
+	var chunks []*StoredChunk
+	err := r.db.
+		Table("chunks").
+		Distinct("files.user AS user, files.blob_id AS blob_id, chunks.number AS number").
+		Joins("JOIN files ON files.id = chunks.file_id").
+		Where("chunks.server_id = ? AND (files.blob_id, chunks.number) > (?, ?)", serverID, afterBlob, afterNumber).
+		Order("files.blob_id, chunks.number").
+		Limit(limit).
+		Scan(&chunks).Error
+
+	return chunks, checkError(err)
 }
 
-func (r *Repository) CreateFile(user, dir, name string) (uuid.UUID, error) {
-	f := &File{
-		User: user,
-		Dir:  dir,
-		Name: name,
+// RemoveServer forgets the server with the damage reported by it,
+// it returns ErrServerNotEmpty while a file refers to a chunk on it or garbage is left there
+func (r *Repository) RemoveServer(id uuid.UUID) error {
+	return checkError(r.db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&Chunk{}, &Garbage{}} {
+			var n int64
+			if err := tx.Model(model).Where(map[string]any{"server_id": id}).Count(&n).Error; err != nil {
+				return err
+			}
+			if n > 0 {
+				return ErrServerNotEmpty
+			}
+		}
+		for _, model := range []any{&DamagedChunk{}, &ServerLoad{}} {
+			if err := tx.Where(map[string]any{"server_id": id}).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		res := tx.Delete(&Server{ID: id})
+		if res.Error == nil && res.RowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+		return res.Error
+	}))
+}
+
+func (r *Repository) Ping(ctx context.Context) error {
+	db, err := r.db.DB()
+	if err != nil {
+		return err
 	}
+	return db.PingContext(ctx)
+}
 
-	return f.ID, checkError(r.db.Save(f).Error)
+// GetTotalUsage sums up what all users store
+func (r *Repository) GetTotalUsage() (*Usage, error) {
+	u := &Usage{}
+	err := r.db.
+		Model(&Usage{}).
+		Select("coalesce(sum(bytes), 0) as bytes, coalesce(sum(objects), 0) as objects").
+		Where(map[string]any{"dir": ""}).
+		Scan(u).Error
+
+	return u, checkError(err)
 }
 
 func (r *Repository) GetFile(username, dir, name string) (*File, error) {
 	c := &File{}
 	err := r.db.
-		Preload("Chunks").
+		Preload("Chunks", func(db *gorm.DB) *gorm.DB { return db.Order("number") }).
 		Preload("Chunks.Server").
 		Preload("Chunks.File").
-		First(c, &File{User: username, Dir: dir, Name: name}).Error
+		First(c, map[string]any{"user": username, "dir": dir, "name": name}).Error
 
 	return c, checkError(err)
 }
 
+// ListFiles returns up to limit files of the user right in dir, ordered by name.
+// A recursive listing takes the nested dirs too and is ordered by dir, then name.
+// The listing starts after the file afterDir/afterName, an empty afterName starts it from the beginning.
+// The content of inline files isn't loaded
+func (r *Repository) ListFiles(user, dir string, recursive bool, afterDir, afterName string, limit int) ([]*File, error) {
+	q := r.db.
+		Select("id", "user", "dir", "name", "size", "e_tag", "content_type", "metadata", "created_at", "modified_at").
+		Where("user = ?", user)
+	if recursive {
+		q = inTree(q, dir)
+	} else {
+		q = q.Where("dir = ?", dir)
+	}
+	if afterName != "" {
+		q = q.Where("(dir, name) > (?, ?)", afterDir, afterName)
+	}
+	var files []*File
+	err := q.Order("dir").Order("name").Limit(limit).Find(&files).Error
+
+	return files, checkError(err)
+}
+
+// inTree limits q to the files in dir and its nested dirs
+func inTree(q *gorm.DB, dir string) *gorm.DB {
+	if dir == "" {
+		return q
+	}
+	// the nested dirs sort between "dir/" and "dir0" as '0' follows '/', the index on user, dir and name covers it.
+	// Dirs like "dir-x" sort in the range too and are filtered out
+	return q.Where("dir >= ? AND dir < ? AND (dir = ? OR dir >= ?)", dir, dir+"0", dir, dir+"/")
+}
+
+// ListDirs returns the names of the dirs right in dir, in order
+func (r *Repository) ListDirs(user, dir string) ([]string, error) {
+	q := r.db.Model(&File{}).Where("user = ?", user)
+	from := 1
+	if dir == "" {
+		q = q.Where("dir <> ''")
+	} else {
+		q = q.Where("dir >= ? AND dir < ?", dir+"/", dir+"0")
+		// substr counts characters, not bytes
+		from = utf8.RuneCountInString(dir) + 2
+	}
+	var dirs []string
+	err := q.
+		Distinct("substr(dir, ?, instr(substr(dir, ?) || '/', '/') - 1) AS child", from, from).
+		Order("child").
+		Scan(&dirs).Error
+
+	return dirs, checkError(err)
+}
+
+func (r *Repository) SetFileKey(id uuid.UUID, keyID string, wrappedKey []byte) error {
+	return checkError(r.db.Model(&File{ID: id}).Updates(&File{KeyID: keyID, WrappedKey: wrappedKey}).Error)
+}
+
+// UpdateFileMeta sets the content type of the file if it's not empty and merges the user metadata, an empty value removes the key.
+// The merge is done in one transaction, a locked file isn't changed. It returns the updated file
+func (r *Repository) UpdateFileMeta(user, dir, name, contentType string, metadata map[string]string) (*File, error) {
+	var f *File
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if f, err = findFile(tx, user, dir, name); err != nil {
+			return err
+		}
+		if f == nil {
+			return ErrRecordNotFound
+		}
+		if f.Locked(time.Now()) {
+			return ErrObjectLocked
+		}
+		if contentType != "" {
+			f.ContentType = contentType
+		}
+		for k, v := range metadata {
+			if v == "" {
+				delete(f.Metadata, k)
+				continue
+			}
+			if f.Metadata == nil {
+				f.Metadata = map[string]string{}
+			}
+			f.Metadata[k] = v
+		}
+		f.ModifiedAt = time.Now()
+		return tx.Model(&File{ID: f.ID}).
+			Select("ContentType", "Metadata", "ModifiedAt").
+			Updates(&File{ContentType: f.ContentType, Metadata: f.Metadata, ModifiedAt: f.ModifiedAt}).Error
+	})
+	return f, checkError(err)
+}
+
+// RewrapFileKeys calls rewrap for every encrypted file whose key isn't wrapped with currentKeyID and saves the result.
+// It returns the number of updated files
+func (r *Repository) RewrapFileKeys(currentKeyID string, rewrap func(keyID string, wrappedKey []byte) (string, []byte, error)) (int, error) {
+	var files []*File
+	updated := 0
+	err := r.db.
+		Select("id", "key_id", "wrapped_key").
+		Where("key_id <> '' AND key_id <> ?", currentKeyID).
+		FindInBatches(&files, 100, func(tx *gorm.DB, _ int) error {
+			for _, f := range files {
+				keyID, wrapped, err := rewrap(f.KeyID, f.WrappedKey)
+				if err != nil {
+					return fmt.Errorf("file %s: %w", f.ID, err)
+				}
+				if err := r.SetFileKey(f.ID, keyID, wrapped); err != nil {
+					return err
+				}
+				updated++
+			}
+			return nil
+		}).Error
+
+	return updated, checkError(err)
+}
+
+// PutFile saves the file with its chunks, the file with the same name is replaced.
+// check is called in the same transaction with the replaced file, nil if there is none, an error from it stops the saving.
+// The ObjectCreated event is queued with the change. It returns the replaced file
+func (r *Repository) PutFile(f *File, check func(old *File) error) (*File, error) {
+	var old *File
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		old, err = putFile(tx, f, check)
+		return err
+	})
+	return old, checkError(err)
+}
+
+// CopyFile saves a copy of the file under toDir and toName, the copy shares the chunks of the file.
+// check works as in PutFile with the file the copy replaces. It returns the copy, a copy onto the file itself changes nothing
+func (r *Repository) CopyFile(user, dir, name, toDir, toName string, check func(old *File) error) (*File, error) {
+	var copied *File
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		f, err := findFile(tx, user, dir, name)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			return ErrRecordNotFound
+		}
+		if dir == toDir && name == toName {
+			copied = f
+			if check != nil {
+				return check(f)
+			}
+			return nil
+		}
+		copied = f.copyTo(toDir, toName)
+		_, err = putFile(tx, copied, check)
+		return err
+	})
+	return copied, checkError(err)
+}
+
+// MoveFile renames the file, its chunks stay as they are.
+// check works as in PutFile with the file the moved one replaces, the events of a removed and a created object are queued.
+// It returns the moved file
+func (r *Repository) MoveFile(user, dir, name, toDir, toName string, check func(old *File) error) (*File, error) {
+	var moved *File
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if moved, err = findFile(tx, user, dir, name); err != nil {
+			return err
+		}
+		if moved == nil {
+			return ErrRecordNotFound
+		}
+		if moved.Locked(time.Now()) {
+			return ErrObjectLocked
+		}
+		if dir == toDir && name == toName {
+			if check != nil {
+				return check(moved)
+			}
+			return nil
+		}
+		old, err := findFile(tx, user, toDir, toName)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(old); err != nil {
+				return err
+			}
+		}
+		if old != nil {
+			if err := deleteFile(tx, old, uuid.Nil); err != nil {
+				return err
+			}
+			if err := addUsage(tx, user, toDir, -old.Size, -1); err != nil {
+				return err
+			}
+		}
+		if TopDir(dir) != TopDir(toDir) {
+			if err := addUsage(tx, user, dir, -moved.Size, -1); err != nil {
+				return err
+			}
+			if err := checkQuota(tx, user, toDir, moved.Size, 1); err != nil {
+				return err
+			}
+			if err := addUsage(tx, user, toDir, moved.Size, 1); err != nil {
+				return err
+			}
+		}
+		source := *moved
+		moved.Dir, moved.Name = toDir, toName
+		if err := tx.Model(&File{ID: moved.ID}).Updates(&File{Dir: toDir, Name: toName}).Error; err != nil {
+			return err
+		}
+		return queueEvents(tx, user, NewEvent(EventObjectRemoved, &source), NewEvent(EventObjectCreated, moved))
+	})
+	return moved, checkError(err)
+}
+
+// putFile saves the file replacing the one with the same name, see PutFile
+func putFile(tx *gorm.DB, f *File, check func(old *File) error) (*File, error) {
+	old, err := findFile(tx, f.User, f.Dir, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	if check != nil {
+		if err := check(old); err != nil {
+			return nil, err
+		}
+	}
+	bytes, objects := f.Size, int64(1)
+	if old != nil {
+		bytes, objects = f.Size-old.Size, 0
+		if err := deleteFile(tx, old, f.BlobID); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkQuota(tx, f.User, f.Dir, bytes, objects); err != nil {
+		return nil, err
+	}
+	setDefaults(f)
+	if err := tx.Omit(clause.Associations).Create(f).Error; err != nil {
+		return nil, err
+	}
+	if len(f.Chunks) > 0 {
+		for _, c := range f.Chunks {
+			c.FileID = f.ID
+		}
+		if err := tx.Omit(clause.Associations).Create(&f.Chunks).Error; err != nil {
+			return nil, err
+		}
+		// the content of a copy is on the servers already
+		var refs int64
+		if err := tx.Model(&File{}).Where(&File{BlobID: f.BlobID}).Count(&refs).Error; err != nil {
+			return nil, err
+		}
+		if refs == 1 {
+			if err := addLoad(tx, f.Chunks, 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := addUsage(tx, f.User, f.Dir, bytes, objects); err != nil {
+		return nil, err
+	}
+	return old, queueEvents(tx, f.User, NewEvent(EventObjectCreated, f))
+}
+
+// setDefaults fills what a new file record needs, the content of a new file is stored under its own id
+func setDefaults(f *File) {
+	if f.ID == uuid.Nil {
+		f.ID = uuid.New()
+	}
+	if f.BlobID == uuid.Nil {
+		f.BlobID = f.ID
+	}
+	if f.ModifiedAt.IsZero() {
+		f.ModifiedAt = time.Now()
+	}
+}
+
+// DeleteFile removes the file and queues the ObjectRemoved event, check works as in PutFile. It returns the removed file
+func (r *Repository) DeleteFile(user, dir, name string, check func(old *File) error) (*File, error) {
+	var old *File
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if old, err = findFile(tx, user, dir, name); err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(old); err != nil {
+				return err
+			}
+		}
+		if old == nil {
+			return ErrRecordNotFound
+		}
+		if err := deleteFile(tx, old, uuid.Nil); err != nil {
+			return err
+		}
+		if err := addUsage(tx, old.User, old.Dir, -old.Size, -1); err != nil {
+			return err
+		}
+		return queueEvents(tx, user, NewEvent(EventObjectRemoved, old))
+	})
+	return old, checkError(err)
+}
+
+// DeleteFiles removes the files of the user named by Dir and Name of the given ones, in one transaction.
+// It returns the removed files and the locked ones, which are kept, the missing ones are skipped.
+// The ObjectRemoved events are queued with the change
+func (r *Repository) DeleteFiles(user string, files []*File) ([]*File, []*File, error) {
+	var removed, locked []*File
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for _, f := range files {
+			old, err := findFile(tx, user, f.Dir, f.Name)
+			if err != nil {
+				return err
+			}
+			if old == nil {
+				continue
+			}
+			if old.Locked(now) {
+				locked = append(locked, old)
+				continue
+			}
+			if err := deleteFile(tx, old, uuid.Nil); err != nil {
+				return err
+			}
+			if err := addUsage(tx, user, old.Dir, -old.Size, -1); err != nil {
+				return err
+			}
+			removed = append(removed, old)
+		}
+		events := make([]*Event, len(removed))
+		for i, f := range removed {
+			events[i] = NewEvent(EventObjectRemoved, f)
+		}
+		return queueEvents(tx, user, events...)
+	})
+	if err != nil {
+		return nil, nil, checkError(err)
+	}
+	return removed, locked, nil
+}
+
+// findFile returns the file with its chunks or nil if there is no such file
+func findFile(tx *gorm.DB, user, dir, name string) (*File, error) {
+	var files []*File
+	err := tx.
+		Preload("Chunks", func(db *gorm.DB) *gorm.DB { return db.Order("number") }).
+		Preload("Chunks.Server").
+		Where(map[string]any{"user": user, "dir": dir, "name": name}).
+		Limit(1).
+		Find(&files).Error
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// deleteFile removes the file found with findFile, its content is left as garbage if no other file refers to it
+// and it isn't the blob keep of the record replacing the file. A locked file isn't removed
+func deleteFile(tx *gorm.DB, f *File, keep uuid.UUID) error {
+	if f.Locked(time.Now()) {
+		return ErrObjectLocked
+	}
+	if err := tx.Where(&Chunk{FileID: f.ID}).Delete(&Chunk{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Delete(&File{}, &File{ID: f.ID}).Error; err != nil {
+		return err
+	}
+	if len(f.Chunks) == 0 {
+		return nil
+	}
+	var refs int64
+	if err := tx.Model(&File{}).Where(&File{BlobID: f.BlobID}).Count(&refs).Error; err != nil || refs > 0 {
+		return err
+	}
+	if err := addLoad(tx, f.Chunks, -1); err != nil {
+		return err
+	}
+	if f.BlobID == keep {
+		return nil
+	}
+	// the whole blob takes the place of its chunks left to delete
+	if err := tx.Where("blob_id = ? AND number IS NOT NULL", f.BlobID).Delete(&Garbage{}).Error; err != nil {
+		return err
+	}
+	servers := map[uuid.UUID]bool{}
+	var garbage []*Garbage
+	for _, c := range f.Chunks {
+		if !servers[c.ServerID] {
+			servers[c.ServerID] = true
+			garbage = append(garbage, &Garbage{ServerID: c.ServerID, User: f.User, BlobID: f.BlobID})
+		}
+	}
+	return tx.Create(&garbage).Error
+}
+
+// unlocked limits q to the files that aren't locked now, locked files don't expire
+func unlocked(q *gorm.DB) *gorm.DB {
+	return q.Where("NOT legal_hold AND (retain_until IS NULL OR retain_until <= ?)", time.Now())
+}
+
+// ExpiredFiles lists the unlocked files of the user in dir and its nested dirs created before the time, ordered like ListFiles
+func (r *Repository) ExpiredFiles(user, dir string, before time.Time, afterDir, afterName string, limit int) ([]*File, error) {
+	q := inTree(unlocked(r.db.Select("id", "user", "dir", "name", "size", "created_at").Where("user = ? AND created_at < ?", user, before)), dir)
+	if afterName != "" {
+		q = q.Where("(dir, name) > (?, ?)", afterDir, afterName)
+	}
+	var files []*File
+	err := q.Order("dir").Order("name").Limit(limit).Find(&files).Error
+
+	return files, checkError(err)
+}
+
+// CountExpiredFiles counts the files ExpiredFiles lists and their size
+func (r *Repository) CountExpiredFiles(user, dir string, before time.Time) (*Usage, error) {
+	usage := &Usage{User: user, Dir: dir}
+	err := inTree(unlocked(r.db.Model(&File{}).Where("user = ? AND created_at < ?", user, before)), dir).
+		Select("count(*) AS objects, coalesce(sum(size), 0) AS bytes").
+		Scan(usage).Error
+
+	return usage, checkError(err)
+}
+
+// ExpireFiles removes up to limit unlocked files of the user in dir and its nested dirs created before the time.
+// The files are found and removed in a transaction with their ObjectExpired events, so a file written meanwhile stays
+func (r *Repository) ExpireFiles(user, dir string, before time.Time, limit int) ([]*File, error) {
+	var removed []*File
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		q := inTree(unlocked(tx.Preload("Chunks").Where("user = ? AND created_at < ?", user, before)), dir)
+		if err := q.Limit(limit).Find(&removed).Error; err != nil {
+			return err
+		}
+		for _, f := range removed {
+			if err := deleteFile(tx, f, uuid.Nil); err != nil {
+				return err
+			}
+			if err := addUsage(tx, user, f.Dir, -f.Size, -1); err != nil {
+				return err
+			}
+		}
+		events := make([]*Event, len(removed))
+		for i, f := range removed {
+			events[i] = NewEvent(EventObjectExpired, f)
+		}
+		return queueEvents(tx, user, events...)
+	})
+	if err != nil {
+		return nil, checkError(err)
+	}
+	return removed, nil
+}
+
+// SetFileLock sets the retention and the legal hold of the file, a retention that is in force can only be extended.
+// A nil retainUntil removes an expired retention
+func (r *Repository) SetFileLock(user, dir, name string, retainUntil *time.Time, legalHold bool) (*File, error) {
+	var f *File
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if f, err = findFile(tx, user, dir, name); err != nil {
+			return err
+		}
+		if f == nil {
+			return ErrRecordNotFound
+		}
+		if f.RetainUntil != nil && time.Now().Before(*f.RetainUntil) && (retainUntil == nil || retainUntil.Before(*f.RetainUntil)) {
+			return ErrRetentionShortened
+		}
+		f.RetainUntil, f.LegalHold = retainUntil, legalHold
+		return tx.Model(&File{ID: f.ID}).Select("retain_until", "legal_hold").Updates(f).Error
+	})
+	return f, checkError(err)
+}
+
+// GetBlobLock returns the latest retention and the legal hold of the files sharing the content, it's locked while any of them is
+func (r *Repository) GetBlobLock(blobID uuid.UUID) (*time.Time, bool, error) {
+	var files []*File
+	if err := r.db.Select("retain_until", "legal_hold").Where(&File{BlobID: blobID}).Find(&files).Error; err != nil {
+		return nil, false, checkError(err)
+	}
+	var retainUntil *time.Time
+	legalHold := false
+	for _, f := range files {
+		if f.RetainUntil != nil && (retainUntil == nil || f.RetainUntil.After(*retainUntil)) {
+			retainUntil = f.RetainUntil
+		}
+		legalHold = legalHold || f.LegalHold
+	}
+	return retainUntil, legalHold, nil
+}
+
+func (r *Repository) AddLifecycleRule(rule *LifecycleRule) error {
+	return checkError(r.db.Create(rule).Error)
+}
+
+// GetLifecycleRules returns the rules of the user, or the rules of all the users for an empty user
+func (r *Repository) GetLifecycleRules(user string) ([]*LifecycleRule, error) {
+	q := r.db.Order("created_at")
+	if user != "" {
+		q = q.Where(&LifecycleRule{User: user})
+	}
+	var rules []*LifecycleRule
+	err := q.Find(&rules).Error
+
+	return rules, checkError(err)
+}
+
+// RemoveLifecycleRule returns ErrRecordNotFound if the user has no such rule
+func (r *Repository) RemoveLifecycleRule(user string, id uuid.UUID) error {
+	res := r.db.Where(&LifecycleRule{User: user}).Delete(&LifecycleRule{}, &LifecycleRule{ID: id})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return checkError(res.Error)
+}
+
+func (r *Repository) AddWebhook(w *Webhook) error {
+	return checkError(r.db.Create(w).Error)
+}
+
+func (r *Repository) GetWebhooks(user string) ([]*Webhook, error) {
+	var hooks []*Webhook
+	err := r.db.Where(&Webhook{User: user}).Order("created_at").Find(&hooks).Error
+
+	return hooks, checkError(err)
+}
+
+// RemoveWebhook removes the webhook with its deliveries, it returns ErrRecordNotFound if the user has no such webhook
+func (r *Repository) RemoveWebhook(user string, id uuid.UUID) error {
+	return checkError(r.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where(&Webhook{User: user}).Delete(&Webhook{}, &Webhook{ID: id})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+		return tx.Where(&Delivery{WebhookID: id}).Delete(&Delivery{}).Error
+	}))
+}
+
+// queueEvents puts the events of the user's objects into the outbox in the transaction of the change,
+// a delivery for every webhook that matches. The events of a change that is rolled back are never sent
+func queueEvents(tx *gorm.DB, user string, events ...*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var hooks []*Webhook
+	if err := tx.Where(&Webhook{User: user}).Find(&hooks).Error; err != nil || len(hooks) == 0 {
+		return err
+	}
+	var deliveries []*Delivery
+	for _, e := range events {
+		for _, w := range hooks {
+			if w.Matches(e) {
+				deliveries = append(deliveries, &Delivery{WebhookID: w.ID, Event: e, NextAttemptAt: e.Time})
+			}
+		}
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return tx.Create(&deliveries).Error
+}
+
+// GetDueDeliveries returns up to limit deliveries to be sent at now with their webhooks, the oldest first
+func (r *Repository) GetDueDeliveries(now time.Time, limit int) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	err := r.db.Preload("Webhook").
+		Where("NOT dead AND next_attempt_at <= ?", now).
+		Order("next_attempt_at").
+		Limit(limit).
+		Find(&deliveries).Error
+
+	return deliveries, checkError(err)
+}
+
+// UpdateDelivery saves a failed attempt of the delivery
+func (r *Repository) UpdateDelivery(d *Delivery) error {
+	return checkError(r.db.Model(&Delivery{ID: d.ID}).
+		Select("attempts", "next_attempt_at", "last_error", "dead").
+		Updates(d).Error)
+}
+
+// RemoveDeliveries removes the sent deliveries
+func (r *Repository) RemoveDeliveries(ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return checkError(r.db.Delete(&Delivery{}, "id IN ?", ids).Error)
+}
+
+// GetDeadDeliveries returns up to limit dead deliveries of the user's webhook, the oldest first
+func (r *Repository) GetDeadDeliveries(user string, webhookID uuid.UUID, limit int) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	err := r.db.
+		Where("dead AND webhook_id IN (?)", r.db.Model(&Webhook{}).Select("id").Where("id = ? AND user = ?", webhookID, user)).
+		Order("created_at").
+		Limit(limit).
+		Find(&deliveries).Error
+
+	return deliveries, checkError(err)
+}
+
+// RetryDeadDeliveries queues the dead deliveries of the user's webhook again, it returns their number
+func (r *Repository) RetryDeadDeliveries(user string, webhookID uuid.UUID) (int, error) {
+	res := r.db.Model(&Delivery{}).
+		Where("dead AND webhook_id IN (?)", r.db.Model(&Webhook{}).Select("id").Where("id = ? AND user = ?", webhookID, user)).
+		Updates(map[string]any{"dead": false, "attempts": 0, "next_attempt_at": time.Now()})
+
+	return int(res.RowsAffected), checkError(res.Error)
+}
+
+// AddGarbage records the content stored on the servers as garbage, for a file that wasn't saved
+func (r *Repository) AddGarbage(user string, blobID uuid.UUID, servers []uuid.UUID) error {
+	garbage := make([]*Garbage, len(servers))
+	for i, s := range servers {
+		garbage[i] = &Garbage{ServerID: s, User: user, BlobID: blobID}
+	}
+	return checkError(r.db.Create(&garbage).Error)
+}
+
+// GetGarbage returns up to limit garbage records with their servers, the ones failed less often first
+func (r *Repository) GetGarbage(limit int) ([]*Garbage, error) {
+	var garbage []*Garbage
+	err := r.db.
+		Preload("Server").
+		Order("attempts").
+		Order("created_at").
+		Limit(limit).
+		Find(&garbage).Error
+
+	return garbage, checkError(err)
+}
+
+// RemoveGarbage forgets the garbage deleted from the servers with the damage reported for it
+func (r *Repository) RemoveGarbage(ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return checkError(r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where(`EXISTS (SELECT 1 FROM garbages WHERE garbages.id IN ?
+			AND garbages.server_id = damaged_chunks.server_id AND garbages.blob_id = damaged_chunks.blob_id
+			AND (garbages.number IS NULL OR garbages.number = damaged_chunks.number))`, ids).
+			Delete(&DamagedChunk{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&Garbage{}, ids).Error
+	}))
+}
+
+// GetBlobGarbage returns the servers the blob or some of its chunks are still to be deleted from
+func (r *Repository) GetBlobGarbage(blobID uuid.UUID) ([]uuid.UUID, error) {
+	var servers []uuid.UUID
+	err := r.db.Model(&Garbage{}).Distinct("server_id").Where(map[string]any{"blob_id": blobID}).Pluck("server_id", &servers).Error
+
+	return servers, checkError(err)
+}
+
+// RetryGarbage counts a failed deletion of the garbage
+func (r *Repository) RetryGarbage(ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return checkError(r.db.Model(&Garbage{}).Where("id IN ?", ids).Update("attempts", gorm.Expr("attempts + 1")).Error)
+}
+
+// AddDamagedChunks records the damaged chunks the server with the name and the port reported,
+// it returns ErrRecordNotFound for an unknown server. A chunk no file refers to is garbage, it isn't recorded.
+// It returns the number of the chunks recorded
+func (r *Repository) AddDamagedChunks(name, port string, chunks []*DamagedChunk) (int, error) {
+	server := &Server{}
+	if err := r.db.Where(&Server{Name: name, Port: port}).First(server).Error; err != nil {
+		return 0, checkError(err)
+	}
+	var known []*DamagedChunk
+	for _, c := range chunks {
+		var n int64
+		err := r.db.Model(&Chunk{}).
+			Joins("JOIN files ON files.id = chunks.file_id").
+			Where("chunks.server_id = ? AND files.user = ? AND files.blob_id = ? AND chunks.number = ?", server.ID, c.User, c.BlobID, c.Number).
+			Count(&n).Error
+		if err != nil {
+			return 0, checkError(err)
+		}
+		if n > 0 {
+			c.ServerID = server.ID
+			known = append(known, c)
+		}
+	}
+	if len(known) == 0 {
+		return 0, nil
+	}
+	err := r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "server_id"}, {Name: "blob_id"}, {Name: "number"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason", "updated_at"}),
+	}).Create(&known).Error
+
+	return len(known), checkError(err)
+}
+
+// GetDamagedChunks returns up to limit damaged chunks with their servers, the oldest first
+func (r *Repository) GetDamagedChunks(limit int) ([]*DamagedChunk, error) {
+	var chunks []*DamagedChunk
+	err := r.db.Preload("Server").Order("created_at").Limit(limit).Find(&chunks).Error
+
+	return chunks, checkError(err)
+}
+
+// chunkHealth groups the stored chunks with the number of their healthy copies, see AtRiskChunk
+func (r *Repository) chunkHealth() *gorm.DB {
+	return r.db.
+		Table("chunks").
+		Select(`files.user AS user, files.blob_id AS blob_id, chunks.number AS number,
+			count(DISTINCT CASE WHEN servers.state != ? AND damaged_chunks.id IS NULL THEN chunks.server_id END) AS healthy`, ServerDead).
+		Joins("JOIN files ON files.id = chunks.file_id").
+		Joins("JOIN servers ON servers.id = chunks.server_id").
+		Joins(`LEFT JOIN damaged_chunks ON damaged_chunks.server_id = chunks.server_id
+			AND damaged_chunks.blob_id = files.blob_id AND damaged_chunks.number = chunks.number`).
+		Group("files.blob_id, chunks.number")
+}
+
+// GetAtRiskChunks returns up to limit chunks with exactly healthy healthy copies, ordered by the blob and the number.
+// The listing starts after the chunk afterNumber of afterBlob
+func (r *Repository) GetAtRiskChunks(healthy int, afterBlob uuid.UUID, afterNumber uint, limit int) ([]*AtRiskChunk, error) {
+	var chunks []*AtRiskChunk
+	err := r.chunkHealth().
+		Having("healthy = ? AND (files.blob_id, chunks.number) > (?, ?)", healthy, afterBlob, afterNumber).
+		Order("files.blob_id, chunks.number").
+		Limit(limit).
+		Scan(&chunks).Error
+
+	return chunks, checkError(err)
+}
+
+// CountAtRiskChunks counts the chunks with fewer healthy copies than replicas by the number of the healthy ones
+func (r *Repository) CountAtRiskChunks(replicas int) (map[int]int64, error) {
+	var rows []struct {
+		Healthy int
+		Chunks  int64
+	}
+	err := r.db.
+		Table("(?) AS health", r.chunkHealth()).
+		Select("healthy, count(*) AS chunks").
+		Where("healthy < ?", replicas).
+		Group("healthy").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, checkError(err)
+	}
+	res := make(map[int]int64, len(rows))
+	for _, row := range rows {
+		res[row.Healthy] = row.Chunks
+	}
+	return res, nil
+}
+
+// GetChunkCopies returns a copy of the chunk of the blob from every server keeping it
+func (r *Repository) GetChunkCopies(blobID uuid.UUID, number uint) ([]*ChunkCopy, error) {
+	var chunks []*Chunk
+	err := r.db.
+		Preload("Server").
+		Joins("JOIN files ON files.id = chunks.file_id").
+		Where("files.blob_id = ? AND chunks.number = ?", blobID, number).
+		Find(&chunks).Error
+	if err != nil {
+		return nil, checkError(err)
+	}
+	var damaged []*DamagedChunk
+	if err := r.db.Where(map[string]any{"blob_id": blobID, "number": number}).Find(&damaged).Error; err != nil {
+		return nil, checkError(err)
+	}
+	isDamaged := map[uuid.UUID]bool{}
+	for _, d := range damaged {
+		isDamaged[d.ServerID] = true
+	}
+	seen := map[uuid.UUID]bool{}
+	var copies []*ChunkCopy
+	for _, c := range chunks {
+		if !seen[c.ServerID] {
+			seen[c.ServerID] = true
+			copies = append(copies, &ChunkCopy{Chunk: c, Damaged: isDamaged[c.ServerID]})
+		}
+	}
+	return copies, nil
+}
+
+// ReplaceChunkCopies records the new copies of the chunk of the blob on the added servers and forgets the ones on the dropped servers,
+// for every file sharing the blob. The chunk is garbage on a dropped server, the whole blob if the server keeps no other chunk of it.
+// It returns ErrRecordNotFound if no file refers to the blob any more
+func (r *Repository) ReplaceChunkCopies(blobID uuid.UUID, number uint, added, dropped []uuid.UUID) error {
+	return checkError(r.db.Transaction(func(tx *gorm.DB) error {
+		var chunks []*Chunk
+		err := tx.
+			Joins("JOIN files ON files.id = chunks.file_id").
+			Where("files.blob_id = ? AND chunks.number = ?", blobID, number).
+			Find(&chunks).Error
+		if err != nil {
+			return err
+		}
+		if len(chunks) == 0 {
+			return ErrRecordNotFound
+		}
+		fileIDs, dropping := map[uuid.UUID]bool{}, map[uuid.UUID]bool{}
+		// stored are the new copies and gone are the dropped ones, once for every server
+		var copies, stored, gone []*Chunk
+		for _, c := range chunks {
+			if slices.Contains(dropped, c.ServerID) && !dropping[c.ServerID] {
+				dropping[c.ServerID] = true
+				gone = append(gone, c)
+			}
+			if fileIDs[c.FileID] {
+				continue
+			}
+			first := len(fileIDs) == 0
+			fileIDs[c.FileID] = true
+			for _, server := range added {
+				cc := *c
+				cc.ID, cc.ServerID, cc.Server = uuid.Nil, server, nil
+				copies = append(copies, &cc)
+				if first {
+					stored = append(stored, &cc)
+				}
+			}
+		}
+		if len(copies) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&copies).Error; err != nil {
+				return err
+			}
+		}
+		if err := addLoad(tx, stored, 1); err != nil {
+			return err
+		}
+		if len(dropped) == 0 {
+			return nil
+		}
+		if err := addLoad(tx, gone, -1); err != nil {
+			return err
+		}
+		ids := make([]uuid.UUID, 0, len(fileIDs))
+		for id := range fileIDs {
+			ids = append(ids, id)
+		}
+		err = tx.Where("file_id IN ? AND number = ? AND server_id IN ?", ids, number, dropped).Delete(&Chunk{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("blob_id = ? AND number = ? AND server_id IN ?", blobID, number, dropped).Delete(&DamagedChunk{}).Error
+		if err != nil {
+			return err
+		}
+		var keeping []uuid.UUID
+		err = tx.Model(&Chunk{}).
+			Distinct("chunks.server_id").
+			Where("file_id IN ? AND server_id IN ?", ids, dropped).
+			Pluck("chunks.server_id", &keeping).Error
+		if err != nil {
+			return err
+		}
+		// a dropped server that keeps other chunks of the blob deletes only this one,
+		// the whole blob takes the place of the chunks left to delete before
+		garbage := make([]*Garbage, len(dropped))
+		var whole []uuid.UUID
+		for i, server := range dropped {
+			garbage[i] = &Garbage{ServerID: server, BlobID: blobID}
+			if slices.Contains(keeping, server) {
+				garbage[i].Number = &number
+			} else {
+				whole = append(whole, server)
+			}
+		}
+		if len(whole) > 0 {
+			if err := tx.Where("server_id IN ? AND blob_id = ? AND number IS NOT NULL", whole, blobID).Delete(&Garbage{}).Error; err != nil {
+				return err
+			}
+		}
+		file := &File{}
+		if err := tx.Select("user").First(file, chunks[0].FileID).Error; err != nil {
+			return err
+		}
+		for _, g := range garbage {
+			g.User = file.User
+		}
+		return tx.Create(&garbage).Error
+	}))
+}
+
+// GetDegradedFiles returns up to limit degraded files with their chunks, a file for every blob, ordered by the blob.
+// The listing starts after afterBlob
+func (r *Repository) GetDegradedFiles(afterBlob uuid.UUID, limit int) ([]*File, error) {
+	var files []*File
+	first := r.db.Model(&File{}).Select("MIN(id)").Where("degraded AND blob_id > ?", afterBlob).Group("blob_id")
+	err := r.db.
+		Select("id", "user", "blob_id", "chunk_count").
+		Preload("Chunks", func(db *gorm.DB) *gorm.DB { return db.Order("number") }).
+		Preload("Chunks.Server").
+		Where("id IN (?)", first).
+		Order("blob_id").
+		Limit(limit).
+		Find(&files).Error
+
+	return files, checkError(err)
+}
+
+// ClearDegraded marks the files sharing the blob as stored on enough servers
+func (r *Repository) ClearDegraded(blobID uuid.UUID) error {
+	return checkError(r.db.Model(&File{}).Where(map[string]any{"blob_id": blobID}).Update("degraded", false).Error)
+}
+
+// RemoveDamagedChunk forgets the damage of the chunk of the blob on the server once the chunk is stored there again
+func (r *Repository) RemoveDamagedChunk(serverID, blobID uuid.UUID, number uint) error {
+	return checkError(r.db.Where(map[string]any{"server_id": serverID, "blob_id": blobID, "number": number}).Delete(&DamagedChunk{}).Error)
+}
+
+func (r *Repository) CreateOperation(op *Operation) error {
+	return checkError(r.db.Create(op).Error)
+}
+
+func (r *Repository) UpdateOperation(op *Operation) error {
+	return checkError(r.db.Save(op).Error)
+}
+
+// GetOperation returns the operation if it belongs to the user
+func (r *Repository) GetOperation(user string, id uuid.UUID) (*Operation, error) {
+	op := &Operation{}
+	err := r.db.Where("user = ?", user).First(op, &Operation{ID: id}).Error
+
+	return op, checkError(err)
+}
+
+// NextOperation returns the oldest operation that isn't finished, an interrupted one comes first
+func (r *Repository) NextOperation() (*Operation, error) {
+	op := &Operation{}
+	err := r.db.
+		Where("status IN ?", []string{OperationRunning, OperationPending}).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: "status"}, Desc: true}).
+		Order("created_at").
+		First(op).Error
+
+	return op, checkError(err)
+}
+
+// RemoveFile removes the file with the id as DeleteFile does, a locked file isn't removed
 func (r *Repository) RemoveFile(id uuid.UUID) error {
-	return checkError(r.db.Delete(&File{}, &File{ID: id}).Error)
+	return checkError(r.db.Transaction(func(tx *gorm.DB) error {
+		f := &File{}
+		if err := tx.Preload("Chunks").First(f, &File{ID: id}).Error; err != nil {
+			return err
+		}
+		if err := deleteFile(tx, f, uuid.Nil); err != nil {
+			return err
+		}
+		if err := addUsage(tx, f.User, f.Dir, -f.Size, -1); err != nil {
+			return err
+		}
+		return queueEvents(tx, f.User, NewEvent(EventObjectRemoved, f))
+	}))
 }
 
-func (r *Repository) SaveChunk(file uuid.UUID, server uuid.UUID, number uint) (uuid.UUID, error) {
-	c := &Chunk{
-		Number:   number,
-		ServerID: server,
-		FileID:   file,
+// CheckQuota returns an error if the user can't add the bytes and the objects to the dir, the quota of its top dir counts
+func (r *Repository) CheckQuota(user, dir string, bytes, objects int64) error {
+	return checkQuota(r.db, user, dir, bytes, objects)
+}
+
+func (r *Repository) SetQuota(q *Quota) error {
+	return checkError(r.db.Save(q).Error)
+}
+
+func (r *Repository) RemoveQuota(user, dir string) error {
+	return checkError(r.db.Where(map[string]any{"user": user, "dir": dir}).Delete(&Quota{}).Error)
+}
+
+func (r *Repository) GetQuotas(user string) ([]*Quota, []*Usage, error) {
+	var quotas []*Quota
+	if err := r.db.Where(&Quota{User: user}).Order("dir").Find(&quotas).Error; err != nil {
+		return nil, nil, checkError(err)
+	}
+	var usage []*Usage
+	if err := r.db.Where(&Usage{User: user}).Order("dir").Find(&usage).Error; err != nil {
+		return nil, nil, checkError(err)
 	}
+	return quotas, usage, nil
+}
+
+func checkQuota(tx *gorm.DB, user, dir string, bytes, objects int64) error {
+	dir = TopDir(dir)
+	var quotas []*Quota
+	if err := tx.Where("user = ? AND dir IN ?", user, []string{"", dir}).Find(&quotas).Error; err != nil {
+		return err
+	}
+	for _, q := range quotas {
+		u := &Usage{}
+		if err := tx.Where(map[string]any{"user": q.User, "dir": q.Dir}).Limit(1).Find(u).Error; err != nil {
+			return err
+		}
+		if q.MaxBytes > 0 && bytes > 0 && u.Bytes+bytes > q.MaxBytes {
+			return ErrBytesQuotaExceeded
+		}
+		if q.MaxObjects > 0 && objects > 0 && u.Objects+objects > q.MaxObjects {
+			return ErrObjectsQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// addUsage adds the deltas to the user total and to the top dir
+func addUsage(tx *gorm.DB, user, dir string, bytes, objects int64) error {
+	dir = TopDir(dir)
+	dirs := []string{""}
+	if dir != "" {
+		dirs = append(dirs, dir)
+	}
+	for _, d := range dirs {
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "user"}, {Name: "dir"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"bytes":   gorm.Expr("bytes + ?", bytes),
+				"objects": gorm.Expr("objects + ?", objects),
+			}),
+		}).Create(&Usage{User: user, Dir: d, Bytes: bytes, Objects: objects}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return c.ID, checkError(r.db.Save(c).Error)
+// addLoad adds the chunks to the load of their servers, a negative sign takes them off
+func addLoad(tx *gorm.DB, chunks []*Chunk, sign int64) error {
+	loads := map[uuid.UUID]*ServerLoad{}
+	var order []*ServerLoad
+	for _, c := range chunks {
+		l, ok := loads[c.ServerID]
+		if !ok {
+			l = &ServerLoad{ServerID: c.ServerID}
+			loads[c.ServerID] = l
+			order = append(order, l)
+		}
+		l.Chunks += sign
+		l.Bytes += sign * c.StoredSize
+	}
+	for _, l := range order {
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "server_id"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"chunks": gorm.Expr("chunks + ?", l.Chunks),
+				"bytes":  gorm.Expr("bytes + ?", l.Bytes),
+			}),
+		}).Create(l).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func checkError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrRecordNotFound
+	}
 	var sqliteErr sqlite3.Error
 	if errors.As(err, &sqliteErr) {
 		switch sqliteErr.Code {
@@ -1,13 +1,11 @@
 package database
 
 import (
-	"errors"
 	"fmt"
+	"slices"
 	"testing"
+	"time"
 
-	"github.com/google/go-cmp/cmp/cmpopts"
-
-	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -24,6 +22,15 @@ func setup() *Repository {
 	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Server{})
 	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&File{})
 	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Chunk{})
+	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Quota{})
+	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Usage{})
+	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Garbage{})
+	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Operation{})
+	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&LifecycleRule{})
+	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Webhook{})
+	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Delivery{})
+	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&DamagedChunk{})
+	db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&ServerLoad{})
 	return NewRepository(db)
 }
 
@@ -40,7 +47,7 @@ func TestRepository_AddServerGetServer(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := repo.AddServer(tt.name, tt.port)
+			_, err := repo.AddServer(tt.name, tt.port, Topology{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("AddServer() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -57,115 +64,92 @@ func TestRepository_AddServerGetServer(t *testing.T) {
 
 		})
 	}
+	t.Run("register again", func(t *testing.T) {
+		first, err := repo.AddServer("TestServer1", "8080", Topology{})
+		assert.NoError(t, err)
+		second, err := repo.AddServer("TestServer1", "8080", Topology{Zone: "eu", Rack: "r1"})
+		assert.NoError(t, err)
+		assert.Equal(t, first, second)
+		res := &Server{}
+		assert.NoError(t, repo.db.First(res, second).Error)
+		assert.Equal(t, Topology{Zone: "eu", Rack: "r1"}, res.Topology)
+	})
 }
 
-func TestRepository_GetLeastLoadedServer(t *testing.T) {
+func TestServer_Domain(t *testing.T) {
+	labeled := &Server{Name: "node1", Topology: Topology{Zone: "eu", Rack: "r1", Host: "h1"}}
+	unlabeled := &Server{Name: "node2"}
+	tests := []struct {
+		level     string
+		labeled   string
+		unlabeled string
+	}{
+		{level: "", labeled: "", unlabeled: ""},
+		{level: DomainZone, labeled: "eu", unlabeled: ""},
+		{level: DomainRack, labeled: "eu/r1", unlabeled: "/"},
+		{level: DomainHost, labeled: "eu/r1/h1", unlabeled: "//node2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			assert.Equal(t, tt.labeled, labeled.Domain(tt.level))
+			assert.Equal(t, tt.unlabeled, unlabeled.Domain(tt.level))
+		})
+	}
+}
+
+func TestRepository_GetActiveServers(t *testing.T) {
 	repo := setup()
 	saved := make([]uuid.UUID, 0, 6)
-	for i := 0; i < 8; i++ {
-		server, err := repo.AddServer(fmt.Sprintf("GetLeastLoadedServer%d", i), "123")
+	for i := 0; i < 4; i++ {
+		server, err := repo.AddServer(fmt.Sprintf("GetActiveServers%d", i), "123", Topology{})
 		if err != nil {
 			t.Fatalf("can't save server: %s", err)
 		}
 		saved = append(saved, server)
-		file, err := repo.CreateFile("username_GetLeastLoadedServer", "dir_GetLeastLoadedServer", fmt.Sprintf("GetLeastLoadedServer_%d", i))
-		if err != nil {
-			t.Fatalf("can't save file: %s", err)
-		}
+		file := &File{User: "username_GetActiveServers", Dir: "dir_GetActiveServers", Name: fmt.Sprintf("GetActiveServers_%d", i), ChunkCount: i}
 		for ii := 0; ii < i; ii++ {
-			if _, err := repo.SaveChunk(file, server, uint(ii)); err != nil {
-				t.Fatalf("can't save chunk: %s", err)
-			}
+			file.Chunks = append(file.Chunks, &Chunk{ServerID: server, Number: uint(ii)})
+		}
+		if _, err := repo.PutFile(file, nil); err != nil {
+			t.Fatalf("can't save file: %s", err)
 		}
 	}
 
-	tests := []struct {
-		num     int
-		want    []*Server
-		wantErr error
-	}{
-		{num: 0, want: []*Server{}},
-		{num: 1,
-			want: []*Server{
-				{ID: saved[0], Name: "GetLeastLoadedServer0", Port: "123"}}},
-		{num: 2,
-			want: []*Server{
-				{ID: saved[0], Name: "GetLeastLoadedServer0", Port: "123"},
-				{ID: saved[1], Name: "GetLeastLoadedServer1", Port: "123"},
-			}},
-		{num: 3,
-			want: []*Server{
-				{ID: saved[0], Name: "GetLeastLoadedServer0", Port: "123"},
-				{ID: saved[1], Name: "GetLeastLoadedServer1", Port: "123"},
-				{ID: saved[2], Name: "GetLeastLoadedServer2", Port: "123"},
-			}},
-		{num: 20,
-			wantErr: ErrUnexpectedServerCount},
-	}
-
-	for _, tt := range tests {
-		t.Run(fmt.Sprintf("%d", tt.num), func(t *testing.T) {
-			servers, err := repo.GetLeastLoadedServers(tt.num)
-			if !errors.Is(err, tt.wantErr) {
-				t.Errorf(
-					"GetLeastLoadedServer() unexpected error\n%s",
-					cmp.Diff(tt.wantErr, err, cmpopts.EquateErrors()))
-			}
-			if diff := cmp.Diff(tt.want, servers); diff != "" {
-				t.Errorf("GetLeastLoadedServer():\n%s", diff)
-			}
-		})
+	// a dead server isn't used
+	dead, err := repo.AddServer("GetActiveServersDead", "123", Topology{})
+	if err != nil {
+		t.Fatalf("can't save server: %s", err)
 	}
-}
+	assert.NoError(t, repo.SetServerState(dead, ServerDead))
+	assert.ErrorIs(t, repo.SetServerState(uuid.New(), ServerDead), ErrRecordNotFound)
 
-func TestRepository_SaveChunk(t *testing.T) {
-	repo := setup()
-	server := &Server{Name: "TestServer", Port: "8080"}
-	if err := repo.db.Create(server).Error; err != nil {
-		t.Fatalf("can't prepare test")
+	server := func(i int) Server {
+		return Server{ID: saved[i], Name: fmt.Sprintf("GetActiveServers%d", i), Port: "123", State: ServerActive}
 	}
-	file1, file2 := &File{User: "user1", Dir: "dir1", Name: "file1"}, &File{User: "user1", Dir: "dir1", Name: "file2"}
-	if err := repo.db.Create([]*File{file1, file2}).Error; err != nil {
-		t.Fatalf("can't prepare test: %s", err)
-	}
-
 	tests := []struct {
 		name    string
-		number  uint
-		file    uuid.UUID
-		server  uuid.UUID
-		wantErr bool
+		exclude []uuid.UUID
+		want    []*ServerUsage
 	}{
-		{name: "file1", server: server.ID, file: file1.ID, number: 1},
-		{name: "file1 duplicated", server: server.ID, file: file1.ID, number: 1, wantErr: true}, // duplicated chunk
-		{name: "file2", server: server.ID, file: file2.ID, number: 1},
+		{name: "all",
+			want: []*ServerUsage{
+				{Server: server(0), Chunks: 0},
+				{Server: server(1), Chunks: 1},
+				{Server: server(2), Chunks: 2},
+				{Server: server(3), Chunks: 3},
+			}},
+		{name: "excluded", exclude: []uuid.UUID{saved[0], saved[2]},
+			want: []*ServerUsage{
+				{Server: server(1), Chunks: 1},
+				{Server: server(3), Chunks: 3},
+			}},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			id, err := repo.SaveChunk(tt.file, tt.server, tt.number)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("SaveChunk() error = %v, wantErr %v", err, tt.wantErr)
-			}
-			if tt.wantErr {
-				return
-			}
-
-			t.Run("check saved", func(t *testing.T) {
-				saved := &Chunk{}
-				if err := repo.db.First(saved, id).Error; err != nil {
-					t.Errorf("SaveChunk() can't find saved chunk")
-				}
-				expected := &Chunk{
-					ID:       id,
-					Number:   tt.number,
-					FileID:   tt.file,
-					ServerID: server.ID,
-				}
-				if diff := cmp.Diff(expected, saved); diff != "" {
-					t.Errorf("SaveChunk()\n%s", diff)
-				}
-			})
+			servers, err := repo.GetActiveServers(tt.exclude...)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.want, servers)
 		})
 	}
 }
@@ -175,7 +159,7 @@ func TestRepository_GetFiles(t *testing.T) {
 
 	servers := make([]uuid.UUID, 0, 6)
 	for i := 0; i < cap(servers); i++ {
-		id, err := repo.AddServer(fmt.Sprintf("TestGetChunks%d", i), "123")
+		id, err := repo.AddServer(fmt.Sprintf("TestGetChunks%d", i), "123", Topology{})
 		if err != nil {
 			t.Fatalf("can't save server: %s", err)
 		}
@@ -183,16 +167,14 @@ func TestRepository_GetFiles(t *testing.T) {
 	}
 	files := make([]uuid.UUID, 3)
 	for i := 0; i < 3; i++ {
-		fileId, err := repo.CreateFile("username3", "dir", fmt.Sprintf("GetFiles_%d", i))
-		if err != nil {
-			t.Fatalf("can't save file: %s", err)
-		}
-		files[i] = fileId
+		file := &File{User: "username3", Dir: "dir", Name: fmt.Sprintf("GetFiles_%d", i), ChunkCount: len(servers)}
 		for chunkNum, serverId := range servers {
-			if _, err := repo.SaveChunk(fileId, serverId, uint(chunkNum)); err != nil {
-				t.Fatalf("can't save chunk: %s", err)
-			}
+			file.Chunks = append(file.Chunks, &Chunk{ServerID: serverId, Number: uint(chunkNum)})
 		}
+		if _, err := repo.PutFile(file, nil); err != nil {
+			t.Fatalf("can't save file: %s", err)
+		}
+		files[i] = file.ID
 	}
 
 	tests := []struct {
@@ -244,63 +226,1108 @@ func TestRepository_GetFiles(t *testing.T) {
 
 func TestRepository_RemoveFile(t *testing.T) {
 	repo := setup()
-	serverId, err := repo.AddServer("RemoveFile", "12")
+	serverId, err := repo.AddServer("RemoveFile", "12", Topology{})
 	if err != nil {
 		t.Fatalf("can't prepare test: %s", err)
 	}
-	fileId, err := repo.CreateFile("RemoveFile_user", "RemoveFile_dir", "RemoveFile_file")
-	if err != nil {
+	if err := repo.AddWebhook(&Webhook{User: "RemoveFile_user", URL: "http://hooks/removed", Events: []string{EventObjectRemoved}}); err != nil {
 		t.Fatalf("can't prepare test: %s", err)
 	}
-
+	f := &File{User: "RemoveFile_user", Dir: "RemoveFile_dir", Name: "RemoveFile_file", Size: 6, ChunkCount: 6}
 	for i := 0; i < 6; i++ {
-		if _, err = repo.SaveChunk(fileId, serverId, uint(i)); err != nil {
-			t.Fatalf("can't prepare test: %s", err)
-		}
+		f.Chunks = append(f.Chunks, &Chunk{ServerID: serverId, Number: uint(i), Offset: int64(i), Size: 1, StoredSize: 1})
 	}
-	f, err := repo.GetFile("RemoveFile_user", "RemoveFile_dir", "RemoveFile_file")
+	if _, err := repo.PutFile(f, nil); err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	got, err := repo.GetFile("RemoveFile_user", "RemoveFile_dir", "RemoveFile_file")
 	if err != nil {
 		t.Fatalf("can't find saved file:  %s", err)
 	}
-	assert.Equal(t, f.ID, fileId)
-	assert.Equal(t, f.User, "RemoveFile_user")
-	assert.Equal(t, f.Name, "RemoveFile_file")
-	assert.Equal(t, f.Dir, "RemoveFile_dir")
-	assert.Equal(t, len(f.Chunks), 6)
-	for _, chunk := range f.Chunks {
+	assert.Equal(t, len(got.Chunks), 6)
+	for _, chunk := range got.Chunks {
 		assert.Equal(t, chunk.ServerID, serverId)
 		assert.Equal(t, chunk.Server.ID, serverId)
-		assert.Equal(t, chunk.FileID, fileId)
-		assert.Equal(t, chunk.File.ID, fileId)
+		assert.Equal(t, chunk.FileID, f.ID)
+		assert.Equal(t, chunk.File.ID, f.ID)
 	}
 
-	if err := repo.RemoveFile(fileId); err != nil {
+	assert.ErrorIs(t, repo.RemoveFile(uuid.New()), ErrRecordNotFound)
+	if err := repo.RemoveFile(f.ID); err != nil {
 		t.Fatalf("can't remove file")
 	}
 	_, err = repo.GetFile("RemoveFile_user", "RemoveFile_dir", "RemoveFile_file")
 	assert.Error(t, err)
 	assert.Equal(t, ErrRecordNotFound, err)
+
+	var chunks int64
+	assert.NoError(t, repo.db.Model(&Chunk{}).Where(&Chunk{FileID: f.ID}).Count(&chunks).Error)
+	assert.Zero(t, chunks)
+	garbage, err := repo.GetGarbage(10)
+	assert.NoError(t, err)
+	if assert.Len(t, garbage, 1) {
+		assert.Equal(t, f.BlobID, garbage[0].BlobID)
+		assert.Equal(t, serverId, garbage[0].ServerID)
+	}
+	servers, err := repo.GetServerUsage()
+	assert.NoError(t, err)
+	if assert.Len(t, servers, 1) {
+		assert.Zero(t, servers[0].Chunks)
+		assert.Zero(t, servers[0].Bytes)
+	}
+	_, usage, err := repo.GetQuotas("RemoveFile_user")
+	assert.NoError(t, err)
+	assert.Equal(t, &Usage{User: "RemoveFile_user"}, usage[0])
+	due, err := repo.GetDueDeliveries(time.Now(), 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, EventObjectRemoved, due[0].Event.Type)
+	}
 }
 
-func TestRepository_CreateFile(t *testing.T) {
+func TestRepository_Quota(t *testing.T) {
 	repo := setup()
+	assert.NoError(t, repo.SetQuota(&Quota{User: "Quota_user", MaxBytes: 100, MaxObjects: 3}))
+	assert.NoError(t, repo.SetQuota(&Quota{User: "Quota_user", Dir: "small", MaxBytes: 10}))
+
 	tests := []struct {
-		name     string
-		user     string
-		dir      string
-		filename string
-		wantErr  error
+		name    string
+		dir     string
+		size    int64
+		wantErr error
 	}{
-		{name: "valid", user: "SaveFile_user0", dir: "SaveFile_dir0", filename: "SaveFile_name0"},
-		{name: "duplicated", user: "SaveFile_user0", dir: "SaveFile_dir0", filename: "SaveFile_name0", wantErr: ErrDuplicated},
+		{name: "first", dir: "big", size: 60},
+		{name: "dir quota", dir: "small", size: 11, wantErr: ErrBytesQuotaExceeded},
+		{name: "fits dir quota", dir: "small", size: 10},
+		{name: "nested dir quota", dir: "small/nested", size: 1, wantErr: ErrBytesQuotaExceeded},
+		{name: "user bytes", dir: "big", size: 31, wantErr: ErrBytesQuotaExceeded},
+		{name: "fits user bytes", dir: "big", size: 30},
+		{name: "user objects", dir: "big", size: 0, wantErr: ErrObjectsQuotaExceeded},
+		{name: "other user", dir: "big", size: 1000},
 	}
-	for _, tt := range tests {
+	var ids []uuid.UUID
+	for i, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := repo.CreateFile(tt.user, tt.dir, tt.filename)
-			if tt.wantErr == nil {
-				assert.NotEqual(t, uuid.Nil, got)
+			user := "Quota_user"
+			if tt.name == "other user" {
+				user = "Quota_other"
 			}
+			assert.ErrorIs(t, repo.CheckQuota(user, tt.dir, tt.size, 1), tt.wantErr)
+			f := &File{User: user, Dir: tt.dir, Name: fmt.Sprintf("Quota_%d", i), Size: tt.size}
+			_, err := repo.PutFile(f, nil)
 			assert.ErrorIs(t, err, tt.wantErr)
+			if tt.wantErr == nil && user == "Quota_user" {
+				ids = append(ids, f.ID)
+			}
 		})
 	}
+
+	quotas, usage, err := repo.GetQuotas("Quota_user")
+	assert.NoError(t, err)
+	assert.Len(t, quotas, 2)
+	assert.Equal(t, []*Usage{
+		{User: "Quota_user", Dir: "", Bytes: 100, Objects: 3},
+		{User: "Quota_user", Dir: "big", Bytes: 90, Objects: 2},
+		{User: "Quota_user", Dir: "small", Bytes: 10, Objects: 1},
+	}, usage)
+
+	assert.NoError(t, repo.RemoveFile(ids[0]))
+	assert.NoError(t, repo.CheckQuota("Quota_user", "big", 60, 1))
+	_, usage, _ = repo.GetQuotas("Quota_user")
+	assert.Equal(t, &Usage{User: "Quota_user", Dir: "", Bytes: 40, Objects: 2}, usage[0])
+
+	assert.NoError(t, repo.RemoveQuota("Quota_user", ""))
+	assert.NoError(t, repo.CheckQuota("Quota_user", "big", 1000, 1))
+	// the dir quota stays
+	assert.ErrorIs(t, repo.CheckQuota("Quota_user", "small", 1, 1), ErrBytesQuotaExceeded)
+}
+
+func TestRepository_PutFileInline(t *testing.T) {
+	repo := setup()
+	_, err := repo.PutFile(&File{
+		ID: uuid.New(), User: "Inline_user", Dir: "dir", Name: "small", Size: 5,
+		Inline: true, InlineCompression: "gzip", InlineData: []byte("hello"),
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, err := repo.GetFile("Inline_user", "dir", "small")
+	if assert.NoError(t, err) {
+		assert.True(t, got.Inline)
+		assert.Equal(t, "gzip", got.InlineCompression)
+		assert.Equal(t, []byte("hello"), got.InlineData)
+		assert.Empty(t, got.Chunks)
+	}
+}
+
+func TestRepository_PutFileDeleteFile(t *testing.T) {
+	repo := setup()
+	server, err := repo.AddServer("PutFile", "123", Topology{})
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	newFile := func(etag string, size int64) *File {
+		return &File{
+			ID: uuid.New(), User: "PutFile_user", Dir: "dir", Name: "name", Size: size, ETag: etag, ChunkCount: 1,
+			Chunks: []*Chunk{{ServerID: server, Size: size}},
+		}
+	}
+	failIfExists := func(old *File) error {
+		if old != nil {
+			return ErrDuplicated
+		}
+		return nil
+	}
+
+	old, err := repo.PutFile(newFile("v1", 10), failIfExists)
+	assert.NoError(t, err)
+	assert.Nil(t, old)
+	_, err = repo.PutFile(newFile("v2", 20), failIfExists)
+	assert.ErrorIs(t, err, ErrDuplicated)
+
+	old, err = repo.PutFile(newFile("v2", 20), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", old.ETag)
+	got, err := repo.GetFile("PutFile_user", "dir", "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", got.ETag)
+	assert.Len(t, got.Chunks, 1)
+
+	_, usage, err := repo.GetQuotas("PutFile_user")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Usage{{User: "PutFile_user", Bytes: 20, Objects: 1}, {User: "PutFile_user", Dir: "dir", Bytes: 20, Objects: 1}}, usage)
+
+	_, err = repo.DeleteFile("PutFile_user", "dir", "name", func(old *File) error { return ErrDuplicated })
+	assert.ErrorIs(t, err, ErrDuplicated)
+	old, err = repo.DeleteFile("PutFile_user", "dir", "name", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", old.ETag)
+	_, err = repo.DeleteFile("PutFile_user", "dir", "name", nil)
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+
+	var chunks int64
+	repo.db.Model(&Chunk{}).Where("server_id = ?", server).Count(&chunks)
+	assert.Zero(t, chunks)
+
+	// a file out of dirs and a file of the same name in a dir are different files
+	_, err = repo.PutFile(newFile("v3", 30), nil)
+	assert.NoError(t, err)
+	root := newFile("v4", 40)
+	root.Dir = ""
+	old, err = repo.PutFile(root, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, old)
+	got, err = repo.GetFile("PutFile_user", "", "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "v4", got.ETag)
+	got, err = repo.GetFile("PutFile_user", "dir", "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "v3", got.ETag)
+
+	old, err = repo.DeleteFile("PutFile_user", "", "name", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "v4", old.ETag)
+	got, err = repo.GetFile("PutFile_user", "dir", "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "v3", got.ETag)
+}
+
+func TestRepository_UpdateFileMeta(t *testing.T) {
+	repo := setup()
+	_, err := repo.PutFile(&File{User: "Meta_user", Name: "name", ContentType: "text/plain", Metadata: map[string]string{"a": "1", "b": "2"}}, nil)
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+
+	_, err = repo.UpdateFileMeta("Meta_user", "", "missing", "", nil)
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+	updated, err := repo.UpdateFileMeta("Meta_user", "", "name", "", map[string]string{"a": "", "c": "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"b": "2", "c": "3"}, updated.Metadata)
+	updated, err = repo.UpdateFileMeta("Meta_user", "", "name", "text/html", map[string]string{"b": "4"})
+	assert.NoError(t, err)
+	got, err := repo.GetFile("Meta_user", "", "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/html", got.ContentType)
+	assert.Equal(t, map[string]string{"b": "4", "c": "3"}, got.Metadata)
+	assert.Equal(t, updated.Metadata, got.Metadata)
+}
+
+func TestRepository_CopyFileMoveFile(t *testing.T) {
+	repo := setup()
+	server, err := repo.AddServer("CopyFile", "123", Topology{})
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	_, err = repo.PutFile(&File{
+		User: "CopyFile_user", Dir: "a", Name: "name", Size: 10, ETag: "v1", ChunkCount: 1,
+		Metadata: map[string]string{"k": "v"},
+		Chunks:   []*Chunk{{ServerID: server, Size: 10, StoredSize: 10}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+
+	copied, err := repo.CopyFile("CopyFile_user", "a", "name", "b", "copy", nil)
+	assert.NoError(t, err)
+	src, err := repo.GetFile("CopyFile_user", "a", "name")
+	assert.NoError(t, err)
+	got, err := repo.GetFile("CopyFile_user", "b", "copy")
+	assert.NoError(t, err)
+	assert.Equal(t, copied.ID, got.ID)
+	assert.NotEqual(t, src.ID, got.ID)
+	assert.Equal(t, src.BlobID, got.BlobID)
+	assert.Equal(t, "v1", got.ETag)
+	assert.Equal(t, map[string]string{"k": "v"}, got.Metadata)
+	assert.Len(t, got.Chunks, 1)
+
+	servers, err := repo.GetServerUsage()
+	assert.NoError(t, err)
+	if assert.Len(t, servers, 1) {
+		assert.Equal(t, int64(1), servers[0].Chunks)
+		assert.Equal(t, int64(10), servers[0].Bytes)
+	}
+
+	// a copy onto the file itself changes nothing, its content isn't garbage
+	same, err := repo.CopyFile("CopyFile_user", "a", "name", "a", "name", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, src.ID, same.ID)
+	_, err = repo.CopyFile("CopyFile_user", "a", "name", "a", "name", func(old *File) error { return ErrDuplicated })
+	assert.ErrorIs(t, err, ErrDuplicated)
+	got, err = repo.GetFile("CopyFile_user", "a", "name")
+	assert.NoError(t, err)
+	assert.Equal(t, src.ID, got.ID)
+
+	_, err = repo.CopyFile("CopyFile_user", "a", "missing", "b", "copy", nil)
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+	_, err = repo.MoveFile("CopyFile_user", "a", "name", "b", "copy", func(old *File) error { return ErrDuplicated })
+	assert.ErrorIs(t, err, ErrDuplicated)
+
+	moved, err := repo.MoveFile("CopyFile_user", "a", "name", "b", "copy", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, src.ID, moved.ID)
+	_, err = repo.GetFile("CopyFile_user", "a", "name")
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+	got, err = repo.GetFile("CopyFile_user", "b", "copy")
+	assert.NoError(t, err)
+	assert.Equal(t, src.ID, got.ID)
+
+	_, usage, err := repo.GetQuotas("CopyFile_user")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Usage{
+		{User: "CopyFile_user", Bytes: 10, Objects: 1},
+		{User: "CopyFile_user", Dir: "a", Bytes: 0, Objects: 0},
+		{User: "CopyFile_user", Dir: "b", Bytes: 10, Objects: 1},
+	}, usage)
+
+	// the record replacing the last one of the blob takes its content over
+	_, err = repo.PutFile(&File{
+		User: "CopyFile_user", Dir: "b", Name: "copy", Size: 10, ETag: "v1", ChunkCount: 1, BlobID: src.BlobID,
+		Chunks: []*Chunk{{ServerID: server, Size: 10, StoredSize: 10}},
+	}, nil)
+	assert.NoError(t, err)
+	garbage, err := repo.GetGarbage(10)
+	assert.NoError(t, err)
+	assert.Empty(t, garbage)
+	servers, err = repo.GetServerUsage()
+	assert.NoError(t, err)
+	if assert.Len(t, servers, 1) {
+		assert.Equal(t, int64(1), servers[0].Chunks)
+		assert.Equal(t, int64(10), servers[0].Bytes)
+	}
+}
+
+func TestRepository_ListFiles(t *testing.T) {
+	repo := setup()
+	keys := [][2]string{
+		{"", "top"},
+		{"a", "1"},
+		{"a", "2"},
+		{"a/b", "3"},
+		{"a/b/c", "4"},
+		{"a/bb", "5"},
+		{"a-x", "6"},
+		{"дир/ж", "7"},
+	}
+	for _, k := range keys {
+		if _, err := repo.PutFile(&File{User: "List_user", Dir: k[0], Name: k[1]}, nil); err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+	}
+	if _, err := repo.PutFile(&File{User: "List_other", Dir: "a", Name: "other"}, nil); err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	paths := func(files []*File) []string {
+		var res []string
+		for _, f := range files {
+			res = append(res, f.Dir+"/"+f.Name)
+		}
+		return res
+	}
+
+	tests := []struct {
+		name      string
+		dir       string
+		recursive bool
+		after     [2]string
+		limit     int
+		want      []string
+	}{
+		{name: "dir", dir: "a", limit: 10, want: []string{"a/1", "a/2"}},
+		{name: "root", dir: "", limit: 10, want: []string{"/top"}},
+		{name: "recursive", dir: "a", recursive: true, limit: 10, want: []string{"a/1", "a/2", "a/b/3", "a/b/c/4", "a/bb/5"}},
+		{name: "recursive nested", dir: "a/b", recursive: true, limit: 10, want: []string{"a/b/3", "a/b/c/4"}},
+		{name: "page", dir: "a", recursive: true, limit: 2, after: [2]string{"a", "2"}, want: []string{"a/b/3", "a/b/c/4"}},
+		{name: "recursive root", dir: "", recursive: true, limit: 3, want: []string{"/top", "a/1", "a/2"}},
+		{name: "empty", dir: "nope", limit: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := repo.ListFiles("List_user", tt.dir, tt.recursive, tt.after[0], tt.after[1], tt.limit)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, paths(files))
+		})
+	}
+
+	dirs, err := repo.ListDirs("List_user", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "a-x", "дир"}, dirs)
+	dirs, err = repo.ListDirs("List_user", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "bb"}, dirs)
+	dirs, err = repo.ListDirs("List_user", "дир")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ж"}, dirs)
+}
+
+func TestRepository_DeleteFilesGarbage(t *testing.T) {
+	repo := setup()
+	var servers []uuid.UUID
+	for i := 0; i < 2; i++ {
+		server, err := repo.AddServer(fmt.Sprintf("Garbage%d", i), "123", Topology{})
+		if err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+		servers = append(servers, server)
+	}
+	for _, name := range []string{"one", "two"} {
+		_, err := repo.PutFile(&File{
+			User: "Garbage_user", Dir: "dir", Name: name, Size: 2, ChunkCount: 2,
+			Chunks: []*Chunk{{ServerID: servers[0], Size: 1}, {ServerID: servers[1], Number: 1, Offset: 1, Size: 1}},
+		}, nil)
+		if err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+	}
+	copied, err := repo.CopyFile("Garbage_user", "dir", "one", "dir", "copy", nil)
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+
+	removed, locked, err := repo.DeleteFiles("Garbage_user", []*File{{Dir: "dir", Name: "one"}, {Dir: "dir", Name: "two"}, {Dir: "dir", Name: "missing"}})
+	assert.NoError(t, err)
+	assert.Len(t, removed, 2)
+	assert.Empty(t, locked)
+	garbage, err := repo.GetGarbage(10)
+	assert.NoError(t, err)
+	// the content of the copied file is still used
+	if assert.Len(t, garbage, 2) {
+		assert.Equal(t, removed[1].BlobID, garbage[0].BlobID)
+		assert.NotNil(t, garbage[0].Server)
+	}
+	_, usage, _ := repo.GetQuotas("Garbage_user")
+	assert.Equal(t, &Usage{User: "Garbage_user", Bytes: 2, Objects: 1}, usage[0])
+
+	assert.NoError(t, repo.RetryGarbage([]uuid.UUID{garbage[0].ID}))
+	_, err = repo.DeleteFile("Garbage_user", "dir", "copy", nil)
+	assert.NoError(t, err)
+	garbage, err = repo.GetGarbage(10)
+	assert.NoError(t, err)
+	if assert.Len(t, garbage, 4) {
+		assert.Equal(t, 1, garbage[3].Attempts)
+	}
+	blobs := map[uuid.UUID]int{}
+	for _, g := range garbage {
+		blobs[g.BlobID]++
+	}
+	assert.Equal(t, map[uuid.UUID]int{copied.BlobID: 2, removed[1].BlobID: 2}, blobs)
+
+	ids := make([]uuid.UUID, len(garbage))
+	for i, g := range garbage {
+		ids[i] = g.ID
+	}
+	assert.NoError(t, repo.RemoveGarbage(ids))
+	garbage, err = repo.GetGarbage(10)
+	assert.NoError(t, err)
+	assert.Empty(t, garbage)
+}
+
+func TestRepository_DamagedChunks(t *testing.T) {
+	repo := setup()
+	server, err := repo.AddServer("Damaged", "123", Topology{})
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	_, err = repo.PutFile(&File{
+		User: "Damaged_user", Name: "file", Size: 2, ChunkCount: 2,
+		Chunks: []*Chunk{{ServerID: server, Size: 1}, {ServerID: server, Number: 1, Offset: 1, Size: 1}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	file, err := repo.GetFile("Damaged_user", "", "file")
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+
+	_, err = repo.AddDamagedChunks("Unknown", "123", []*DamagedChunk{{User: "Damaged_user", BlobID: file.BlobID, Reason: DamageCorrupt}})
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+
+	n, err := repo.AddDamagedChunks("Damaged", "123", []*DamagedChunk{
+		{User: "Damaged_user", BlobID: file.BlobID, Number: 1, Reason: DamageCorrupt},
+		{User: "Damaged_user", BlobID: file.BlobID, Number: 2, Reason: DamageCorrupt},
+		{User: "Other_user", BlobID: file.BlobID, Number: 0, Reason: DamageCorrupt},
+		{User: "Damaged_user", BlobID: uuid.New(), Number: 0, Reason: DamageMissing},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	// a chunk reported again is updated
+	n, err = repo.AddDamagedChunks("Damaged", "123", []*DamagedChunk{{User: "Damaged_user", BlobID: file.BlobID, Number: 1, Reason: DamageMissing}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	damaged, err := repo.GetDamagedChunks(10)
+	assert.NoError(t, err)
+	if assert.Len(t, damaged, 1) {
+		assert.Equal(t, server, damaged[0].ServerID)
+		assert.Equal(t, uint(1), damaged[0].Number)
+		assert.Equal(t, DamageMissing, damaged[0].Reason)
+		assert.NotNil(t, damaged[0].Server)
+	}
+
+	// the damage of the garbage goes with it
+	_, err = repo.DeleteFile("Damaged_user", "", "file", nil)
+	assert.NoError(t, err)
+	garbage, err := repo.GetGarbage(10)
+	assert.NoError(t, err)
+	if assert.Len(t, garbage, 1) {
+		assert.NoError(t, repo.RemoveGarbage([]uuid.UUID{garbage[0].ID}))
+	}
+	damaged, err = repo.GetDamagedChunks(10)
+	assert.NoError(t, err)
+	assert.Empty(t, damaged)
+}
+
+func TestRepository_Repair(t *testing.T) {
+	repo := setup()
+	var servers []uuid.UUID
+	for i := 0; i < 4; i++ {
+		server, err := repo.AddServer(fmt.Sprintf("Repair%d", i), "123", Topology{})
+		if err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+		servers = append(servers, server)
+	}
+	// two chunks with two copies each
+	_, err := repo.PutFile(&File{
+		User: "Repair_user", Name: "file", Size: 2, ChunkCount: 2,
+		Chunks: []*Chunk{
+			{ServerID: servers[0], Size: 1, StoredSize: 1},
+			{ServerID: servers[1], Size: 1, StoredSize: 1},
+			{ServerID: servers[1], Number: 1, Offset: 1, Size: 1, StoredSize: 1},
+			{ServerID: servers[2], Number: 1, Offset: 1, Size: 1, StoredSize: 1},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	copied, err := repo.CopyFile("Repair_user", "", "file", "", "copy", nil)
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+
+	counts, err := repo.CountAtRiskChunks(2)
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+
+	assert.NoError(t, repo.SetServerState(servers[1], ServerDead))
+	_, err = repo.AddDamagedChunks("Repair2", "123", []*DamagedChunk{{User: "Repair_user", BlobID: copied.BlobID, Number: 1, Reason: DamageCorrupt}})
+	assert.NoError(t, err)
+	counts, err = repo.CountAtRiskChunks(2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int64{0: 1, 1: 1}, counts)
+
+	atRisk, err := repo.GetAtRiskChunks(1, uuid.Nil, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []*AtRiskChunk{{StoredChunk: StoredChunk{User: "Repair_user", BlobID: copied.BlobID, Number: 0}, Healthy: 1}}, atRisk)
+	atRisk, err = repo.GetAtRiskChunks(1, copied.BlobID, 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, atRisk)
+
+	copies, err := repo.GetChunkCopies(copied.BlobID, 1)
+	assert.NoError(t, err)
+	if assert.Len(t, copies, 2) {
+		damaged := map[uuid.UUID]bool{}
+		for _, c := range copies {
+			damaged[c.Chunk.ServerID] = c.Damaged
+			assert.NotNil(t, c.Chunk.Server)
+		}
+		assert.Equal(t, map[uuid.UUID]bool{servers[1]: false, servers[2]: true}, damaged)
+	}
+
+	// the chunk is stored again where it was damaged and moved from the dead server
+	assert.NoError(t, repo.RemoveDamagedChunk(servers[2], copied.BlobID, 1))
+	assert.NoError(t, repo.ReplaceChunkCopies(copied.BlobID, 1, []uuid.UUID{servers[3]}, []uuid.UUID{servers[1]}))
+	garbage, err := repo.GetGarbage(10)
+	assert.NoError(t, err)
+	if assert.Len(t, garbage, 1, "the dead server keeps another chunk of the blob") {
+		assert.Equal(t, servers[1], garbage[0].ServerID)
+		if assert.NotNil(t, garbage[0].Number) {
+			assert.Equal(t, uint(1), *garbage[0].Number)
+		}
+	}
+	assert.NoError(t, repo.ReplaceChunkCopies(copied.BlobID, 0, []uuid.UUID{servers[3]}, []uuid.UUID{servers[1]}))
+	garbage, err = repo.GetGarbage(10)
+	assert.NoError(t, err)
+	if assert.Len(t, garbage, 1, "the whole blob takes the place of the chunk") {
+		assert.Nil(t, garbage[0].Number)
+		assert.Equal(t, servers[1], garbage[0].ServerID)
+		assert.Equal(t, "Repair_user", garbage[0].User)
+		assert.Equal(t, copied.BlobID, garbage[0].BlobID)
+	}
+	blobGarbage, err := repo.GetBlobGarbage(copied.BlobID)
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{servers[1]}, blobGarbage)
+	counts, err = repo.CountAtRiskChunks(2)
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+	for _, name := range []string{"file", "copy"} {
+		file, err := repo.GetFile("Repair_user", "", name)
+		assert.NoError(t, err)
+		holders := map[uint][]uuid.UUID{}
+		for _, c := range file.Chunks {
+			holders[c.Number] = append(holders[c.Number], c.ServerID)
+		}
+		assert.ElementsMatch(t, []uuid.UUID{servers[0], servers[3]}, holders[0])
+		assert.ElementsMatch(t, []uuid.UUID{servers[2], servers[3]}, holders[1])
+	}
+
+	_, _, err = repo.DeleteFiles("Repair_user", []*File{{Name: "file"}, {Name: "copy"}})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, repo.ReplaceChunkCopies(copied.BlobID, 0, []uuid.UUID{servers[1]}, nil), ErrRecordNotFound)
+}
+
+func TestRepository_Drain(t *testing.T) {
+	repo := setup()
+	var servers []uuid.UUID
+	for i := 0; i < 2; i++ {
+		server, err := repo.AddServer(fmt.Sprintf("Drain%d", i), "123", Topology{})
+		if err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+		servers = append(servers, server)
+	}
+	var blobs []uuid.UUID
+	for _, name := range []string{"a", "b"} {
+		_, err := repo.PutFile(&File{
+			User: "Drain_user", Name: name, Size: 2, ChunkCount: 2,
+			Chunks: []*Chunk{
+				{ServerID: servers[0], Size: 1, StoredSize: 1},
+				{ServerID: servers[0], Number: 1, Offset: 1, Size: 1, StoredSize: 1},
+			},
+		}, nil)
+		if err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+		file, err := repo.GetFile("Drain_user", "", name)
+		if err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+		blobs = append(blobs, file.BlobID)
+	}
+	if blobs[1].String() < blobs[0].String() {
+		blobs[0], blobs[1] = blobs[1], blobs[0]
+	}
+
+	assert.NoError(t, repo.SetServerState(servers[0], ServerDraining))
+	draining, err := repo.GetServersByState(ServerDraining)
+	assert.NoError(t, err)
+	if assert.Len(t, draining, 1) {
+		assert.Equal(t, servers[0], draining[0].ID)
+	}
+	active, err := repo.GetActiveServers()
+	assert.NoError(t, err)
+	if assert.Len(t, active, 1, "a draining server takes no chunks") {
+		assert.Equal(t, servers[1], active[0].ID)
+	}
+
+	chunks, err := repo.GetServerChunks(servers[0], uuid.Nil, 0, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []*StoredChunk{
+		{User: "Drain_user", BlobID: blobs[0], Number: 0},
+		{User: "Drain_user", BlobID: blobs[0], Number: 1},
+		{User: "Drain_user", BlobID: blobs[1], Number: 0},
+	}, chunks)
+	chunks, err = repo.GetServerChunks(servers[0], blobs[1], 0, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []*StoredChunk{{User: "Drain_user", BlobID: blobs[1], Number: 1}}, chunks)
+
+	assert.ErrorIs(t, repo.RemoveServer(servers[0]), ErrServerNotEmpty)
+	for _, blob := range blobs {
+		for number := uint(0); number < 2; number++ {
+			assert.NoError(t, repo.ReplaceChunkCopies(blob, number, []uuid.UUID{servers[1]}, []uuid.UUID{servers[0]}))
+		}
+	}
+	chunks, err = repo.GetServerChunks(servers[0], uuid.Nil, 0, 3)
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+	garbage, err := repo.GetGarbage(10)
+	assert.NoError(t, err)
+	assert.Len(t, garbage, 2)
+	assert.ErrorIs(t, repo.RemoveServer(servers[0]), ErrServerNotEmpty, "the garbage is left on the server")
+
+	assert.NoError(t, repo.RemoveGarbage([]uuid.UUID{garbage[0].ID, garbage[1].ID}))
+	assert.NoError(t, repo.RemoveServer(servers[0]))
+	assert.ErrorIs(t, repo.RemoveServer(servers[0]), ErrRecordNotFound)
+	usage, err := repo.GetServerUsage()
+	assert.NoError(t, err)
+	if assert.Len(t, usage, 1) {
+		assert.Equal(t, servers[1], usage[0].ID)
+		assert.Equal(t, int64(4), usage[0].Chunks)
+	}
+}
+
+func TestRepository_ServerLoad(t *testing.T) {
+	repo := setup()
+	var servers []uuid.UUID
+	for i := 0; i < 3; i++ {
+		server, err := repo.AddServer(fmt.Sprintf("ServerLoad%d", i), "123", Topology{})
+		if err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+		servers = append(servers, server)
+	}
+	// the load is what a scan of the chunks finds
+	check := func(t *testing.T) {
+		var want []*ServerUsage
+		err := repo.db.Model(&Server{}).
+			Select("servers.id, count(chunks.number) AS chunks, coalesce(sum(chunks.stored_size), 0) AS bytes").
+			Joins("LEFT JOIN " + storedChunks + " ON servers.id = chunks.server_id").
+			Group("servers.id").
+			Order("servers.id").
+			Scan(&want).Error
+		assert.NoError(t, err)
+		got, err := repo.GetActiveServers()
+		assert.NoError(t, err)
+		if assert.Len(t, got, len(want)) {
+			for i := range want {
+				assert.Equal(t, want[i].ID, got[i].ID)
+				assert.Equal(t, want[i].Chunks, got[i].Chunks, "chunks of %s", want[i].ID)
+				assert.Equal(t, want[i].Bytes, got[i].Bytes, "bytes of %s", want[i].ID)
+			}
+		}
+	}
+	put := func(name string, size int64) *File {
+		f := &File{
+			User: "ServerLoad_user", Name: name, Size: 2 * size, ChunkCount: 2,
+			Chunks: []*Chunk{
+				{ServerID: servers[0], Size: size, StoredSize: size},
+				{ServerID: servers[1], Size: size, StoredSize: size},
+				{ServerID: servers[0], Number: 1, Offset: size, Size: size, StoredSize: size},
+			},
+		}
+		_, err := repo.PutFile(f, nil)
+		assert.NoError(t, err)
+		return f
+	}
+
+	steps := []struct {
+		name string
+		do   func(t *testing.T)
+	}{
+		{name: "put", do: func(t *testing.T) { put("a", 10) }},
+		{name: "copy", do: func(t *testing.T) {
+			_, err := repo.CopyFile("ServerLoad_user", "", "a", "", "b", nil)
+			assert.NoError(t, err)
+		}},
+		{name: "replace", do: func(t *testing.T) { put("a", 7) }},
+		{name: "repair", do: func(t *testing.T) {
+			b, err := repo.GetFile("ServerLoad_user", "", "b")
+			assert.NoError(t, err)
+			assert.NoError(t, repo.ReplaceChunkCopies(b.BlobID, 0, []uuid.UUID{servers[2]}, []uuid.UUID{servers[0]}))
+		}},
+		{name: "delete copies", do: func(t *testing.T) {
+			_, err := repo.DeleteFile("ServerLoad_user", "", "b", nil)
+			assert.NoError(t, err)
+		}},
+		{name: "move over", do: func(t *testing.T) {
+			put("c", 3)
+			_, err := repo.MoveFile("ServerLoad_user", "", "c", "", "a", nil)
+			assert.NoError(t, err)
+		}},
+		{name: "expire", do: func(t *testing.T) {
+			_, err := repo.ExpireFiles("ServerLoad_user", "", time.Now().Add(time.Hour), 10)
+			assert.NoError(t, err)
+		}},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			step.do(t)
+			check(t)
+		})
+	}
+	usage, err := repo.GetServerUsage()
+	assert.NoError(t, err)
+	for _, u := range usage {
+		assert.Zero(t, u.Chunks)
+		assert.Zero(t, u.Bytes)
+	}
+}
+
+func TestRepository_Degraded(t *testing.T) {
+	repo := setup()
+	server, err := repo.AddServer("Degraded", "123", Topology{})
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	for _, name := range []string{"degraded", "spread"} {
+		_, err := repo.PutFile(&File{
+			User: "Degraded_user", Name: name, Size: 2, ChunkCount: 2, Degraded: name == "degraded",
+			Chunks: []*Chunk{
+				{ServerID: server, Size: 1, StoredSize: 1},
+				{ServerID: server, Number: 1, Offset: 1, Size: 1, StoredSize: 1},
+			},
+		}, nil)
+		if err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+	}
+	copied, err := repo.CopyFile("Degraded_user", "", "degraded", "", "copy", nil)
+	assert.NoError(t, err)
+	assert.True(t, copied.Degraded)
+
+	degraded, err := repo.GetDegradedFiles(uuid.Nil, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, degraded, 1, "a file for every blob") {
+		assert.Equal(t, copied.BlobID, degraded[0].BlobID)
+		assert.Equal(t, "Degraded_user", degraded[0].User)
+		if assert.Len(t, degraded[0].Chunks, 2) {
+			assert.Equal(t, server, degraded[0].Chunks[1].Server.ID)
+		}
+	}
+	degraded, err = repo.GetDegradedFiles(copied.BlobID, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, degraded)
+
+	assert.NoError(t, repo.ClearDegraded(copied.BlobID))
+	degraded, err = repo.GetDegradedFiles(uuid.Nil, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, degraded)
+	got, err := repo.GetFile("Degraded_user", "", "copy")
+	assert.NoError(t, err)
+	assert.False(t, got.Degraded)
+}
+
+func TestRepository_Operations(t *testing.T) {
+	repo := setup()
+	_, err := repo.NextOperation()
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+
+	first := &Operation{User: "Operation_user", Kind: OperationDelete, Status: OperationPending, Request: &OperationRequest{Prefix: "dir"}}
+	second := &Operation{User: "Operation_user", Kind: OperationDelete, Status: OperationPending, Request: &OperationRequest{Keys: []string{"a/b"}}}
+	assert.NoError(t, repo.CreateOperation(first))
+	assert.NoError(t, repo.CreateOperation(second))
+
+	second.Status = OperationRunning
+	assert.NoError(t, repo.UpdateOperation(second))
+	next, err := repo.NextOperation()
+	assert.NoError(t, err)
+	assert.Equal(t, second.ID, next.ID)
+	assert.Equal(t, []string{"a/b"}, next.Request.Keys)
+
+	second.Status, second.Report = OperationDone, &OperationReport{Deleted: 1}
+	assert.NoError(t, repo.UpdateOperation(second))
+	next, err = repo.NextOperation()
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, next.ID)
+
+	got, err := repo.GetOperation("Operation_user", second.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, &OperationReport{Deleted: 1}, got.Report)
+	_, err = repo.GetOperation("Operation_other", second.ID)
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+}
+
+func TestRepository_Lifecycle(t *testing.T) {
+	repo := setup()
+	server, err := repo.AddServer("Lifecycle", "123", Topology{})
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	now := time.Now()
+	for _, f := range []struct {
+		dir, name string
+		age       int
+	}{
+		{"builds", "old", 40},
+		{"builds/1", "old", 31},
+		{"builds/1", "new", 1},
+		{"builds-x", "old", 40},
+		{"", "old", 40},
+	} {
+		_, err := repo.PutFile(&File{
+			User: "Lifecycle_user", Dir: f.dir, Name: f.name, Size: 2, ChunkCount: 1,
+			Chunks:    []*Chunk{{ServerID: server, Size: 2}},
+			CreatedAt: now.AddDate(0, 0, -f.age),
+		}, nil)
+		if err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+	}
+	rule := &LifecycleRule{User: "Lifecycle_user", Prefix: "builds", ExpireDays: 30}
+	assert.NoError(t, repo.AddLifecycleRule(rule))
+	assert.NoError(t, repo.AddLifecycleRule(&LifecycleRule{User: "Lifecycle_other", ExpireDays: 1}))
+	rules, err := repo.GetLifecycleRules("Lifecycle_user")
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, rule.ID, rules[0].ID)
+	}
+	rules, err = repo.GetLifecycleRules("")
+	assert.NoError(t, err)
+	assert.Len(t, rules, 2)
+
+	before := rule.ExpiredBefore(now)
+	files, err := repo.ExpiredFiles("Lifecycle_user", "builds", before, "", "", 10)
+	assert.NoError(t, err)
+	var keys []string
+	for _, f := range files {
+		keys = append(keys, JoinKey(f.Dir, f.Name))
+	}
+	assert.Equal(t, []string{"builds/old", "builds/1/old"}, keys)
+	files, err = repo.ExpiredFiles("Lifecycle_user", "builds", before, "builds", "old", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "builds/1", files[0].Dir)
+	}
+	count, err := repo.CountExpiredFiles("Lifecycle_user", "builds", before)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count.Objects)
+	assert.Equal(t, int64(4), count.Bytes)
+
+	removed, err := repo.ExpireFiles("Lifecycle_user", "builds", before, 1)
+	assert.NoError(t, err)
+	assert.Len(t, removed, 1)
+	removed, err = repo.ExpireFiles("Lifecycle_user", "builds", before, 10)
+	assert.NoError(t, err)
+	assert.Len(t, removed, 1)
+	garbage, err := repo.GetGarbage(10)
+	assert.NoError(t, err)
+	assert.Len(t, garbage, 2)
+	_, usage, _ := repo.GetQuotas("Lifecycle_user")
+	assert.Equal(t, &Usage{User: "Lifecycle_user", Bytes: 6, Objects: 3}, usage[0])
+
+	assert.ErrorIs(t, repo.RemoveLifecycleRule("Lifecycle_other", rule.ID), ErrRecordNotFound)
+	assert.NoError(t, repo.RemoveLifecycleRule("Lifecycle_user", rule.ID))
+}
+
+func TestRepository_FileLock(t *testing.T) {
+	repo := setup()
+	server, err := repo.AddServer("Lock", "123", Topology{})
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	newFile := func(name string) *File {
+		return &File{User: "Lock_user", Dir: "lock", Name: name, Size: 1, ChunkCount: 1, Chunks: []*Chunk{{ServerID: server, Size: 1}}}
+	}
+	for _, name := range []string{"one", "two"} {
+		if _, err := repo.PutFile(newFile(name), nil); err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+	}
+	if _, err := repo.CopyFile("Lock_user", "lock", "one", "lock", "copy", nil); err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+
+	_, err = repo.SetFileLock("Lock_user", "lock", "missing", nil, true)
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+	until := time.Now().Add(time.Hour)
+	locked, err := repo.SetFileLock("Lock_user", "lock", "one", &until, false)
+	assert.NoError(t, err)
+	assert.True(t, locked.Locked(time.Now()))
+	assert.False(t, locked.Locked(until))
+
+	_, err = repo.DeleteFile("Lock_user", "lock", "one", nil)
+	assert.ErrorIs(t, err, ErrObjectLocked)
+	assert.ErrorIs(t, repo.RemoveFile(locked.ID), ErrObjectLocked)
+	_, err = repo.PutFile(newFile("one"), nil)
+	assert.ErrorIs(t, err, ErrObjectLocked)
+	_, err = repo.UpdateFileMeta("Lock_user", "lock", "one", "text/plain", nil)
+	assert.ErrorIs(t, err, ErrObjectLocked)
+	_, err = repo.MoveFile("Lock_user", "lock", "one", "lock", "moved", nil)
+	assert.ErrorIs(t, err, ErrObjectLocked)
+	_, err = repo.MoveFile("Lock_user", "lock", "two", "lock", "one", nil)
+	assert.ErrorIs(t, err, ErrObjectLocked)
+	_, err = repo.CopyFile("Lock_user", "lock", "two", "lock", "one", nil)
+	assert.ErrorIs(t, err, ErrObjectLocked)
+	expired, err := repo.ExpireFiles("Lock_user", "lock", time.Now().Add(time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Len(t, expired, 2)
+
+	_, err = repo.SetFileLock("Lock_user", "lock", "one", nil, false)
+	assert.ErrorIs(t, err, ErrRetentionShortened)
+	earlier := until.Add(-time.Minute)
+	_, err = repo.SetFileLock("Lock_user", "lock", "one", &earlier, false)
+	assert.ErrorIs(t, err, ErrRetentionShortened)
+	later := until.Add(time.Minute)
+	_, err = repo.SetFileLock("Lock_user", "lock", "one", &later, true)
+	assert.NoError(t, err)
+	retainUntil, legalHold, err := repo.GetBlobLock(locked.BlobID)
+	assert.NoError(t, err)
+	assert.True(t, legalHold)
+	if assert.NotNil(t, retainUntil) {
+		assert.True(t, later.Equal(*retainUntil))
+	}
+
+	removed, lockedFiles, err := repo.DeleteFiles("Lock_user", []*File{{Dir: "lock", Name: "one"}})
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.Len(t, lockedFiles, 1)
+	got, err := repo.GetFile("Lock_user", "lock", "one")
+	assert.NoError(t, err)
+	assert.True(t, got.LegalHold)
+
+	// an expired retention doesn't lock the file
+	past := time.Now().Add(-time.Minute)
+	_, err = repo.PutFile(newFile("two"), nil)
+	assert.NoError(t, err)
+	_, err = repo.SetFileLock("Lock_user", "lock", "two", &past, false)
+	assert.NoError(t, err)
+	_, err = repo.DeleteFile("Lock_user", "lock", "two", nil)
+	assert.NoError(t, err)
+}
+
+func TestRepository_Webhooks(t *testing.T) {
+	repo := setup()
+	all := &Webhook{User: "Webhook_user", URL: "http://hooks/all", Events: EventTypes}
+	created := &Webhook{User: "Webhook_user", URL: "http://hooks/builds", Prefix: "builds", Events: []string{EventObjectCreated}}
+	for _, w := range []*Webhook{all, created, {User: "Webhook_other", URL: "http://hooks/other", Events: EventTypes}} {
+		if err := repo.AddWebhook(w); err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+	}
+	hooks, err := repo.GetWebhooks("Webhook_user")
+	assert.NoError(t, err)
+	assert.Len(t, hooks, 2)
+
+	assert.NoError(t, queueEvents(repo.db, "Webhook_user",
+		NewEvent(EventObjectCreated, &File{Dir: "builds/1", Name: "a"}),
+		NewEvent(EventObjectRemoved, &File{Dir: "builds", Name: "b"}),
+		NewEvent(EventObjectCreated, &File{Dir: "builds-x", Name: "c"}),
+	))
+	assert.NoError(t, queueEvents(repo.db, "Webhook_nobody", NewEvent(EventObjectCreated, &File{Name: "a"})))
+
+	due, err := repo.GetDueDeliveries(time.Now(), 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 4) {
+		assert.NotNil(t, due[0].Webhook)
+	}
+	var toBuilds, toAll *Delivery
+	for _, d := range due {
+		if d.WebhookID == created.ID {
+			toBuilds = d
+		} else {
+			toAll = d
+		}
+	}
+	if !assert.NotNil(t, toBuilds) {
+		return
+	}
+	assert.Equal(t, "builds/1/a", toBuilds.Event.Key)
+	toBuilds.Attempts, toBuilds.LastError, toBuilds.Dead = 3, "refused", true
+	assert.NoError(t, repo.UpdateDelivery(toBuilds))
+	toAll.Attempts, toAll.NextAttemptAt = 1, time.Now().Add(time.Hour)
+	assert.NoError(t, repo.UpdateDelivery(toAll))
+	due, err = repo.GetDueDeliveries(time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, due, 2)
+
+	dead, err := repo.GetDeadDeliveries("Webhook_other", created.ID, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, dead)
+	dead, err = repo.GetDeadDeliveries("Webhook_user", created.ID, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, "refused", dead[0].LastError)
+	}
+	n, err := repo.RetryDeadDeliveries("Webhook_user", created.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	due, err = repo.GetDueDeliveries(time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, due, 3)
+
+	assert.NoError(t, repo.RemoveDeliveries([]uuid.UUID{due[0].ID}))
+	assert.ErrorIs(t, repo.RemoveWebhook("Webhook_other", all.ID), ErrRecordNotFound)
+	assert.NoError(t, repo.RemoveWebhook("Webhook_user", all.ID))
+	due, err = repo.GetDueDeliveries(time.Now(), 10)
+	assert.NoError(t, err)
+	for _, d := range due {
+		assert.Equal(t, created.ID, d.WebhookID)
+	}
+}
+
+func TestRepository_EventsOutbox(t *testing.T) {
+	repo := setup()
+	if err := repo.AddWebhook(&Webhook{User: "Outbox_user", URL: "http://hooks/all", Events: EventTypes}); err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	queued := func() []string {
+		due, err := repo.GetDueDeliveries(time.Now(), 100)
+		assert.NoError(t, err)
+		var (
+			ids    []uuid.UUID
+			events []string
+		)
+		for _, d := range due {
+			ids = append(ids, d.ID)
+			events = append(events, d.Event.Type+" "+d.Event.Key)
+		}
+		assert.NoError(t, repo.RemoveDeliveries(ids))
+		slices.Sort(events)
+		return events
+	}
+	newFile := func(name string) *File {
+		return &File{User: "Outbox_user", Dir: "dir", Name: name, Size: 10, CreatedAt: time.Now().Add(-time.Hour)}
+	}
+
+	_, err := repo.PutFile(newFile("a"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ObjectCreated dir/a"}, queued())
+	// a change that is rolled back queues nothing
+	_, err = repo.PutFile(newFile("a"), func(old *File) error { return ErrDuplicated })
+	assert.ErrorIs(t, err, ErrDuplicated)
+	_, err = repo.DeleteFile("Outbox_user", "dir", "a", func(old *File) error { return ErrDuplicated })
+	assert.ErrorIs(t, err, ErrDuplicated)
+	assert.Empty(t, queued())
+
+	_, err = repo.CopyFile("Outbox_user", "dir", "a", "dir", "b", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ObjectCreated dir/b"}, queued())
+	_, err = repo.MoveFile("Outbox_user", "dir", "b", "dir", "c", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ObjectCreated dir/c", "ObjectRemoved dir/b"}, queued())
+	_, err = repo.DeleteFile("Outbox_user", "dir", "c", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ObjectRemoved dir/c"}, queued())
+
+	_, err = repo.PutFile(newFile("d"), nil)
+	assert.NoError(t, err)
+	_ = queued()
+	_, _, err = repo.DeleteFiles("Outbox_user", []*File{{Dir: "dir", Name: "d"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ObjectRemoved dir/d"}, queued())
+	_, err = repo.ExpireFiles("Outbox_user", "", time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ObjectExpired dir/a"}, queued())
 }
@@ -6,10 +6,54 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	ServerActive = "active"
+	// ServerReadOnly is a server that keeps its chunks and takes no new ones
+	ServerReadOnly = "read-only"
+	// ServerDraining is a server that gives its chunks to the other servers, it's removed once it keeps none
+	ServerDraining = "draining"
+	// ServerDead is a server declared lost, its chunks are repaired from the other copies
+	ServerDead = "dead"
+)
+
+const (
+	DomainZone = "zone"
+	DomainRack = "rack"
+	DomainHost = "host"
+)
+
+// Topology places a server in the failure domains, a rack is in a zone and a host is in a rack
+type Topology struct {
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
 type Server struct {
 	ID   uuid.UUID `gorm:"type:uuid;primaryKey;default:(gen_random_uuid())"`
-	Name string
-	Port string
+	Name string    `gorm:"index:,unique,composite:server_address"`
+	Port string    `gorm:"index:,unique,composite:server_address"`
+	// State decides if the server is used, only an active server takes new chunks
+	State    string `gorm:"not null;default:active"`
+	Topology `gorm:"embedded"`
+}
+
+// Domain names the failure domain of the server at the level, the servers with no labels share a domain.
+// A server with no host label is a host of its own
+func (s *Server) Domain(level string) string {
+	switch level {
+	case DomainZone:
+		return s.Zone
+	case DomainRack:
+		return s.Zone + "/" + s.Rack
+	case DomainHost:
+		host := s.Host
+		if host == "" {
+			host = s.Name
+		}
+		return s.Zone + "/" + s.Rack + "/" + host
+	}
+	return ""
 }
 
 func (s *Server) GetID() uuid.UUID {
@@ -19,3 +63,18 @@ func (s *Server) GetID() uuid.UUID {
 func (s *Server) GetUrl() string {
 	return fmt.Sprintf("http://%s:%s/", s.Name, s.Port)
 }
+
+// ServerLoad counts what a server keeps, a chunk shared by copies of a file is counted once.
+// It's updated together with the chunks, so picking the servers for a file doesn't need to scan them
+type ServerLoad struct {
+	ServerID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Chunks   int64
+	Bytes    int64
+}
+
+// ServerUsage is what a server keeps, Bytes are counted as stored, after compression
+type ServerUsage struct {
+	Server
+	Chunks int64
+	Bytes  int64
+}
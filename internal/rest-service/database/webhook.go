@@ -0,0 +1,69 @@
+package database
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	EventObjectCreated = "ObjectCreated"
+	EventObjectRemoved = "ObjectRemoved"
+	// EventObjectExpired is sent for the objects a lifecycle rule removes
+	EventObjectExpired = "ObjectExpired"
+)
+
+// EventTypes are the events a webhook can subscribe to
+var EventTypes = []string{EventObjectCreated, EventObjectRemoved, EventObjectExpired}
+
+// Webhook sends the events of the user's objects in Prefix and its nested dirs to URL, an empty Prefix covers all the objects.
+// Every request is signed with Secret, see webhooks.Sign
+type Webhook struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey;default:(gen_random_uuid())" json:"id"`
+	User      string    `gorm:"index" json:"-"`
+	URL       string    `json:"url"`
+	Prefix    string    `json:"prefix"`
+	Events    []string  `gorm:"serializer:json" json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Matches tells if the webhook subscribes to the event
+func (w *Webhook) Matches(e *Event) bool {
+	if !slices.Contains(w.Events, e.Type) {
+		return false
+	}
+	dir, _ := SplitKey(e.Key)
+	return w.Prefix == "" || dir == w.Prefix || strings.HasPrefix(dir, w.Prefix+"/")
+}
+
+// Event is a change of an object, it's the body of a webhook request
+type Event struct {
+	ID   uuid.UUID `json:"id"`
+	Type string    `json:"type"`
+	Key  string    `json:"key"`
+	Size int64     `json:"size"`
+	ETag string    `json:"etag,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// NewEvent describes a change of the file
+func NewEvent(eventType string, f *File) *Event {
+	return &Event{ID: uuid.New(), Type: eventType, Key: JoinKey(f.Dir, f.Name), Size: f.Size, ETag: f.ETag, Time: time.Now().UTC()}
+}
+
+// Delivery is an event waiting in the outbox to be sent to a webhook, it's removed once the webhook accepts it.
+// A failed delivery is tried again at NextAttemptAt, one that failed too many times is Dead and kept for the user to retry
+type Delivery struct {
+	ID            uuid.UUID `gorm:"type:uuid;primaryKey;default:(gen_random_uuid())" json:"id"`
+	WebhookID     uuid.UUID `gorm:"type:uuid;index" json:"-"`
+	Webhook       *Webhook  `json:"-"`
+	Event         *Event    `gorm:"serializer:json" json:"event"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `gorm:"index" json:"-"`
+	LastError     string    `json:"last_error,omitempty"`
+	Dead          bool      `gorm:"index" json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+}
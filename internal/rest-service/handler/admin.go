@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+type QuotaRegistry interface {
+	SetQuota(q *database.Quota) error
+	RemoveQuota(user, dir string) error
+	GetQuotas(user string) ([]*database.Quota, []*database.Usage, error)
+}
+
+type rotateKeysResponse struct {
+	KeyID     string `json:"key_id"`
+	Rewrapped int    `json:"rewrapped"`
+}
+
+func rotateKeys(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		keyID, n, err := s.RotateKeys(r.Context())
+		if err != nil {
+			if errors.Is(err, storage.ErrEncryptionDisabled) {
+				http.Error(rw, err.Error(), http.StatusConflict)
+				return
+			}
+			tracing.Logger(r.Context(), l).WithError(err).WithField("rewrapped", n).Error("can't rotate keys")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &rotateKeysResponse{KeyID: keyID, Rewrapped: n})
+	}
+}
+
+type quotasResponse struct {
+	Quotas []*database.Quota `json:"quotas"`
+	Usage  []*database.Usage `json:"usage"`
+}
+
+func getQuotas(repo QuotaRegistry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		quotas, usage, err := repo.GetQuotas(r.PathValue(fieldNameUsername))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &quotasResponse{Quotas: quotas, Usage: usage})
+	}
+}
+
+// setQuota sets a user-wide quota, or a quota for the top-level dir given in the body, it covers the nested dirs too
+func setQuota(repo QuotaRegistry, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		q := &database.Quota{}
+		if err := json.NewDecoder(r.Body).Decode(q); err != nil || q.MaxBytes < 0 || q.MaxObjects < 0 || strings.Contains(q.Dir, "/") {
+			http.Error(rw, "can't read quota", http.StatusBadRequest)
+			return
+		}
+		q.User = r.PathValue(fieldNameUsername)
+		if err := repo.SetQuota(q); err != nil {
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't set quota")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tracing.Logger(r.Context(), l).WithFields(log.Fields{
+			fieldNameUsername: q.User,
+			fieldNameDir:      q.Dir,
+			"max_bytes":       q.MaxBytes,
+			"max_objects":     q.MaxObjects,
+		}).Info("quota set")
+		writeJSON(rw, http.StatusOK, q)
+	}
+}
+
+func removeQuota(repo QuotaRegistry, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, dir := r.PathValue(fieldNameUsername), r.URL.Query().Get(fieldNameDir)
+		if err := repo.RemoveQuota(username, dir); err != nil {
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't remove quota")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tracing.Logger(r.Context(), l).WithFields(log.Fields{fieldNameUsername: username, fieldNameDir: dir}).Info("quota removed")
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
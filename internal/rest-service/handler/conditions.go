@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+)
+
+// preconditions are the conditional request headers, nil lists are for headers that are not set
+type preconditions struct {
+	ifMatch         []string
+	ifNoneMatch     []string
+	ifModifiedSince time.Time
+}
+
+func parsePreconditions(h http.Header) *preconditions {
+	p := &preconditions{
+		ifMatch:     parseETags(h.Values("If-Match")),
+		ifNoneMatch: parseETags(h.Values("If-None-Match")),
+	}
+	if since, err := http.ParseTime(h.Get("If-Modified-Since")); err == nil {
+		p.ifModifiedSince = since
+	}
+	return p
+}
+
+// parseETags splits the header values into tags without quotes, weak tags are compared as strong ones
+func parseETags(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	tags := []string{}
+	for _, v := range values {
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag = strings.Trim(tag, `"`); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// matchETag checks if any of the tags matches the file, * matches any existing file
+func matchETag(tags []string, file *database.File) bool {
+	if file == nil {
+		return false
+	}
+	for _, tag := range tags {
+		if tag == "*" || (file.ETag != "" && tag == file.ETag) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWrite is the compare-and-swap check for a file about to be replaced or removed, old is nil if there is no file
+func (p *preconditions) checkWrite(old *database.File) error {
+	if p.ifMatch != nil && !matchETag(p.ifMatch, old) {
+		return storage.ErrPreconditionFailed
+	}
+	if p.ifNoneMatch != nil && matchETag(p.ifNoneMatch, old) {
+		return storage.ErrPreconditionFailed
+	}
+	return nil
+}
+
+// readStatus returns the status a GET or HEAD is answered with instead of the file, 0 if the file should be sent
+func (p *preconditions) readStatus(file *database.File) int {
+	if p.ifMatch != nil && !matchETag(p.ifMatch, file) {
+		return http.StatusPreconditionFailed
+	}
+	if p.ifNoneMatch != nil {
+		if matchETag(p.ifNoneMatch, file) {
+			return http.StatusNotModified
+		}
+		return 0
+	}
+	// Last-Modified has seconds precision
+	if !p.ifModifiedSince.IsZero() && !file.ModifiedAt.IsZero() && !file.ModifiedAt.Truncate(time.Second).After(p.ifModifiedSince) {
+		return http.StatusNotModified
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+)
+
+func TestPreconditions_checkWrite(t *testing.T) {
+	file := &database.File{ETag: "abc"}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		old     *database.File
+		wantErr error
+	}{
+		{name: "no conditions", old: file},
+		{name: "if-match", headers: map[string]string{"If-Match": `"abc"`}, old: file},
+		{name: "if-match list", headers: map[string]string{"If-Match": `"xyz", W/"abc"`}, old: file},
+		{name: "if-match changed", headers: map[string]string{"If-Match": `"xyz"`}, old: file, wantErr: storage.ErrPreconditionFailed},
+		{name: "if-match no file", headers: map[string]string{"If-Match": `*`}, wantErr: storage.ErrPreconditionFailed},
+		{name: "create only", headers: map[string]string{"If-None-Match": `*`}},
+		{name: "create only exists", headers: map[string]string{"If-None-Match": `*`}, old: file, wantErr: storage.ErrPreconditionFailed},
+		{name: "if-none-match other", headers: map[string]string{"If-None-Match": `"xyz"`}, old: file},
+		{name: "no etag", headers: map[string]string{"If-Match": `""`}, old: &database.File{}, wantErr: storage.ErrPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			assert.ErrorIs(t, parsePreconditions(h).checkWrite(tt.old), tt.wantErr)
+		})
+	}
+}
+
+func TestPreconditions_readStatus(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 10, 0, 0, 500, time.UTC)
+	file := &database.File{ETag: "abc", ModifiedAt: modified}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{name: "no conditions"},
+		{name: "cached", headers: map[string]string{"If-None-Match": `"abc"`}, want: http.StatusNotModified},
+		{name: "changed", headers: map[string]string{"If-None-Match": `"xyz"`}},
+		{name: "not modified since", headers: map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, want: http.StatusNotModified},
+		{name: "modified since", headers: map[string]string{"If-Modified-Since": modified.Add(-time.Second).Format(http.TimeFormat)}},
+		{
+			name:    "etag wins over date",
+			headers: map[string]string{"If-None-Match": `"xyz"`, "If-Modified-Since": modified.Format(http.TimeFormat)},
+		},
+		{name: "if-match changed", headers: map[string]string{"If-Match": `"xyz"`}, want: http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			assert.Equal(t, tt.want, parsePreconditions(h).readStatus(file))
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	restMetrics "github.com/konorlevich/test_task_s3/internal/rest-service/metrics"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+const (
+	headerCopySource = "X-Copy-Source"
+	headerMoveSource = "X-Move-Source"
+)
+
+var (
+	errBadSource = errors.New("the source must be set once, as the key of an object")
+	errSelfCopy  = errors.New("an object can't be copied onto itself")
+)
+
+// withCopy serves the requests naming a source object with copyFile, uploads are passed to next
+func withCopy(s *storage.Server, l *log.Entry, next http.HandlerFunc) http.HandlerFunc {
+	relink := copyFile(s, l)
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerCopySource) != "" || r.Header.Get(headerMoveSource) != "" {
+			relink(rw, r)
+			return
+		}
+		next(rw, r)
+	}
+}
+
+// copyFile copies the object set with X-Copy-Source or renames the one set with X-Move-Source to the request key.
+// No data passes through the service, the preconditions are checked against the object that is replaced
+func copyFile(s *storage.Server, l *log.Entry) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		dir, name, err := objectPath(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		copySource, moveSource := r.Header.Get(headerCopySource), r.Header.Get(headerMoveSource)
+		if copySource != "" && moveSource != "" {
+			http.Error(rw, errBadSource.Error(), http.StatusBadRequest)
+			return
+		}
+		relink, source := s.CopyFile, copySource
+		if moveSource != "" {
+			relink, source = s.MoveFile, moveSource
+		}
+		srcDir, srcName, err := parseKey(source)
+		if err != nil {
+			http.Error(rw, errBadSource.Error(), http.StatusBadRequest)
+			return
+		}
+		if copySource != "" && srcDir == dir && srcName == name {
+			http.Error(rw, errSelfCopy.Error(), http.StatusBadRequest)
+			return
+		}
+		l := tracing.Logger(r.Context(), l).WithFields(log.Fields{
+			fieldNameUsername: username,
+			fieldNameDir:      dir,
+			fieldNameFileName: name,
+			"source":          source,
+		})
+
+		file, err := relink(r.Context(), username, srcDir, srcName, dir, name, parsePreconditions(r.Header).checkWrite)
+		if err != nil {
+			restMetrics.CountError(err, countedErrors)
+			if errors.Is(err, ErrFileNotFound) {
+				http.NotFound(rw, r)
+				return
+			}
+			http.Error(rw, err.Error(), saveErrorStatus(err))
+			return
+		}
+		if moveSource != "" {
+			l.Info("file moved")
+		} else {
+			l.Info("file copied")
+		}
+		rw.Header().Set("ETag", `"`+file.ETag+`"`)
+		_, _ = rw.Write([]byte("file saved"))
+	}
+}
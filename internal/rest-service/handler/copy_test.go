@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		wantErr error
+	}{
+		{name: "copy and move", header: http.Header{headerCopySource: {"a/src"}, headerMoveSource: {"a/src"}}, wantErr: errBadSource},
+		{name: "bad key", header: http.Header{headerCopySource: {"a/"}}, wantErr: errBadSource},
+		{name: "copy onto itself", header: http.Header{headerCopySource: {"/a//name"}}, wantErr: errSelfCopy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/files/a/name", nil)
+			r.SetPathValue(fieldNameKey, "a/name")
+			r.Header = tt.header
+			rw := httptest.NewRecorder()
+			copyFile(nil, getLogger())(rw, r)
+			assert.Equal(t, http.StatusBadRequest, rw.Code)
+			assert.Contains(t, rw.Body.String(), tt.wantErr.Error())
+		})
+	}
+}
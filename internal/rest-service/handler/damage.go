@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+// maxDamageReport limits the chunks a storage server reports at a time
+const maxDamageReport = 1000
+
+var errBadDamageReport = errors.New(`the report must be {"hostname": "...", "port": "...", "chunks": [{"username": "...", "file_id": "...", "chunk_id": "N", "reason": "corrupt"}]}`)
+
+type DamageRegistry interface {
+	AddDamagedChunks(name, port string, chunks []*database.DamagedChunk) (int, error)
+	GetDamagedChunks(limit int) ([]*database.DamagedChunk, error)
+}
+
+type damagedChunk struct {
+	Username string `json:"username"`
+	FileId   string `json:"file_id"`
+	ChunkId  string `json:"chunk_id"`
+	Reason   string `json:"reason"`
+}
+
+type damageReport struct {
+	Hostname string          `json:"hostname"`
+	Port     string          `json:"port"`
+	Chunks   []*damagedChunk `json:"chunks"`
+}
+
+type damageReportResponse struct {
+	Recorded int `json:"recorded"`
+}
+
+type damagedChunksResponse struct {
+	Chunks []*database.DamagedChunk `json:"chunks"`
+}
+
+// readDamageReport reads the chunks a storage server found damaged, the chunks are named as the server keeps them
+func readDamageReport(r *http.Request) (*damageReport, []*database.DamagedChunk, error) {
+	report := &damageReport{}
+	if err := json.NewDecoder(r.Body).Decode(report); err != nil {
+		return nil, nil, errBadDamageReport
+	}
+	if report.Hostname == "" || report.Port == "" || len(report.Chunks) == 0 || len(report.Chunks) > maxDamageReport {
+		return nil, nil, errBadDamageReport
+	}
+	chunks := make([]*database.DamagedChunk, len(report.Chunks))
+	for i, c := range report.Chunks {
+		blobID, err := uuid.Parse(c.FileId)
+		if err != nil {
+			return nil, nil, errBadDamageReport
+		}
+		number, err := strconv.ParseUint(c.ChunkId, 10, 32)
+		if err != nil || c.Username == "" || (c.Reason != database.DamageCorrupt && c.Reason != database.DamageMissing) {
+			return nil, nil, errBadDamageReport
+		}
+		chunks[i] = &database.DamagedChunk{User: c.Username, BlobID: blobID, Number: uint(number), Reason: c.Reason}
+	}
+	return report, chunks, nil
+}
+
+// ReportDamage records the chunks a storage server found damaged with its scrubber, they wait to be repaired
+func ReportDamage(repo DamageRegistry, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		report, chunks, err := readDamageReport(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l := tracing.Logger(r.Context(), l).WithFields(log.Fields{"hostname": report.Hostname, "port": report.Port})
+		n, err := repo.AddDamagedChunks(report.Hostname, report.Port, chunks)
+		if err != nil {
+			if errors.Is(err, database.ErrRecordNotFound) {
+				http.Error(rw, "unknown storage server", http.StatusNotFound)
+				return
+			}
+			l.WithError(err).Error("can't record damaged chunks")
+			http.Error(rw, "can't record damaged chunks", http.StatusInternalServerError)
+			return
+		}
+		l.WithFields(log.Fields{"reported": len(chunks), "recorded": n}).Warning("damaged chunks reported")
+		writeJSON(rw, http.StatusOK, &damageReportResponse{Recorded: n})
+	}
+}
+
+func getDamagedChunks(repo DamageRegistry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		chunks, err := repo.GetDamagedChunks(maxListLimit)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &damagedChunksResponse{Chunks: chunks})
+	}
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+const (
+	headerRetainUntil = "X-Retain-Until"
+	headerLegalHold   = "X-Legal-Hold"
+	// headerDegraded is set for a file stored on fewer servers than it should be, see database.File.Degraded
+	headerDegraded = "X-Degraded"
+)
+
+// writeFileHeaders describes the file in the response headers, GET and HEAD return the same ones
+func writeFileHeaders(rw http.ResponseWriter, file *database.File) {
+	h := rw.Header()
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	if file.ETag != "" {
+		h.Set("ETag", `"`+file.ETag+`"`)
+	}
+	if !file.ModifiedAt.IsZero() {
+		h.Set("Last-Modified", file.ModifiedAt.UTC().Format(http.TimeFormat))
+	}
+	if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}); disposition != "" {
+		h.Set("Content-Disposition", disposition)
+	}
+	if file.RetainUntil != nil {
+		h.Set(headerRetainUntil, file.RetainUntil.UTC().Format(time.RFC3339))
+	}
+	if file.LegalHold {
+		h.Set(headerLegalHold, "on")
+	}
+	if file.Degraded {
+		h.Set(headerDegraded, "true")
+	}
+	for k, v := range file.Metadata {
+		h.Set(headerMetaPrefix+k, v)
+	}
+}
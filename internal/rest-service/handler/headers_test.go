@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+func TestWriteFileHeaders(t *testing.T) {
+	rw := httptest.NewRecorder()
+	writeFileHeaders(rw, &database.File{
+		Name:       "report 1.pdf",
+		Size:       42,
+		ModifiedAt: time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*3600)),
+		Metadata:   map[string]string{"owner": "team a"},
+		RetainUntil: func() *time.Time {
+			t := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+			return &t
+		}(),
+		LegalHold: true,
+		Degraded:  true,
+	})
+	h := rw.Header()
+	assert.Equal(t, defaultContentType, h.Get("Content-Type"))
+	assert.Equal(t, "42", h.Get("Content-Length"))
+	assert.Equal(t, "Wed, 01 May 2024 08:00:00 GMT", h.Get("Last-Modified"))
+	assert.Equal(t, `attachment; filename="report 1.pdf"`, h.Get("Content-Disposition"))
+	assert.Equal(t, "team a", h.Get("X-Meta-Owner"))
+	assert.Equal(t, "2030-01-02T03:04:05Z", h.Get("X-Retain-Until"))
+	assert.Equal(t, "on", h.Get("X-Legal-Hold"))
+	assert.Equal(t, "true", h.Get("X-Degraded"))
+
+	rw = httptest.NewRecorder()
+	writeFileHeaders(rw, &database.File{Name: "spread", Size: 1})
+	assert.Empty(t, rw.Header().Get("X-Degraded"))
+}
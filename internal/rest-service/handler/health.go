@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+const probeTimeout = 2 * time.Second
+
+type HealthRepository interface {
+	Ping(ctx context.Context) error
+	GetServerUsage() ([]*database.ServerUsage, error)
+	GetTotalUsage() (*database.Usage, error)
+}
+
+type ServerProber interface {
+	Ping(ctx context.Context, server files.ServerMeta) error
+}
+
+type check struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]*check `json:"checks"`
+}
+
+type serverStatus struct {
+	ID        string            `json:"id"`
+	Url       string            `json:"url"`
+	State     string            `json:"state"`
+	Topology  database.Topology `json:"topology"`
+	Reachable bool              `json:"reachable"`
+	Error     string            `json:"error,omitempty"`
+	Chunks    int64             `json:"chunks"`
+	Bytes     int64             `json:"bytes"`
+}
+
+type statusResponse struct {
+	Ready            bool            `json:"ready"`
+	ChunkNum         int             `json:"chunk_num"`
+	ServersTotal     int             `json:"servers_total"`
+	ServersReachable int             `json:"servers_reachable"`
+	Servers          []*serverStatus `json:"servers"`
+	Objects          int64           `json:"objects"`
+	Bytes            int64           `json:"bytes"`
+	Encryption       bool            `json:"encryption"`
+}
+
+func healthz(rw http.ResponseWriter, _ *http.Request) {
+	_, _ = rw.Write([]byte("ok"))
+}
+
+// readyz reports the service ready when the metadata db answers and there are enough storage servers to store a file
+func readyz(repo HealthRepository, prober ServerProber, chunkNum int, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		res := &readinessResponse{Ready: true, Checks: map[string]*check{}}
+
+		res.Checks["database"] = newCheck(repo.Ping(r.Context()))
+		servers, err := probeServers(r.Context(), repo, prober)
+		storageCheck := newCheck(err)
+		if err == nil {
+			if reachable := countReachable(servers); reachable < chunkNum {
+				storageCheck = &check{Error: fmt.Sprintf("not enough storage servers: %d reachable, %d needed", reachable, chunkNum)}
+			}
+		}
+		res.Checks["storage_servers"] = storageCheck
+
+		status := http.StatusOK
+		for name, c := range res.Checks {
+			if !c.OK {
+				res.Ready = false
+				status = http.StatusServiceUnavailable
+				tracing.Logger(r.Context(), l).WithField("check", name).Warning(c.Error)
+			}
+		}
+		writeJSON(rw, status, res)
+	}
+}
+
+// status summarises the cluster: every storage server with its load and what the users store in total
+func status(repo HealthRepository, prober ServerProber, chunkNum int, encryption bool, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		servers, err := probeServers(r.Context(), repo, prober)
+		if err != nil {
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't get servers")
+			http.Error(rw, "can't get servers", http.StatusInternalServerError)
+			return
+		}
+		total, err := repo.GetTotalUsage()
+		if err != nil {
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't get usage")
+			http.Error(rw, "can't get usage", http.StatusInternalServerError)
+			return
+		}
+		reachable := countReachable(servers)
+		writeJSON(rw, http.StatusOK, &statusResponse{
+			Ready:            reachable >= chunkNum && repo.Ping(r.Context()) == nil,
+			ChunkNum:         chunkNum,
+			ServersTotal:     len(servers),
+			ServersReachable: reachable,
+			Servers:          servers,
+			Objects:          total.Objects,
+			Bytes:            total.Bytes,
+			Encryption:       encryption,
+		})
+	}
+}
+
+// probeServers checks all registered servers at once
+func probeServers(ctx context.Context, repo HealthRepository, prober ServerProber) ([]*serverStatus, error) {
+	usage, err := repo.GetServerUsage()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	res := make([]*serverStatus, len(usage))
+	wg := &sync.WaitGroup{}
+	for i, u := range usage {
+		res[i] = &serverStatus{ID: u.ID.String(), Url: u.GetUrl(), State: u.State, Topology: u.Topology, Chunks: u.Chunks, Bytes: u.Bytes}
+		wg.Add(1)
+		go func(s *serverStatus, server *database.Server) {
+			defer wg.Done()
+			if err := prober.Ping(ctx, server); err != nil {
+				s.Error = err.Error()
+				return
+			}
+			s.Reachable = true
+		}(res[i], &u.Server)
+	}
+	wg.Wait()
+	return res, nil
+}
+
+func countReachable(servers []*serverStatus) int {
+	n := 0
+	for _, s := range servers {
+		if s.Reachable {
+			n++
+		}
+	}
+	return n
+}
+
+func newCheck(err error) *check {
+	if err != nil {
+		return &check{Error: err.Error()}
+	}
+	return &check{OK: true}
+}
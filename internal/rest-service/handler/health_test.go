@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+)
+
+type mockHealthRepository struct {
+	pingErr  error
+	usageErr error
+	servers  []*database.ServerUsage
+	total    *database.Usage
+}
+
+func (m *mockHealthRepository) Ping(_ context.Context) error {
+	return m.pingErr
+}
+
+func (m *mockHealthRepository) GetServerUsage() ([]*database.ServerUsage, error) {
+	return m.servers, m.usageErr
+}
+
+func (m *mockHealthRepository) GetTotalUsage() (*database.Usage, error) {
+	if m.total == nil {
+		return nil, errors.New("no usage")
+	}
+	return m.total, nil
+}
+
+// mockProber can't reach the servers named down
+type mockProber struct {
+	down map[string]bool
+}
+
+func (m *mockProber) Ping(_ context.Context, server files.ServerMeta) error {
+	if m.down[server.GetUrl()] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func newServerUsage(name string, chunks, bytes int64) *database.ServerUsage {
+	return &database.ServerUsage{Server: database.Server{ID: uuid.New(), Name: name, Port: "8080"}, Chunks: chunks, Bytes: bytes}
+}
+
+func TestReadyz(t *testing.T) {
+	servers := []*database.ServerUsage{newServerUsage("s1", 0, 0), newServerUsage("s2", 0, 0)}
+	tests := []struct {
+		name       string
+		repo       *mockHealthRepository
+		down       map[string]bool
+		wantStatus int
+		wantFailed []string
+	}{
+		{name: "ready", repo: &mockHealthRepository{servers: servers}, wantStatus: http.StatusOK},
+		{name: "database down", repo: &mockHealthRepository{pingErr: errors.New("closed"), servers: servers},
+			wantStatus: http.StatusServiceUnavailable, wantFailed: []string{"database"}},
+		{name: "server unreachable", repo: &mockHealthRepository{servers: servers}, down: map[string]bool{"http://s2:8080/": true},
+			wantStatus: http.StatusServiceUnavailable, wantFailed: []string{"storage_servers"}},
+		{name: "no servers", repo: &mockHealthRepository{usageErr: errors.New("closed")},
+			wantStatus: http.StatusServiceUnavailable, wantFailed: []string{"storage_servers"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			readyz(tt.repo, &mockProber{down: tt.down}, 2, getLogger())(rw, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			res := &readinessResponse{}
+			if assert.NoError(t, json.NewDecoder(rw.Body).Decode(res)) {
+				assert.Equal(t, tt.wantFailed == nil, res.Ready)
+				for name, c := range res.Checks {
+					assert.Equal(t, !slices.Contains(tt.wantFailed, name), c.OK, name)
+				}
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	servers := []*database.ServerUsage{newServerUsage("s1", 3, 300), newServerUsage("s2", 1, 100)}
+	repo := &mockHealthRepository{servers: servers, total: &database.Usage{Objects: 2, Bytes: 400}}
+	rw := httptest.NewRecorder()
+	status(repo, &mockProber{down: map[string]bool{"http://s2:8080/": true}}, 1, true, getLogger())(rw, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	res := &statusResponse{}
+	if assert.NoError(t, json.NewDecoder(rw.Body).Decode(res)) {
+		assert.True(t, res.Ready)
+		assert.Equal(t, 1, res.ChunkNum)
+		assert.Equal(t, 2, res.ServersTotal)
+		assert.Equal(t, 1, res.ServersReachable)
+		assert.Equal(t, int64(2), res.Objects)
+		assert.Equal(t, int64(400), res.Bytes)
+		assert.True(t, res.Encryption)
+		if assert.Len(t, res.Servers, 2) {
+			assert.Equal(t, &serverStatus{ID: servers[0].ID.String(), Url: "http://s1:8080/", Reachable: true, Chunks: 3, Bytes: 300}, res.Servers[0])
+			assert.False(t, res.Servers[1].Reachable)
+			assert.Equal(t, "connection refused", res.Servers[1].Error)
+		}
+	}
+
+	rw = httptest.NewRecorder()
+	status(&mockHealthRepository{usageErr: errors.New("closed")}, &mockProber{}, 1, false, getLogger())(rw, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	rw = httptest.NewRecorder()
+	status(&mockHealthRepository{servers: servers}, &mockProber{}, 1, false, getLogger())(rw, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+	assert.Equal(t, http.StatusInternalServerError, rw.Code, "no usage")
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	fieldNameKey    = "key"
+	fieldNamePrefix = "prefix"
+
+	// maxKeyLength limits the whole key, maxNameLength limits every part of it
+	maxKeyLength  = 1024
+	maxNameLength = 255
+)
+
+var errBadKey = errors.New("bad object key")
+
+// objectPath returns the dir and the name of the object the request is for
+func objectPath(r *http.Request) (string, string, error) {
+	return parseKey(r.PathValue(fieldNameKey))
+}
+
+// parseKey splits the object key into its dir and name, a key without dirs has an empty dir.
+// Leading and repeated slashes are dropped, a key can't end with a slash
+func parseKey(key string) (string, string, error) {
+	if strings.HasSuffix(key, "/") {
+		return "", "", errBadKey
+	}
+	parts, err := splitPath(key)
+	if err != nil || len(parts) == 0 {
+		return "", "", errBadKey
+	}
+	return strings.Join(parts[:len(parts)-1], "/"), parts[len(parts)-1], nil
+}
+
+// parseDir normalises a dir path as parseKey does, a trailing slash is allowed and an empty path is the root
+func parseDir(dir string) (string, error) {
+	parts, err := splitPath(dir)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+func splitPath(p string) ([]string, error) {
+	if len(p) > maxKeyLength || !utf8.ValidString(p) {
+		return nil, errBadKey
+	}
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		switch {
+		case part == "":
+			continue
+		case part == "." || part == "..", len(part) > maxNameLength, strings.ContainsFunc(part, unicode.IsControl):
+			return nil, errBadKey
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		dir     string
+		name    string
+		wantErr error
+	}{
+		{key: "name", name: "name"},
+		{key: "dir/name", dir: "dir", name: "name"},
+		{key: "a/b/c/name.txt", dir: "a/b/c", name: "name.txt"},
+		{key: "/a//b/name", dir: "a/b", name: "name"},
+		{key: "a/b c/имя", dir: "a/b c", name: "имя"},
+		{key: "", wantErr: errBadKey},
+		{key: "/", wantErr: errBadKey},
+		{key: "a/b/", wantErr: errBadKey},
+		{key: "a/../name", wantErr: errBadKey},
+		{key: "a/./name", wantErr: errBadKey},
+		{key: "a/na\nme", wantErr: errBadKey},
+		{key: "a/\xff", wantErr: errBadKey},
+		{key: "a/" + strings.Repeat("n", maxNameLength+1), wantErr: errBadKey},
+		{key: strings.Repeat("d/", maxKeyLength/2) + "n", wantErr: errBadKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			dir, name, err := parseKey(tt.key)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.dir, dir)
+			assert.Equal(t, tt.name, name)
+		})
+	}
+}
+
+func TestParseDir(t *testing.T) {
+	for prefix, want := range map[string]string{"": "", "/": "", "a/b/": "a/b", "/a//b": "a/b"} {
+		got, err := parseDir(prefix)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, prefix)
+	}
+	_, err := parseDir("a/../b")
+	assert.ErrorIs(t, err, errBadKey)
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+const (
+	// maxLifecycleRules limits the rules of a user, each rule costs the reaper a query
+	maxLifecycleRules = 100
+	maxExpireDays     = 100 * 365
+)
+
+var errBadLifecycleRule = errors.New(`the rule must be {"prefix": "dir", "expire_days": N} with N from 1 to 36500`)
+
+type LifecycleRegistry interface {
+	AddLifecycleRule(rule *database.LifecycleRule) error
+	GetLifecycleRules(user string) ([]*database.LifecycleRule, error)
+	RemoveLifecycleRule(user string, id uuid.UUID) error
+}
+
+type lifecycleResponse struct {
+	Rules []*database.LifecycleRule `json:"rules"`
+}
+
+type lifecycleReportResponse struct {
+	Reports []*storage.LifecycleReport `json:"reports"`
+}
+
+// readLifecycleRule reads a rule, an empty prefix makes it cover all the objects of the user
+func readLifecycleRule(r *http.Request) (*database.LifecycleRule, error) {
+	rule := &database.LifecycleRule{}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 2*maxKeyLength)).Decode(rule); err != nil {
+		return nil, errBadLifecycleRule
+	}
+	if rule.ExpireDays < 1 || rule.ExpireDays > maxExpireDays {
+		return nil, errBadLifecycleRule
+	}
+	prefix, err := parseDir(rule.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &database.LifecycleRule{Prefix: prefix, ExpireDays: rule.ExpireDays}, nil
+}
+
+func getLifecycleRules(repo LifecycleRegistry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		rules, err := repo.GetLifecycleRules(username)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &lifecycleResponse{Rules: rules})
+	}
+}
+
+// addLifecycleRule adds a rule expiring the objects in the prefix dir and its nested dirs.
+// The objects are removed in the background, see the dry run for what a rule would remove
+func addLifecycleRule(repo LifecycleRegistry, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		rule, err := readLifecycleRule(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule.User = username
+		l := tracing.Logger(r.Context(), l).WithFields(log.Fields{fieldNameUsername: username, "prefix": rule.Prefix})
+		rules, err := repo.GetLifecycleRules(username)
+		if err == nil && len(rules) >= maxLifecycleRules {
+			http.Error(rw, "too many lifecycle rules", http.StatusConflict)
+			return
+		}
+		if err == nil {
+			err = repo.AddLifecycleRule(rule)
+		}
+		if err != nil {
+			l.WithError(err).Error("can't add lifecycle rule")
+			http.Error(rw, "can't add lifecycle rule", http.StatusInternalServerError)
+			return
+		}
+		l.WithFields(log.Fields{"rule": rule.ID, "expire_days": rule.ExpireDays}).Info("lifecycle rule added")
+		writeJSON(rw, http.StatusCreated, rule)
+	}
+}
+
+func removeLifecycleRule(repo LifecycleRegistry, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.NotFound(rw, r)
+			return
+		}
+		if err := repo.RemoveLifecycleRule(username, id); err != nil {
+			if errors.Is(err, database.ErrRecordNotFound) {
+				http.NotFound(rw, r)
+				return
+			}
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't remove lifecycle rule")
+			http.Error(rw, "can't remove lifecycle rule", http.StatusInternalServerError)
+			return
+		}
+		tracing.Logger(r.Context(), l).WithFields(log.Fields{fieldNameUsername: username, "rule": id}).Info("lifecycle rule removed")
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// lifecycleDryRun reports what the rules of the user would remove now, nothing is removed
+func lifecycleDryRun(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		reports, err := s.LifecycleReport(r.Context(), username, maxListLimit)
+		if err != nil {
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't report lifecycle")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &lifecycleReportResponse{Reports: reports})
+	}
+}
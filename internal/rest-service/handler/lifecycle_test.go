@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+func TestReadLifecycleRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    *database.LifecycleRule
+		wantErr error
+	}{
+		{name: "rule", body: `{"prefix":"builds/","expire_days":30}`, want: &database.LifecycleRule{Prefix: "builds", ExpireDays: 30}},
+		{name: "all objects", body: `{"expire_days":1}`, want: &database.LifecycleRule{ExpireDays: 1}},
+		{name: "user is ignored", body: `{"User":"other","expire_days":1}`, want: &database.LifecycleRule{ExpireDays: 1}},
+		{name: "no days", body: `{"prefix":"builds"}`, wantErr: errBadLifecycleRule},
+		{name: "too many days", body: `{"expire_days":36501}`, wantErr: errBadLifecycleRule},
+		{name: "not json", body: `rule`, wantErr: errBadLifecycleRule},
+		{name: "bad prefix", body: `{"prefix":"../builds","expire_days":1}`, wantErr: errBadKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readLifecycleRule(httptest.NewRequest("POST", "/lifecycle", strings.NewReader(tt.body)))
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package handler
+
+import "sync/atomic"
+
+// Limits are the request limits that can be changed while the service runs
+type Limits struct {
+	maxUploadSize atomic.Int64
+}
+
+func NewLimits(maxUploadSize int64) *Limits {
+	l := &Limits{}
+	l.SetMaxUploadSize(maxUploadSize)
+	return l
+}
+
+// MaxUploadSize is the max upload request size in bytes, 0 is unlimited
+func (l *Limits) MaxUploadSize() int64 {
+	return l.maxUploadSize.Load()
+}
+
+func (l *Limits) SetMaxUploadSize(n int64) {
+	l.maxUploadSize.Store(n)
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+// maxListLimit is the page size of a listing, a smaller one can be asked with limit
+const maxListLimit = 1000
+
+type FileLister interface {
+	ListFiles(user, dir string, recursive bool, afterDir, afterName string, limit int) ([]*database.File, error)
+	ListDirs(user, dir string) ([]string, error)
+}
+
+type objectInfo struct {
+	Key         string            `json:"key"`
+	Size        int64             `json:"size"`
+	ETag        string            `json:"etag,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ModifiedAt  time.Time         `json:"modified_at"`
+}
+
+type listResponse struct {
+	Objects []*objectInfo `json:"objects"`
+	// Dirs are the keys of the dirs right in the listed one, with a trailing slash
+	Dirs []string `json:"dirs,omitempty"`
+	// Next is the after parameter of the next page, empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+// listFiles lists the objects in the dir the path names, /objects/ is the root.
+// With recursive=true the objects of the nested dirs are listed too, otherwise the nested dirs are given on the first page.
+// Objects are ordered by dir, then name, a page ends after limit objects
+func listFiles(repo FileLister, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		dir, err := parseDir(r.PathValue(fieldNamePrefix))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		recursive, err := strconv.ParseBool(query.Get("recursive"))
+		if err != nil && query.Has("recursive") {
+			http.Error(rw, "bad recursive", http.StatusBadRequest)
+			return
+		}
+		limit := maxListLimit
+		if query.Has("limit") {
+			if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit <= 0 {
+				http.Error(rw, "bad limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(limit, maxListLimit)
+		}
+		var afterDir, afterName string
+		if query.Has("after") {
+			if afterDir, afterName, err = parseKey(query.Get("after")); err != nil {
+				http.Error(rw, "bad after", http.StatusBadRequest)
+				return
+			}
+		}
+		l := tracing.Logger(r.Context(), l).WithFields(log.Fields{fieldNameUsername: username, fieldNameDir: dir})
+
+		// one more file is taken to know if there is a next page
+		files, err := repo.ListFiles(username, dir, recursive, afterDir, afterName, limit+1)
+		if err != nil {
+			l.WithError(err).Error("can't list files")
+			http.Error(rw, "can't list files", http.StatusInternalServerError)
+			return
+		}
+		res := &listResponse{Objects: make([]*objectInfo, 0, len(files))}
+		if len(files) > limit {
+			files = files[:limit]
+			res.Next = database.JoinKey(files[limit-1].Dir, files[limit-1].Name)
+		}
+		for _, f := range files {
+			res.Objects = append(res.Objects, &objectInfo{
+				Key:         database.JoinKey(f.Dir, f.Name),
+				Size:        f.Size,
+				ETag:        f.ETag,
+				ContentType: f.ContentType,
+				Metadata:    f.Metadata,
+				ModifiedAt:  f.ModifiedAt,
+			})
+		}
+		if !recursive && afterName == "" {
+			dirs, err := repo.ListDirs(username, dir)
+			if err != nil {
+				l.WithError(err).Error("can't list dirs")
+				http.Error(rw, "can't list files", http.StatusInternalServerError)
+				return
+			}
+			for _, d := range dirs {
+				res.Dirs = append(res.Dirs, database.JoinKey(dir, d)+"/")
+			}
+		}
+		writeJSON(rw, http.StatusOK, res)
+	}
+}
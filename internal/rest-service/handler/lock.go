@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+// lockInfo is the lock of an object, it can't be removed or replaced before RetainUntil or while LegalHold is set
+type lockInfo struct {
+	RetainUntil *time.Time `json:"retain_until"`
+	LegalHold   bool       `json:"legal_hold"`
+}
+
+func newLockInfo(file *database.File) *lockInfo {
+	return &lockInfo{RetainUntil: file.RetainUntil, LegalHold: file.LegalHold}
+}
+
+func getLock(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		dir, name, err := objectPath(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, err := s.StatFile(r.Context(), r.PathValue(fieldNameUsername), dir, name)
+		if err != nil {
+			if errors.Is(err, ErrFileNotFound) {
+				http.NotFound(rw, r)
+				return
+			}
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't get file")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, newLockInfo(file))
+	}
+}
+
+// setLock replaces the lock of an object. A retention in force can only be extended, the legal hold is set or removed
+func setLock(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username := r.PathValue(fieldNameUsername)
+		dir, name, err := objectPath(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lock := &lockInfo{}
+		if err := json.NewDecoder(r.Body).Decode(lock); err != nil {
+			http.Error(rw, "can't read lock", http.StatusBadRequest)
+			return
+		}
+		l := tracing.Logger(r.Context(), l).WithFields(log.Fields{
+			fieldNameUsername: username,
+			fieldNameDir:      dir,
+			fieldNameFileName: name,
+			"retain_until":    lock.RetainUntil,
+			"legal_hold":      lock.LegalHold,
+		})
+		file, err := s.SetLock(r.Context(), username, dir, name, lock.RetainUntil, lock.LegalHold)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrFileNotFound):
+				http.NotFound(rw, r)
+			case errors.Is(err, database.ErrRetentionShortened):
+				http.Error(rw, err.Error(), http.StatusConflict)
+			default:
+				l.WithError(err).Error("can't lock file")
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		l.Info("file lock set")
+		writeJSON(rw, http.StatusOK, newLockInfo(file))
+	}
+}
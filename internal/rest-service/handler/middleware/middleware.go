@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"net/http"
 )
 
@@ -16,3 +17,42 @@ func CheckAuth(next http.Handler) http.Handler {
 		next.ServeHTTP(rw, r)
 	})
 }
+
+const headerAdminToken = "X-Admin-Token"
+
+// CheckAdmin lets the request through only with a valid admin token. Admin endpoints are disabled without a token
+func CheckAdmin(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			rw.WriteHeader(http.StatusForbidden)
+			_, _ = rw.Write([]byte("admin api is disabled"))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(headerAdminToken)), []byte(token)) != 1 {
+			rw.WriteHeader(http.StatusUnauthorized)
+			_, _ = rw.Write([]byte("you are not authorized for this action"))
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+const headerNodeToken = "X-Node-Token"
+
+// CheckNode lets the request of a storage server through only with a valid node token.
+// The storage servers can't report to the rest-service without a token
+func CheckNode(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			rw.WriteHeader(http.StatusForbidden)
+			_, _ = rw.Write([]byte("node api is disabled"))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(headerNodeToken)), []byte(token)) != 1 {
+			rw.WriteHeader(http.StatusUnauthorized)
+			_, _ = rw.Write([]byte("you are not authorized for this action"))
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
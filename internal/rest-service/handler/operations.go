@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+// maxDeleteKeys is how many keys a bulk delete request may name
+const maxDeleteKeys = 1000
+
+var errBadDeleteRequest = errors.New(`the request must be {"keys": [...]} with 1 to 1000 object keys`)
+
+type deleteRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// readDeleteRequest returns the normalised keys of a bulk delete request, each key once
+func readDeleteRequest(r *http.Request) ([]string, error) {
+	var req deleteRequest
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxDeleteKeys*(maxKeyLength+8))).Decode(&req); err != nil {
+		return nil, errBadDeleteRequest
+	}
+	if len(req.Keys) == 0 || len(req.Keys) > maxDeleteKeys {
+		return nil, errBadDeleteRequest
+	}
+	keys := make([]string, 0, len(req.Keys))
+	seen := make(map[string]bool, len(req.Keys))
+	for _, key := range req.Keys {
+		dir, name, err := parseKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", errBadKey, key)
+		}
+		if key = database.JoinKey(dir, name); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// deleteKeys starts removing the objects the request names, the operation is reported at /operations/{id}
+func deleteKeys(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		keys, err := readDeleteRequest(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		startOperation(rw, r, s, l, username, &database.OperationRequest{Keys: keys})
+	}
+}
+
+// deletePrefix starts removing all the objects in the dir the path names and in its nested dirs.
+// The root can't be removed this way
+func deletePrefix(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		dir, err := parseDir(r.PathValue(fieldNamePrefix))
+		if err == nil && dir == "" {
+			err = errBadKey
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		startOperation(rw, r, s, l, username, &database.OperationRequest{Prefix: dir})
+	}
+}
+
+func startOperation(rw http.ResponseWriter, r *http.Request, s *storage.Server, l *log.Entry, username string, req *database.OperationRequest) {
+	l = tracing.Logger(r.Context(), l).WithField(fieldNameUsername, username)
+	op, err := s.StartDelete(r.Context(), username, req)
+	if err != nil {
+		l.WithError(err).Error("can't start delete")
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	l.WithFields(log.Fields{"operation": op.ID, "keys": len(req.Keys), "prefix": req.Prefix}).Info("delete started")
+	rw.Header().Set("Location", "/operations/"+op.ID.String())
+	writeJSON(rw, http.StatusAccepted, op)
+}
+
+// getOperation returns the status and the report of an operation of the user
+func getOperation(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.NotFound(rw, r)
+			return
+		}
+		op, err := s.GetOperation(r.Context(), username, id)
+		if err != nil {
+			if errors.Is(err, storage.ErrOperationNotFound) {
+				http.NotFound(rw, r)
+				return
+			}
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't get operation")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, op)
+	}
+}
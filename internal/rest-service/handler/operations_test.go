@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDeleteRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr error
+	}{
+		{name: "keys", body: `{"keys":["a.txt","dir/b.txt"]}`, want: []string{"a.txt", "dir/b.txt"}},
+		{name: "keys are normalised once", body: `{"keys":["/dir//b.txt","dir/b.txt"]}`, want: []string{"dir/b.txt"}},
+		{name: "no keys", body: `{"keys":[]}`, wantErr: errBadDeleteRequest},
+		{name: "not json", body: `keys`, wantErr: errBadDeleteRequest},
+		{name: "too many keys", body: `{"keys":["a"` + strings.Repeat(`,"a"`, maxDeleteKeys) + `]}`, wantErr: errBadDeleteRequest},
+		{name: "bad key", body: `{"keys":["a","dir/../b"]}`, wantErr: errBadKey},
+		{name: "dir key", body: `{"keys":["dir/"]}`, wantErr: errBadKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readDeleteRequest(httptest.NewRequest("POST", "/delete", strings.NewReader(tt.body)))
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+var errBadServerState = errors.New(`the state must be {"state": "..."}, one of active, read-only, draining or dead`)
+
+type serverState struct {
+	State string `json:"state"`
+}
+
+func readServerState(r *http.Request) (string, error) {
+	st := &serverState{}
+	if err := json.NewDecoder(r.Body).Decode(st); err != nil {
+		return "", errBadServerState
+	}
+	switch st.State {
+	case database.ServerActive, database.ServerReadOnly, database.ServerDraining, database.ServerDead:
+		return st.State, nil
+	}
+	return "", errBadServerState
+}
+
+// setServerState sets the state of a storage server: a read-only server takes no new chunks,
+// a draining one gives its chunks to the others and is removed once empty, the chunks of a dead one are repaired
+func setServerState(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(rw, "unknown storage server", http.StatusNotFound)
+			return
+		}
+		state, err := readServerState(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.SetServerState(r.Context(), id, state); err != nil {
+			if errors.Is(err, database.ErrRecordNotFound) {
+				http.Error(rw, "unknown storage server", http.StatusNotFound)
+				return
+			}
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't set server state")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &serverState{State: state})
+	}
+}
+
+func getRepairStatus(s *storage.Server) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, s.RepairStatus())
+	}
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+func TestReadServerState(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr error
+	}{
+		{name: "dead", body: `{"state":"dead"}`, want: database.ServerDead},
+		{name: "active", body: `{"state":"active"}`, want: database.ServerActive},
+		{name: "read-only", body: `{"state":"read-only"}`, want: database.ServerReadOnly},
+		{name: "draining", body: `{"state":"draining"}`, want: database.ServerDraining},
+		{name: "unknown state", body: `{"state":"gone"}`, wantErr: errBadServerState},
+		{name: "no state", body: `{}`, wantErr: errBadServerState},
+		{name: "not json", body: `dead`, wantErr: errBadServerState},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readServerState(httptest.NewRequest("PUT", "/admin/servers/id", strings.NewReader(tt.body)))
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -2,8 +2,11 @@ package handler
 
 import (
 	"errors"
+	"io"
 	"mime/multipart"
 	"net/http"
+	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -12,11 +15,23 @@ const (
 	fieldNameDir      = "dir"
 	fieldNameUsername = "username"
 	fieldNameFileName = "name"
+
+	headerCompression = "X-Compression"
+	headerObjectSize  = "X-Object-Size"
+	headerMetaPrefix  = "X-Meta-"
+
+	// maxMetadataSize limits the user metadata of a file, keys and values together
+	maxMetadataSize = 2 << 10
+	// sniffLen is how much of the file http.DetectContentType looks at
+	sniffLen           = 512
+	defaultContentType = "application/octet-stream"
 )
 
 var (
 	errCantParseForm = errors.New("can't parse request form")
 	errNoFile        = errors.New("file has not been provided")
+	errFileTooLarge  = errors.New("file is too large")
+	errBadMetadata   = errors.New("metadata is too large")
 )
 
 type requestData struct {
@@ -24,6 +39,12 @@ type requestData struct {
 	dir      string
 	filename string
 	file     *fileData
+	// compression is the algorithm requested by the client, empty if not set
+	compression string
+	// metadata is taken from the X-Meta-* headers, the keys are lower case
+	metadata map[string]string
+	// contentType is the type of the uploaded file, sniffed if the client didn't set it
+	contentType string
 }
 
 type fileData struct {
@@ -33,21 +54,35 @@ type fileData struct {
 
 func newRequestData(r *http.Request, logger *log.Entry) (*requestData, error) {
 	username, _, _ := r.BasicAuth()
+	dir, filename, err := objectPath(r)
+	if err != nil {
+		logger.WithError(err).WithField(fieldNameKey, r.PathValue(fieldNameKey)).Warning(errBadKey)
+		return nil, err
+	}
 	rd := &requestData{
-		username: username,
-		dir:      r.PathValue(fieldNameDir),
-		filename: r.PathValue(fieldNameFileName),
+		username:    username,
+		dir:         dir,
+		filename:    filename,
+		compression: r.Header.Get(headerCompression),
 	}
 	l := logger.WithFields(log.Fields{
 		fieldNameUsername: username,
 		fieldNameDir:      rd.dir,
 		fieldNameFileName: rd.filename,
 	})
-	if r.Method == "GET" {
+	if rd.metadata, err = parseMetadata(r.Header); err != nil {
+		l.WithError(err).Warning(errBadMetadata)
+		return nil, err
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
 		return rd, nil
 	}
 
 	if err := r.ParseMultipartForm(1024 << 20); err != nil { // 1024Mb
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			l.WithError(err).Warning(errFileTooLarge)
+			return nil, errFileTooLarge
+		}
 		l.WithError(err).Error(errCantParseForm)
 		return nil, errCantParseForm
 	}
@@ -61,5 +96,55 @@ func newRequestData(r *http.Request, logger *log.Entry) (*requestData, error) {
 		_ = f.Close()
 	}(f)
 	rd.file = &fileData{f: f, header: fh}
+	if rd.contentType, err = fileContentType(rd.file); err != nil {
+		l.WithError(err).Error(errCantParseForm)
+		return nil, errCantParseForm
+	}
 	return rd, nil
 }
+
+// parseMetadata collects the X-Meta-* headers
+func parseMetadata(h http.Header) (map[string]string, error) {
+	var meta map[string]string
+	size := 0
+	for name, values := range h {
+		if !strings.HasPrefix(name, headerMetaPrefix) || len(name) == len(headerMetaPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, headerMetaPrefix))
+		value := strings.Join(values, ",")
+		if size += len(key) + len(value); size > maxMetadataSize {
+			return nil, errBadMetadata
+		}
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta[key] = value
+	}
+	return meta, nil
+}
+
+// fileContentType is the type the client set for the file part, or the sniffed one
+func fileContentType(file *fileData) (string, error) {
+	if ct := file.header.Header.Get("Content-Type"); ct != "" && ct != defaultContentType {
+		return ct, nil
+	}
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(file.f, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if _, err := file.f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// declaredSize is the file size the client announced before sending it.
+// Without X-Object-Size the whole request body is taken, which is a bit more than the file
+func declaredSize(r *http.Request) int64 {
+	if size, err := strconv.ParseInt(r.Header.Get(headerObjectSize), 10, 64); err == nil {
+		return size
+	}
+	return r.ContentLength
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"bytes"
 	"errors"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -73,23 +74,16 @@ func createGetRequest(url, authorized string, pathVals map[string]string) *http.
 func TestNewRequestData(t *testing.T) {
 	tests := []testCase{
 		{
-			description:   "Successful POST request with file chunk, no path vals",
-			request:       createMultipartRequest(true, "file content", "username", map[string]string{}),
-			expectedError: nil,
-			verifyResponse: func(t *testing.T, rd *requestData, err error) {
-				if err != nil {
-					t.Errorf("Expected no error, got %v", err)
-				}
-				assert.Equal(t, rd.username, "username")
-				assert.Equal(t, rd.filename, "")
-			},
+			description:    "POST request without a key",
+			request:        createMultipartRequest(true, "file content", "username", map[string]string{}),
+			expectedError:  errBadKey,
+			verifyResponse: func(t *testing.T, rd *requestData, err error) {},
 		},
 		{
 			description: "Successful POST request with file, with path vals",
 			request: createMultipartRequest(true, "file content", "username1", map[string]string{
 				fieldNameUsername: "username1",
-				fieldNameDir:      "dir1",
-				fieldNameFileName: "file1",
+				fieldNameKey:      "dir1/file1",
 			}),
 			expectedError: nil,
 			verifyResponse: func(t *testing.T, rd *requestData, err error) {
@@ -107,8 +101,7 @@ func TestNewRequestData(t *testing.T) {
 			description: "Get with path vals and auth",
 			request: createGetRequest("http://example.com/upload", "username2", map[string]string{
 				fieldNameUsername: "username2",
-				fieldNameDir:      "dir2",
-				fieldNameFileName: "file2",
+				fieldNameKey:      "dir2/file2",
 			}),
 			expectedError: nil,
 			verifyResponse: func(t *testing.T, rd *requestData, err error) {
@@ -122,8 +115,8 @@ func TestNewRequestData(t *testing.T) {
 			},
 		},
 		{
-			description:   "Get without path vals and auth",
-			request:       createGetRequest("http://example.com/upload", "", map[string]string{}),
+			description:   "Get with a nested key without auth",
+			request:       createGetRequest("http://example.com/upload", "", map[string]string{fieldNameKey: "a/b/c.txt"}),
 			expectedError: nil,
 			verifyResponse: func(t *testing.T, rd *requestData, err error) {
 				if err != nil {
@@ -131,20 +124,56 @@ func TestNewRequestData(t *testing.T) {
 					t.Errorf("Unexpected error %v", err)
 				}
 				assert.Equal(t, "", rd.username)
-				assert.Equal(t, "", rd.dir)
-				assert.Equal(t, "", rd.filename)
+				assert.Equal(t, "a/b", rd.dir)
+				assert.Equal(t, "c.txt", rd.filename)
+			},
+		},
+		{
+			description:    "Get with a bad key",
+			request:        createGetRequest("http://example.com/upload", "", map[string]string{fieldNameKey: "a/../c.txt"}),
+			expectedError:  errBadKey,
+			verifyResponse: func(t *testing.T, rd *requestData, err error) {},
+		},
+		{
+			description: "POST with metadata, content type is sniffed",
+			request: func() *http.Request {
+				r := createMultipartRequest(true, "file content", "username", map[string]string{fieldNameKey: "dir/file"})
+				r.Header.Set("X-Meta-Owner", "team a")
+				r.Header.Add("X-Meta-Tags", "one")
+				r.Header.Add("X-Meta-Tags", "two")
+				return r
+			}(),
+			verifyResponse: func(t *testing.T, rd *requestData, err error) {
+				assert.Equal(t, map[string]string{"owner": "team a", "tags": "one,two"}, rd.metadata)
+				assert.Equal(t, "text/plain; charset=utf-8", rd.contentType)
+				got, _ := io.ReadAll(rd.file.f)
+				assert.Equal(t, "file content", string(got))
 			},
 		},
 		{
-			description:   "Failure to parse multipart form",
-			request:       httptest.NewRequest("POST", "http://example.com/upload", strings.NewReader("bad content")),
+			description: "metadata is too large",
+			request: func() *http.Request {
+				r := createGetRequest("http://example.com/upload", "username", map[string]string{fieldNameKey: "dir/file"})
+				r.Header.Set("X-Meta-Big", strings.Repeat("a", maxMetadataSize))
+				return r
+			}(),
+			expectedError:  errBadMetadata,
+			verifyResponse: func(t *testing.T, rd *requestData, err error) {},
+		},
+		{
+			description: "Failure to parse multipart form",
+			request: func() *http.Request {
+				r := httptest.NewRequest("POST", "http://example.com/upload", strings.NewReader("bad content"))
+				r.SetPathValue(fieldNameKey, "dir/file")
+				return r
+			}(),
 			expectedError: errCantParseForm,
 			verifyResponse: func(t *testing.T, rd *requestData, err error) {
 			},
 		},
 		{
 			description:   "Failure when no file provided",
-			request:       createMultipartRequest(false, "", "username", map[string]string{}),
+			request:       createMultipartRequest(false, "", "username", map[string]string{fieldNameKey: "dir/file"}),
 			expectedError: errNoFile,
 			verifyResponse: func(t *testing.T, rd *requestData, err error) {
 				if !errors.Is(err, errNoFile) {
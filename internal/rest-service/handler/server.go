@@ -4,40 +4,121 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"time"
 
+	"github.com/konorlevich/test_task_s3/internal/metrics"
 	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
 	"github.com/konorlevich/test_task_s3/internal/rest-service/handler/middleware"
+	restMetrics "github.com/konorlevich/test_task_s3/internal/rest-service/metrics"
 	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/compression"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/encryption"
 	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	ErrFileNotFound = errors.New("not found")
+	ErrFileNotFound = storage.ErrFileNotFound
 )
 
+// retryAfter is the seconds an upload rejected for too few storage servers is retried after, they register right as they start
+const retryAfter = "30"
+
+// countedErrors are the error types reported in metrics, anything else is counted as "other"
+var countedErrors = []error{
+	storage.ErrFileNotFound,
+	storage.ErrCantGetFile,
+	storage.ErrNoChunks,
+	storage.ErrCantGetServers,
+	storage.ErrSpreadNotMet,
+	storage.ErrNotEnoughServers,
+	storage.ErrCantSaveFile,
+	storage.ErrSavingFailed,
+	storage.ErrCantReadFile,
+	storage.ErrCantDecodeChunk,
+	storage.ErrCantRemoveFile,
+	storage.ErrPreconditionFailed,
+	storage.ErrCantGetFileKey,
+	storage.ErrCantStartOperation,
+	files.ErrCantGetChunks,
+	database.ErrBytesQuotaExceeded,
+	database.ErrObjectsQuotaExceeded,
+	database.ErrObjectLocked,
+}
+
 type ServerRegistry interface {
-	AddServer(name, port string) (uuid.UUID, error)
+	AddServer(name, port string, topology database.Topology) (uuid.UUID, error)
 }
 
 type StorageRepository interface {
 	ServerRegistry
-	GetLeastLoadedServers(num int) ([]*database.Server, error)
-	CreateFile(user, dir, name string) (uuid.UUID, error)
-	GetFile(username, dir, name string) (*database.File, error)
-	RemoveFile(id uuid.UUID) error
-	SaveChunk(file uuid.UUID, server uuid.UUID, number uint) (uuid.UUID, error)
+	QuotaRegistry
+	HealthRepository
+	FileLister
+	LifecycleRegistry
+	WebhookRegistry
+	DamageRegistry
+	storage.MetaStorage
 }
 
-func NewHandler(storageRepository StorageRepository, chunkNum int, l *log.Entry) *http.ServeMux {
+// NewHandler builds the rest-service routes, s stores the files in storageRepository and the servers fs probes.
+// keys may be nil to store files unencrypted, an empty adminToken disables the admin endpoints,
+// an empty nodeToken the reports of the storage servers.
+// The webhooks can be sent only to the targets
+func NewHandler(
+	storageRepository StorageRepository,
+	s *storage.Server,
+	fs ServerProber,
+	chunking storage.ChunkPolicy,
+	compressionPolicy *compression.Policy,
+	keys *encryption.Keyring,
+	adminToken string,
+	nodeToken string,
+	limits *Limits,
+	targets WebhookTargets,
+	l *log.Entry,
+) *http.ServeMux {
 	handler := http.NewServeMux()
 
-	handler.Handle("GET /object/{dir}/{name}", middleware.CheckAuth(http.HandlerFunc(getFileHandler(storageRepository, l))))
-	handler.Handle("POST /object/{dir}/{name}", middleware.CheckAuth(http.HandlerFunc(saveFile(storageRepository, chunkNum, l))))
+	handler.Handle("GET /object/{key...}", middleware.CheckAuth(http.HandlerFunc(getFileHandler(s, l))))
+	handler.Handle("HEAD /object/{key...}", middleware.CheckAuth(http.HandlerFunc(statFileHandler(s, l))))
+	handler.Handle("PATCH /object/{key...}", middleware.CheckAuth(http.HandlerFunc(updateFileMeta(s, l))))
+	handler.Handle("POST /object/{key...}", middleware.CheckAuth(withCopy(s, l, saveFile(s, chunking, compressionPolicy, limits, l))))
+	handler.Handle("PUT /object/{key...}", middleware.CheckAuth(withCopy(s, l, saveFile(s, chunking, compressionPolicy, limits, l))))
+	handler.Handle("DELETE /object/{key...}", middleware.CheckAuth(http.HandlerFunc(deleteFile(s, l))))
+	handler.Handle("GET /objects/{prefix...}", middleware.CheckAuth(http.HandlerFunc(listFiles(storageRepository, l))))
+	handler.Handle("DELETE /objects/{prefix...}", middleware.CheckAuth(http.HandlerFunc(deletePrefix(s, l))))
+	handler.Handle("POST /delete", middleware.CheckAuth(http.HandlerFunc(deleteKeys(s, l))))
+	handler.Handle("GET /operations/{id}", middleware.CheckAuth(http.HandlerFunc(getOperation(s, l))))
+	handler.Handle("GET /lifecycle", middleware.CheckAuth(http.HandlerFunc(getLifecycleRules(storageRepository))))
+	handler.Handle("POST /lifecycle", middleware.CheckAuth(http.HandlerFunc(addLifecycleRule(storageRepository, l))))
+	handler.Handle("DELETE /lifecycle/{id}", middleware.CheckAuth(http.HandlerFunc(removeLifecycleRule(storageRepository, l))))
+	handler.Handle("GET /lifecycle/dry-run", middleware.CheckAuth(http.HandlerFunc(lifecycleDryRun(s, l))))
+	handler.Handle("GET /webhooks", middleware.CheckAuth(http.HandlerFunc(getWebhooks(storageRepository))))
+	handler.Handle("POST /webhooks", middleware.CheckAuth(http.HandlerFunc(addWebhook(storageRepository, targets, l))))
+	handler.Handle("DELETE /webhooks/{id}", middleware.CheckAuth(http.HandlerFunc(removeWebhook(storageRepository, l))))
+	handler.Handle("GET /webhooks/{id}/dead", middleware.CheckAuth(http.HandlerFunc(getDeadDeliveries(storageRepository))))
+	handler.Handle("POST /webhooks/{id}/dead/retry", middleware.CheckAuth(http.HandlerFunc(retryDeadDeliveries(storageRepository, l))))
 
 	handler.HandleFunc("POST /storage/register", RegisterStorage(storageRepository))
+	handler.Handle("POST /storage/damaged", middleware.CheckNode(nodeToken, http.HandlerFunc(ReportDamage(storageRepository, l))))
+	handler.Handle("GET /metrics", metrics.Handler())
+	handler.HandleFunc("GET /healthz", healthz)
+	handler.HandleFunc("GET /readyz", readyz(storageRepository, fs, chunking.Servers, l))
+
+	handler.Handle("GET /admin/status", middleware.CheckAdmin(adminToken, http.HandlerFunc(status(storageRepository, fs, chunking.Servers, keys != nil, l))))
+	handler.Handle("POST /admin/keys/rotate", middleware.CheckAdmin(adminToken, http.HandlerFunc(rotateKeys(s, l))))
+	handler.Handle("GET /admin/quotas/{username}", middleware.CheckAdmin(adminToken, http.HandlerFunc(getQuotas(storageRepository))))
+	handler.Handle("PUT /admin/quotas/{username}", middleware.CheckAdmin(adminToken, http.HandlerFunc(setQuota(storageRepository, l))))
+	handler.Handle("DELETE /admin/quotas/{username}", middleware.CheckAdmin(adminToken, http.HandlerFunc(removeQuota(storageRepository, l))))
+	handler.Handle("GET /admin/lock/{username}/{key...}", middleware.CheckAdmin(adminToken, http.HandlerFunc(getLock(s, l))))
+	handler.Handle("PUT /admin/lock/{username}/{key...}", middleware.CheckAdmin(adminToken, http.HandlerFunc(setLock(s, l))))
+	handler.Handle("GET /admin/damaged", middleware.CheckAdmin(adminToken, http.HandlerFunc(getDamagedChunks(storageRepository))))
+	handler.Handle("PUT /admin/servers/{id}", middleware.CheckAdmin(adminToken, http.HandlerFunc(setServerState(s, l))))
+	handler.Handle("GET /admin/repair", middleware.CheckAdmin(adminToken, http.HandlerFunc(getRepairStatus(s))))
 	return handler
 }
 
@@ -51,7 +132,12 @@ func RegisterStorage(repository ServerRegistry) func(rw http.ResponseWriter, r *
 		}
 		hostname := r.PostForm.Get("hostname")
 		port := r.PostForm.Get("port")
-		if _, err := repository.AddServer(hostname, port); err != nil {
+		topology := database.Topology{
+			Zone: r.PostForm.Get(database.DomainZone),
+			Rack: r.PostForm.Get(database.DomainRack),
+			Host: r.PostForm.Get(database.DomainHost),
+		}
+		if _, err := repository.AddServer(hostname, port, topology); err != nil {
 			http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
 			return
 		}
@@ -61,21 +147,28 @@ func RegisterStorage(repository ServerRegistry) func(rw http.ResponseWriter, r *
 	}
 }
 
-func getFileHandler(repo StorageRepository, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
-	s := storage.NewServer(repo, files.NewFiles(l), l)
+func getFileHandler(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		rd, err := newRequestData(r, log.NewEntry(log.New()))
+		rd, err := newRequestData(r, tracing.Logger(r.Context(), l))
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusBadRequest)
 			return
 		}
-		l := l.WithFields(log.Fields{
+		l := tracing.Logger(r.Context(), l).WithFields(log.Fields{
 			fieldNameUsername: rd.username,
 			fieldNameDir:      rd.dir,
 			fieldNameFileName: rd.filename,
 		})
-		f, err := s.GetFile(rd.username, rd.dir, rd.filename)
+		file, err := s.StatFile(r.Context(), rd.username, rd.dir, rd.filename)
+		if err == nil && writeReadStatus(rw, r, file) {
+			return
+		}
+		var f io.Reader
+		if err == nil {
+			f, err = s.OpenFile(r.Context(), file)
+		}
 		if err != nil {
+			restMetrics.CountError(err, countedErrors)
 			if errors.Is(err, ErrFileNotFound) {
 				http.NotFound(rw, r)
 				return
@@ -84,6 +177,7 @@ func getFileHandler(repo StorageRepository, l *log.Entry) func(rw http.ResponseW
 			http.Error(rw, "can't get file", http.StatusInternalServerError)
 			return
 		}
+		writeFileHeaders(rw, file)
 		if _, err := io.Copy(rw, f); err != nil {
 			l.WithError(err).Error("can't return the file")
 			http.Error(rw, "can't return the file", http.StatusInternalServerError)
@@ -92,30 +186,212 @@ func getFileHandler(repo StorageRepository, l *log.Entry) func(rw http.ResponseW
 	}
 }
 
-func saveFile(repository StorageRepository, chunkNum int, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
-	s := storage.NewServer(repository, files.NewFiles(l), l)
+func saveFile(s *storage.Server, chunking storage.ChunkPolicy, compressionPolicy *compression.Policy, limits *Limits, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		rd, err := newRequestData(r, log.NewEntry(log.New()))
+		if max := limits.MaxUploadSize(); max > 0 {
+			if declaredSize(r) > max {
+				http.Error(rw, errFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(rw, r.Body, max)
+		}
+
+		// the upload is rejected before it's received if the preconditions or the declared size don't fit,
+		// both are checked again when the file is saved
+		username, _, _ := r.BasicAuth()
+		dir, name, err := objectPath(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		old, err := s.StatFile(r.Context(), username, dir, name)
+		if err != nil && !errors.Is(err, ErrFileNotFound) {
+			restMetrics.CountError(err, countedErrors)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		conditions := parsePreconditions(r.Header)
+		if err := conditions.checkWrite(old); err != nil {
+			restMetrics.CountError(err, countedErrors)
+			http.Error(rw, err.Error(), saveErrorStatus(err))
+			return
+		}
+		if old.Locked(time.Now()) {
+			restMetrics.CountError(database.ErrObjectLocked, countedErrors)
+			http.Error(rw, database.ErrObjectLocked.Error(), http.StatusLocked)
+			return
+		}
+		if size := declaredSize(r); size > 0 {
+			if err := s.CheckQuota(r.Context(), username, dir, size, old); err != nil {
+				restMetrics.CountError(err, countedErrors)
+				http.Error(rw, err.Error(), saveErrorStatus(err))
+				return
+			}
+		}
+
+		rd, err := newRequestData(r, tracing.Logger(r.Context(), l))
+		if errors.Is(err, errFileTooLarge) {
+			http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		l := l.WithFields(log.Fields{
+		l := tracing.Logger(r.Context(), l).WithFields(log.Fields{
 			fieldNameUsername: rd.username,
 			fieldNameDir:      rd.dir,
 			fieldNameFileName: rd.filename,
-			"chunk_num":       chunkNum,
+			"chunk_num":       chunking.Servers,
 			"file_size":       rd.file.header.Size,
 		})
 
-		err = s.SaveFile(rd.username, rd.dir, rd.filename, chunkNum, rd.file.header.Size, rd.file.f)
+		alg, err := compressionPolicy.Choose(database.TopDir(rd.dir), rd.compression)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l = l.WithField("compression", alg)
+
+		file := &database.File{
+			User:        rd.username,
+			Dir:         rd.dir,
+			Name:        rd.filename,
+			Size:        rd.file.header.Size,
+			ContentType: rd.contentType,
+			Metadata:    rd.metadata,
+		}
+		err = s.SaveFile(r.Context(), file, chunking, alg, rd.file.f, conditions.checkWrite)
+		if err != nil {
+			restMetrics.CountError(err, countedErrors)
+			writeSaveError(rw, err)
 			return
 		}
 
 		l.Info("file saved")
+		rw.Header().Set("ETag", `"`+file.ETag+`"`)
+		if file.Degraded {
+			rw.Header().Set(headerDegraded, "true")
+		}
 		_, _ = rw.Write([]byte("file saved"))
 	}
 }
+
+// writeSaveError responds to a failed upload, one rejected for too few storage servers is to be retried later
+func writeSaveError(rw http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrNotEnoughServers) {
+		rw.Header().Set("Retry-After", retryAfter)
+	}
+	http.Error(rw, err.Error(), saveErrorStatus(err))
+}
+
+func saveErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrBytesQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, database.ErrObjectsQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, database.ErrObjectLocked):
+		return http.StatusLocked
+	case errors.Is(err, storage.ErrSpreadNotMet), errors.Is(err, storage.ErrNotEnoughServers):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func statFileHandler(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		dir, name, err := objectPath(r)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file, err := s.StatFile(r.Context(), username, dir, name)
+		if err != nil {
+			restMetrics.CountError(err, countedErrors)
+			if errors.Is(err, ErrFileNotFound) {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't get file")
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if writeReadStatus(rw, r, file) {
+			return
+		}
+		writeFileHeaders(rw, file)
+	}
+}
+
+// writeReadStatus answers a conditional GET or HEAD without the file if the preconditions say so
+func writeReadStatus(rw http.ResponseWriter, r *http.Request, file *database.File) bool {
+	status := parsePreconditions(r.Header).readStatus(file)
+	if status == 0 {
+		return false
+	}
+	if status == http.StatusNotModified {
+		writeFileHeaders(rw, file)
+		rw.Header().Del("Content-Length")
+	}
+	rw.WriteHeader(status)
+	return true
+}
+
+// deleteFile removes the file, If-Match makes it remove only the expected version
+func deleteFile(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rd, err := newRequestData(r, tracing.Logger(r.Context(), l))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = s.DeleteFile(r.Context(), rd.username, rd.dir, rd.filename, parsePreconditions(r.Header).checkWrite)
+		if err != nil {
+			restMetrics.CountError(err, countedErrors)
+			if errors.Is(err, ErrFileNotFound) {
+				http.NotFound(rw, r)
+				return
+			}
+			http.Error(rw, err.Error(), saveErrorStatus(err))
+			return
+		}
+		tracing.Logger(r.Context(), l).WithFields(log.Fields{
+			fieldNameUsername: rd.username,
+			fieldNameDir:      rd.dir,
+			fieldNameFileName: rd.filename,
+		}).Info("file removed")
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// updateFileMeta changes the file metadata without uploading it again.
+// Content-Type replaces the type, X-Meta-* headers are merged into the user metadata, an empty one removes the key.
+// A locked file gets 423
+func updateFileMeta(s *storage.Server, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rd, err := newRequestData(r, tracing.Logger(r.Context(), l))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, err := s.UpdateMetadata(r.Context(), rd.username, rd.dir, rd.filename, r.Header.Get("Content-Type"), rd.metadata)
+		if err != nil {
+			restMetrics.CountError(err, countedErrors)
+			if errors.Is(err, ErrFileNotFound) {
+				http.NotFound(rw, r)
+				return
+			}
+			http.Error(rw, err.Error(), saveErrorStatus(err))
+			return
+		}
+		writeFileHeaders(rw, file)
+		rw.Header().Del("Content-Length")
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage"
+)
+
+// fakeMeta keeps the saved files, there are no storage servers. The other methods aren't used
+type fakeMeta struct {
+	storage.MetaStorage
+	saved []*database.File
+}
+
+func (m *fakeMeta) GetFile(string, string, string) (*database.File, error) {
+	return nil, database.ErrRecordNotFound
+}
+
+func (m *fakeMeta) GetActiveServers(...uuid.UUID) ([]*database.ServerUsage, error) {
+	return nil, nil
+}
+
+func (m *fakeMeta) CheckQuota(string, string, int64, int64) error {
+	return nil
+}
+
+func (m *fakeMeta) PutFile(f *database.File, _ func(old *database.File) error) (*database.File, error) {
+	m.saved = append(m.saved, f)
+	return nil, nil
+}
+
+func TestSaveFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		wantStatus int
+		wantSaved  bool
+	}{
+		{name: "empty file", wantStatus: http.StatusOK, wantSaved: true},
+		{name: "file", content: "data", wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := &fakeMeta{}
+			s := storage.NewServer(ms, nil, nil, nil, storage.LeastLoaded{}, storage.Spread{}, getLogger())
+			// inline storage is disabled
+			chunking := storage.ChunkPolicy{Servers: 2}
+			r := createMultipartRequest(true, tt.content, "user", map[string]string{fieldNameKey: "dir/name"})
+			rw := httptest.NewRecorder()
+			saveFile(s, chunking, nil, NewLimits(0), getLogger())(rw, r)
+			assert.Equal(t, tt.wantStatus, rw.Code, rw.Body.String())
+			if !tt.wantSaved {
+				assert.Empty(t, ms.saved)
+				return
+			}
+			if assert.Len(t, ms.saved, 1) {
+				assert.False(t, ms.saved[0].Inline)
+				assert.Empty(t, ms.saved[0].Chunks)
+				assert.Zero(t, ms.saved[0].ChunkCount)
+			}
+		})
+	}
+}
+
+func TestWriteSaveError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{name: "not enough servers", err: storage.ErrNotEnoughServers, wantStatus: http.StatusServiceUnavailable, wantRetryAfter: retryAfter},
+		{name: "spread not met", err: storage.ErrSpreadNotMet, wantStatus: http.StatusServiceUnavailable},
+		{name: "quota", err: database.ErrBytesQuotaExceeded, wantStatus: http.StatusInsufficientStorage},
+		{name: "saving failed", err: storage.ErrSavingFailed, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			writeSaveError(rw, tt.err)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantRetryAfter, rw.Header().Get("Retry-After"))
+			assert.Contains(t, rw.Body.String(), tt.err.Error())
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
+)
+
+const (
+	// maxWebhooks limits the webhooks of a user, every event is queued for each of them
+	maxWebhooks  = 20
+	maxURLLength = 2048
+	// secretLength is the length of a generated secret in bytes
+	secretLength = 32
+)
+
+var errBadWebhook = errors.New(`the webhook must be {"url": "https://...", "prefix": "dir", "events": ["ObjectCreated", ...], "secret": "..."}`)
+
+type WebhookRegistry interface {
+	AddWebhook(w *database.Webhook) error
+	GetWebhooks(user string) ([]*database.Webhook, error)
+	RemoveWebhook(user string, id uuid.UUID) error
+	GetDeadDeliveries(user string, webhookID uuid.UUID, limit int) ([]*database.Delivery, error)
+	RetryDeadDeliveries(user string, webhookID uuid.UUID) (int, error)
+}
+
+// WebhookTargets rejects the urls the webhooks can't be sent to, see webhooks.Targets
+type WebhookTargets interface {
+	CheckURL(u *url.URL) error
+}
+
+type webhooksResponse struct {
+	Webhooks []*database.Webhook `json:"webhooks"`
+}
+
+// newWebhookResponse is the only place the secret is shown, the requests to the webhook are signed with it
+type newWebhookResponse struct {
+	*database.Webhook
+	Secret string `json:"secret"`
+}
+
+type deadDeliveriesResponse struct {
+	Deliveries []*database.Delivery `json:"deliveries"`
+}
+
+type retryResponse struct {
+	Retried int `json:"retried"`
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Prefix string   `json:"prefix"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// readWebhook reads a webhook, an empty prefix makes it cover all the objects of the user.
+// A secret is generated if it isn't set
+func readWebhook(r *http.Request, targets WebhookTargets) (*database.Webhook, error) {
+	req := &webhookRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 2*maxURLLength+2*maxKeyLength)).Decode(req); err != nil {
+		return nil, errBadWebhook
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || len(req.URL) > maxURLLength || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errBadWebhook
+	}
+	if err := targets.CheckURL(u); err != nil {
+		return nil, err
+	}
+	if len(req.Events) == 0 || len(req.Secret) > maxKeyLength {
+		return nil, errBadWebhook
+	}
+	var events []string
+	for _, e := range req.Events {
+		if !slices.Contains(database.EventTypes, e) {
+			return nil, errBadWebhook
+		}
+		if !slices.Contains(events, e) {
+			events = append(events, e)
+		}
+	}
+	prefix, err := parseDir(req.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	secret := req.Secret
+	if secret == "" {
+		b := make([]byte, secretLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(b)
+	}
+	return &database.Webhook{URL: req.URL, Prefix: prefix, Events: events, Secret: secret}, nil
+}
+
+func getWebhooks(repo WebhookRegistry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		hooks, err := repo.GetWebhooks(username)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &webhooksResponse{Webhooks: hooks})
+	}
+}
+
+// addWebhook subscribes the url to the events of the objects in the prefix dir and its nested dirs
+func addWebhook(repo WebhookRegistry, targets WebhookTargets, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		hook, err := readWebhook(r, targets)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hook.User = username
+		l := tracing.Logger(r.Context(), l).WithFields(log.Fields{fieldNameUsername: username, "prefix": hook.Prefix})
+		hooks, err := repo.GetWebhooks(username)
+		if err == nil && len(hooks) >= maxWebhooks {
+			http.Error(rw, "too many webhooks", http.StatusConflict)
+			return
+		}
+		if err == nil {
+			err = repo.AddWebhook(hook)
+		}
+		if err != nil {
+			l.WithError(err).Error("can't add webhook")
+			http.Error(rw, "can't add webhook", http.StatusInternalServerError)
+			return
+		}
+		l.WithFields(log.Fields{"webhook": hook.ID, "events": hook.Events}).Info("webhook added")
+		writeJSON(rw, http.StatusCreated, &newWebhookResponse{Webhook: hook, Secret: hook.Secret})
+	}
+}
+
+func removeWebhook(repo WebhookRegistry, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.NotFound(rw, r)
+			return
+		}
+		if err := repo.RemoveWebhook(username, id); err != nil {
+			if errors.Is(err, database.ErrRecordNotFound) {
+				http.NotFound(rw, r)
+				return
+			}
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't remove webhook")
+			http.Error(rw, "can't remove webhook", http.StatusInternalServerError)
+			return
+		}
+		tracing.Logger(r.Context(), l).WithFields(log.Fields{fieldNameUsername: username, "webhook": id}).Info("webhook removed")
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// userWebhook returns the id of the webhook in the path if the user has it
+func userWebhook(repo WebhookRegistry, r *http.Request) (uuid.UUID, error) {
+	username, _, _ := r.BasicAuth()
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		return uuid.Nil, database.ErrRecordNotFound
+	}
+	hooks, err := repo.GetWebhooks(username)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if !slices.ContainsFunc(hooks, func(w *database.Webhook) bool { return w.ID == id }) {
+		return uuid.Nil, database.ErrRecordNotFound
+	}
+	return id, nil
+}
+
+// getDeadDeliveries lists the events the webhook didn't accept after all the retries
+func getDeadDeliveries(repo WebhookRegistry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		id, err := userWebhook(repo, r)
+		if errors.Is(err, database.ErrRecordNotFound) {
+			http.NotFound(rw, r)
+			return
+		}
+		var deliveries []*database.Delivery
+		if err == nil {
+			deliveries, err = repo.GetDeadDeliveries(username, id, maxListLimit)
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &deadDeliveriesResponse{Deliveries: deliveries})
+	}
+}
+
+// retryDeadDeliveries queues the dead events of the webhook again, they are sent in the background
+func retryDeadDeliveries(repo WebhookRegistry, l *log.Entry) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		id, err := userWebhook(repo, r)
+		if errors.Is(err, database.ErrRecordNotFound) {
+			http.NotFound(rw, r)
+			return
+		}
+		retried := 0
+		if err == nil {
+			retried, err = repo.RetryDeadDeliveries(username, id)
+		}
+		if err != nil {
+			tracing.Logger(r.Context(), l).WithError(err).Error("can't retry deliveries")
+			http.Error(rw, "can't retry deliveries", http.StatusInternalServerError)
+			return
+		}
+		tracing.Logger(r.Context(), l).WithFields(log.Fields{fieldNameUsername: username, "webhook": id, "retried": retried}).
+			Info("dead deliveries retried")
+		writeJSON(rw, http.StatusAccepted, &retryResponse{Retried: retried})
+	}
+}
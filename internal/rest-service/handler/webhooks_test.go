@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/webhooks"
+)
+
+func TestReadWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    *database.Webhook
+		wantErr error
+	}{
+		{
+			name: "webhook",
+			body: `{"url":"https://ci.example.com/hook","prefix":"builds/","events":["ObjectCreated","ObjectCreated"],"secret":"s"}`,
+			want: &database.Webhook{URL: "https://ci.example.com/hook", Prefix: "builds", Events: []string{database.EventObjectCreated}, Secret: "s"},
+		},
+		{
+			name: "all objects",
+			body: `{"url":"http://hooks.local:9000","events":["ObjectRemoved","ObjectExpired"],"secret":"s"}`,
+			want: &database.Webhook{URL: "http://hooks.local:9000", Events: []string{database.EventObjectRemoved, database.EventObjectExpired}, Secret: "s"},
+		},
+		{name: "allowed internal host", body: `{"url":"http://localhost:9000","events":["ObjectCreated"],"secret":"s"}`,
+			want: &database.Webhook{URL: "http://localhost:9000", Events: []string{database.EventObjectCreated}, Secret: "s"}},
+		{name: "internal address", body: `{"url":"http://169.254.169.254/latest","events":["ObjectCreated"]}`, wantErr: webhooks.ErrForbiddenTarget},
+		{name: "no events", body: `{"url":"https://ci.example.com"}`, wantErr: errBadWebhook},
+		{name: "unknown event", body: `{"url":"https://ci.example.com","events":["ObjectRead"]}`, wantErr: errBadWebhook},
+		{name: "not http", body: `{"url":"ftp://ci.example.com","events":["ObjectCreated"]}`, wantErr: errBadWebhook},
+		{name: "relative url", body: `{"url":"/hook","events":["ObjectCreated"]}`, wantErr: errBadWebhook},
+		{name: "not json", body: `hook`, wantErr: errBadWebhook},
+		{name: "bad prefix", body: `{"url":"https://ci.example.com","prefix":"../builds","events":["ObjectCreated"]}`, wantErr: errBadKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readWebhook(httptest.NewRequest("POST", "/webhooks", strings.NewReader(tt.body)), webhooks.NewTargets("localhost"))
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("secret is generated", func(t *testing.T) {
+		got, err := readWebhook(httptest.NewRequest("POST", "/webhooks", strings.NewReader(`{"url":"https://ci.example.com","events":["ObjectCreated"]}`)), webhooks.NewTargets())
+		assert.NoError(t, err)
+		assert.Len(t, got.Secret, 2*secretLength)
+	})
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+var (
+	ChunkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "storage_chunk_duration_seconds",
+		Help:    "Latency of chunk operations on storage servers by server and operation.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 9),
+	}, []string{"server", "operation"})
+
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "errors_total",
+		Help: "Errors returned to clients by type.",
+	}, []string{"type"})
+)
+
+const (
+	OperationFetch  = "fetch"
+	OperationStore  = "store"
+	OperationDelete = "delete"
+)
+
+// CountError counts err under the first of known errors it matches, or as "other"
+func CountError(err error, known []error) {
+	if err == nil {
+		return
+	}
+	for _, k := range known {
+		if errors.Is(err, k) {
+			errorsTotal.WithLabelValues(k.Error()).Inc()
+			return
+		}
+	}
+	errorsTotal.WithLabelValues("other").Inc()
+}
+
+type ServerUsageSource interface {
+	GetServerUsage() ([]*database.ServerUsage, error)
+}
+
+// ServerUsageCollector reports how many chunks and bytes every storage server keeps,
+// the numbers are read from the metadata on every scrape
+type ServerUsageCollector struct {
+	source ServerUsageSource
+	chunks *prometheus.Desc
+	bytes  *prometheus.Desc
+	l      *log.Entry
+}
+
+func NewServerUsageCollector(source ServerUsageSource, l *log.Entry) *ServerUsageCollector {
+	return &ServerUsageCollector{
+		source: source,
+		chunks: prometheus.NewDesc("storage_server_chunks", "Chunks stored on a storage server.", []string{"server", "server_id"}, nil),
+		bytes:  prometheus.NewDesc("storage_server_bytes", "Bytes stored on a storage server.", []string{"server", "server_id"}, nil),
+		l:      l,
+	}
+}
+
+func (c *ServerUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.chunks
+	ch <- c.bytes
+}
+
+func (c *ServerUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	usage, err := c.source.GetServerUsage()
+	if err != nil {
+		c.l.WithError(err).Error("can't get server usage")
+		return
+	}
+	for _, u := range usage {
+		ch <- prometheus.MustNewConstMetric(c.chunks, prometheus.GaugeValue, float64(u.Chunks), u.GetUrl(), u.ID.String())
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(u.Bytes), u.GetUrl(), u.ID.String())
+	}
+}
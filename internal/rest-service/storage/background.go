@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+)
+
+const (
+	DefaultGCInterval = time.Minute
+	// garbageBatch is how many files are deleted from the storage servers at a time
+	garbageBatch = 1000
+)
+
+var ErrCantCollectGarbage = errors.New("can't delete garbage from storage")
+
+// RunBackground runs the queued operations, expires the files with the lifecycle rules, sends the events to the webhooks
+// and deletes the garbage from the storage servers until ctx is done.
+// It works every interval and right after an operation is started, the events are delivered right after they are queued
+func (s *Server) RunBackground(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		s.runOperations(ctx)
+		s.expireFiles(ctx)
+		s.deliverEvents(ctx)
+		s.collectGarbage(ctx)
+		if !s.idle(ctx, t.C) {
+			return
+		}
+	}
+}
+
+// idle delivers the events queued meanwhile until the rest of the background work is due, it returns false once ctx is done
+func (s *Server) idle(ctx context.Context, tick <-chan time.Time) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-tick:
+			return true
+		case <-s.wake:
+			return true
+		case <-s.events:
+			s.deliverEvents(ctx)
+		}
+	}
+}
+
+// wakeUp makes RunBackground work without waiting for the interval
+func (s *Server) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// collectGarbage deletes the content of removed files from the storage servers, with a request per server.
+// What can't be deleted is tried again the next time
+func (s *Server) collectGarbage(ctx context.Context) {
+	l := s.logger(ctx)
+	total := 0
+	defer func() {
+		if total > 0 {
+			l.WithField("files", total).Info("garbage deleted from storage")
+		}
+	}()
+	for ctx.Err() == nil {
+		garbage, err := s.ms.GetGarbage(garbageBatch)
+		if err != nil {
+			l.WithError(err).Error(ErrCantCollectGarbage)
+			return
+		}
+		byServer := map[uuid.UUID][]*database.Garbage{}
+		for _, g := range garbage {
+			byServer[g.ServerID] = append(byServer[g.ServerID], g)
+		}
+		var deleted, failed []uuid.UUID
+		for serverID, batch := range byServer {
+			blobs := make([]files.Blob, len(batch))
+			for i, g := range batch {
+				blobs[i] = files.Blob{Username: g.User, FileId: g.BlobID}
+				if g.Number != nil {
+					blobs[i].ChunkId = strconv.FormatUint(uint64(*g.Number), 10)
+				}
+			}
+			var locked []files.Blob
+			if batch[0].Server == nil {
+				err = errors.New("unknown server")
+			} else {
+				locked, err = s.fs.DeleteFiles(ctx, batch[0].Server, blobs)
+			}
+			if err != nil {
+				l.WithError(err).WithField("server_id", serverID).Warning(ErrCantCollectGarbage)
+			}
+			// the content locked on the server is kept until the lock is over
+			keep := make(map[files.Blob]bool, len(locked))
+			for _, blob := range locked {
+				l.WithFields(log.Fields{"server_id": serverID, "blob_id": blob.FileId}).Warning("garbage is locked")
+				keep[blob] = true
+			}
+			for i, g := range batch {
+				if err != nil || keep[blobs[i]] {
+					failed = append(failed, g.ID)
+				} else {
+					deleted = append(deleted, g.ID)
+				}
+			}
+		}
+		if err := s.ms.RemoveGarbage(deleted); err != nil {
+			l.WithError(err).Error(ErrCantCollectGarbage)
+			return
+		}
+		if err := s.ms.RetryGarbage(failed); err != nil {
+			l.WithError(err).Error(ErrCantCollectGarbage)
+			return
+		}
+		total += len(deleted)
+		if len(garbage) < garbageBatch || len(deleted) == 0 {
+			return
+		}
+	}
+}
+
+// addGarbage leaves the chunks of a file that wasn't saved to be deleted from the servers
+func (s *Server) addGarbage(ctx context.Context, file *database.File, servers []files.ServerMeta) {
+	ids := make([]uuid.UUID, len(servers))
+	for i, server := range servers {
+		ids[i] = server.GetID()
+	}
+	if err := s.ms.AddGarbage(file.User, file.BlobID, ids); err != nil {
+		s.logger(ctx).WithError(err).WithField("blob_id", file.BlobID).Error(ErrCantCollectGarbage)
+	}
+}
@@ -0,0 +1,121 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Algorithm string
+
+const (
+	None  Algorithm = ""
+	Gzip  Algorithm = "gzip"
+	Flate Algorithm = "flate"
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown compression algorithm")
+	ErrCantCompress     = errors.New("can't compress chunk")
+)
+
+// Parse accepts an algorithm name, "none" and an empty string mean no compression
+func Parse(name string) (Algorithm, error) {
+	switch a := Algorithm(strings.ToLower(strings.TrimSpace(name))); a {
+	case None, "none":
+		return None, nil
+	case Gzip, Flate:
+		return a, nil
+	default:
+		return None, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, name)
+	}
+}
+
+// Compress returns the compressed data and the algorithm that was actually applied.
+// Data that doesn't get smaller is returned as is with None
+func Compress(alg Algorithm, data []byte) ([]byte, Algorithm, error) {
+	if alg == None || len(data) == 0 {
+		return data, None, nil
+	}
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch alg {
+	case Gzip:
+		w = gzip.NewWriter(buf)
+	case Flate:
+		w, _ = flate.NewWriter(buf, flate.DefaultCompression)
+	default:
+		return nil, None, ErrUnknownAlgorithm
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, None, fmt.Errorf("%w: %w", ErrCantCompress, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, None, fmt.Errorf("%w: %w", ErrCantCompress, err)
+	}
+	if buf.Len() >= len(data) {
+		return data, None, nil
+	}
+	return buf.Bytes(), alg, nil
+}
+
+// NewReader returns a reader that removes the compression applied by Compress
+func NewReader(alg Algorithm, r io.Reader) (io.Reader, error) {
+	switch alg {
+	case None:
+		return r, nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Flate:
+		return flate.NewReader(r), nil
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+}
+
+// Policy chooses an algorithm for an upload: a header value wins over a dir setting, which wins over the default
+type Policy struct {
+	Default Algorithm
+	Dirs    map[string]Algorithm
+}
+
+// ParsePolicy reads the default algorithm and a list of dir settings like "logs=gzip,json=flate"
+func ParsePolicy(def, dirs string) (*Policy, error) {
+	d, err := Parse(def)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{Default: d, Dirs: map[string]Algorithm{}}
+	for _, pair := range strings.Split(dirs, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		dir, name, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("can't parse dir compression setting %q", pair)
+		}
+		a, err := Parse(name)
+		if err != nil {
+			return nil, err
+		}
+		p.Dirs[strings.TrimSpace(dir)] = a
+	}
+	return p, nil
+}
+
+func (p *Policy) Choose(dir, requested string) (Algorithm, error) {
+	if requested != "" {
+		return Parse(requested)
+	}
+	if p == nil {
+		return None, nil
+	}
+	if a, ok := p.Dirs[dir]; ok {
+		return a, nil
+	}
+	return p.Default, nil
+}
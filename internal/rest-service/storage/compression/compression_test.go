@@ -0,0 +1,76 @@
+package compression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompress(t *testing.T) {
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+	compressible := []byte(strings.Repeat(`{"level":"info","msg":"chunk saved"}`, 100))
+
+	tests := []struct {
+		name    string
+		alg     Algorithm
+		data    []byte
+		wantAlg Algorithm
+	}{
+		{name: "none", alg: None, data: compressible, wantAlg: None},
+		{name: "empty", alg: Gzip, data: []byte{}, wantAlg: None},
+		{name: "gzip", alg: Gzip, data: compressible, wantAlg: Gzip},
+		{name: "flate", alg: Flate, data: compressible, wantAlg: Flate},
+		{name: "incompressible", alg: Gzip, data: random, wantAlg: None},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, alg, err := Compress(tt.alg, tt.data)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantAlg, alg)
+			if alg != None {
+				assert.Less(t, len(stored), len(tt.data))
+			}
+
+			r, err := NewReader(alg, bytes.NewReader(stored))
+			assert.NoError(t, err)
+			got, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.data, got)
+		})
+	}
+}
+
+func TestPolicy_Choose(t *testing.T) {
+	p, err := ParsePolicy("flate", "logs=gzip, raw=none")
+	if err != nil {
+		t.Fatalf("can't parse policy: %s", err)
+	}
+	tests := []struct {
+		name      string
+		dir       string
+		requested string
+		want      Algorithm
+		wantErr   error
+	}{
+		{name: "default", dir: "other", want: Flate},
+		{name: "dir", dir: "logs", want: Gzip},
+		{name: "dir disabled", dir: "raw", want: None},
+		{name: "header wins", dir: "logs", requested: "none", want: None},
+		{name: "unknown header", dir: "logs", requested: "zstd", wantErr: ErrUnknownAlgorithm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Choose(tt.dir, tt.requested)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = ParsePolicy("", "logs")
+	assert.Error(t, err)
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+	"github.com/konorlevich/test_task_s3/internal/throttle"
+)
+
+const (
+	// DegradedReject fails an upload with ErrNotEnoughServers when fewer servers are active than it needs
+	DegradedReject = "reject"
+	// DegradedAccept stores the file on the servers there are, several chunks share a server.
+	// The file is marked as degraded and spread out once more servers are active, see database.File.Degraded
+	DegradedAccept = "accept"
+)
+
+var ErrCantSpread = errors.New("can't spread degraded files")
+
+// ParseDegraded checks the policy for uploads with too few servers, it's DegradedReject by default
+func ParseDegraded(policy string) (string, error) {
+	switch policy {
+	case "":
+		return DegradedReject, nil
+	case DegradedReject, DegradedAccept:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown degraded policy %q, must be %s or %s", policy, DegradedReject, DegradedAccept)
+}
+
+// spreadFiles moves the chunks of the degraded files to the servers that became active since.
+// A file is done once it's stored on as many servers as the chunking policy wants, till then it stays degraded
+func (s *Server) spreadFiles(ctx context.Context, chunking ChunkPolicy, rate int64) {
+	l := s.logger(ctx)
+	start := time.Now()
+	var sent int64
+	afterBlob := uuid.Nil
+	for ctx.Err() == nil {
+		degraded, err := s.ms.GetDegradedFiles(afterBlob, repairBatch)
+		if err != nil {
+			l.WithError(err).Error(ErrCantSpread)
+			return
+		}
+		for _, f := range degraded {
+			if ctx.Err() != nil {
+				return
+			}
+			n, done, err := s.spreadFile(ctx, f, chunking)
+			sent += n
+			s.updateRepair(func(st *RepairStatus) {
+				st.Degraded++
+				st.Bytes += n
+				if done {
+					st.Spread++
+				}
+			})
+			if err != nil {
+				l.WithError(err).WithField("blob_id", f.BlobID).Error(ErrCantSpread)
+			}
+			throttle.Wait(ctx, start, sent, rate)
+		}
+		if len(degraded) < repairBatch {
+			break
+		}
+		afterBlob = degraded[len(degraded)-1].BlobID
+	}
+	if st := s.RepairStatus(); st.Degraded > 0 {
+		l.WithFields(log.Fields{"degraded": st.Degraded, "spread": st.Spread}).Info("degraded files checked")
+	}
+}
+
+// spreadFile moves the chunks of the file from the servers keeping more than their share to new ones.
+// A server keeps at least its share, so only the moved chunks are garbage there.
+// It returns the bytes sent and if the file is spread over enough servers
+func (s *Server) spreadFile(ctx context.Context, f *database.File, chunking ChunkPolicy) (int64, bool, error) {
+	want := chunking.servers(f.ChunkCount)
+	held := map[uuid.UUID][]*database.Chunk{}
+	var holders []uuid.UUID
+	var kept []*database.Server
+	var stored int64
+	for _, c := range f.Chunks {
+		// a copy on a dead server is left to the repair
+		if c.Server.State == database.ServerDead {
+			continue
+		}
+		if _, ok := held[c.ServerID]; !ok {
+			holders = append(holders, c.ServerID)
+			kept = append(kept, c.Server)
+		}
+		held[c.ServerID] = append(held[c.ServerID], c)
+		stored += c.StoredSize
+	}
+	if len(holders) >= want || len(f.Chunks) == 0 {
+		return 0, true, s.ms.ClearDegraded(f.BlobID)
+	}
+	share := ceilDiv(int64(len(f.Chunks)), int64(want))
+	load := reservation{chunks: share, bytes: ceilDiv(stored*share, int64(len(f.Chunks)))}
+	// a chunk moved to a server the blob is still to be deleted from could be deleted with the garbage
+	garbage, err := s.ms.GetBlobGarbage(f.BlobID)
+	if err != nil {
+		return 0, false, err
+	}
+	targets, release, err := s.getServers(ctx, f.BlobID, want-len(holders), 1, load, kept, slices.Concat(holders, garbage)...)
+	if errors.Is(err, ErrNotEnoughServers) {
+		// no server joined yet
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer release()
+
+	var sent int64
+	for _, target := range targets {
+		taken := map[uint]bool{}
+		for moved := int64(0); moved < share; moved++ {
+			from, i := fullest(held, holders, taken)
+			if from == uuid.Nil || int64(len(held[from])) <= share {
+				break
+			}
+			c := held[from][i]
+			held[from] = append(held[from][:i:i], held[from][i+1:]...)
+			n, err := s.spreadChunk(ctx, f, c, target)
+			sent += n
+			if err != nil {
+				return sent, false, err
+			}
+			taken[c.Number] = true
+		}
+	}
+	if len(holders)+len(targets) < want {
+		return sent, false, nil
+	}
+	return sent, true, s.ms.ClearDegraded(f.BlobID)
+}
+
+// fullest returns the holder keeping the most chunks with the index of its last chunk that isn't taken,
+// uuid.Nil if every chunk is taken
+func fullest(held map[uuid.UUID][]*database.Chunk, holders []uuid.UUID, taken map[uint]bool) (uuid.UUID, int) {
+	from, index := uuid.Nil, -1
+	for _, id := range holders {
+		if from != uuid.Nil && len(held[id]) <= len(held[from]) {
+			continue
+		}
+		for i := len(held[id]) - 1; i >= 0; i-- {
+			if !taken[held[id][i].Number] {
+				from, index = id, i
+				break
+			}
+		}
+	}
+	return from, index
+}
+
+// spreadChunk moves the copy c of a chunk of the file to the target, it returns the bytes sent
+func (s *Server) spreadChunk(ctx context.Context, f *database.File, c *database.Chunk, target files.ServerMeta) (int64, error) {
+	stored := &database.StoredChunk{User: f.User, BlobID: f.BlobID, Number: c.Number}
+	data, err := s.readCopy(ctx, stored, []*database.Chunk{c})
+	if err != nil {
+		return 0, err
+	}
+	return s.relocate(ctx, stored, data, c.ServerID, target)
+}
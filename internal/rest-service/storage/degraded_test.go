@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+func TestParseDegraded(t *testing.T) {
+	policy, err := ParseDegraded("")
+	assert.NoError(t, err)
+	assert.Equal(t, DegradedReject, policy)
+	policy, err = ParseDegraded(DegradedAccept)
+	assert.NoError(t, err)
+	assert.Equal(t, DegradedAccept, policy)
+	_, err = ParseDegraded("maybe")
+	assert.Error(t, err)
+}
+
+func TestFullest(t *testing.T) {
+	a, b := uuid.UUID{1}, uuid.UUID{2}
+	chunks := func(numbers ...uint) []*database.Chunk {
+		var res []*database.Chunk
+		for _, n := range numbers {
+			res = append(res, &database.Chunk{Number: n})
+		}
+		return res
+	}
+	held := map[uuid.UUID][]*database.Chunk{a: chunks(0, 2), b: chunks(1, 3, 5)}
+	holders := []uuid.UUID{a, b}
+	tests := []struct {
+		name      string
+		taken     map[uint]bool
+		wantFrom  uuid.UUID
+		wantIndex int
+	}{
+		{name: "the last chunk of the fullest", wantFrom: b, wantIndex: 2},
+		{name: "a chunk the target has is skipped", taken: map[uint]bool{5: true}, wantFrom: b, wantIndex: 1},
+		{name: "the next fullest", taken: map[uint]bool{1: true, 3: true, 5: true}, wantFrom: a, wantIndex: 1},
+		{name: "all taken", taken: map[uint]bool{0: true, 1: true, 2: true, 3: true, 5: true}, wantFrom: uuid.Nil, wantIndex: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, index := fullest(held, holders, tt.taken)
+			assert.Equal(t, tt.wantFrom, from)
+			assert.Equal(t, tt.wantIndex, index)
+		})
+	}
+}
+
+func TestServer_SpreadFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// joined servers are active besides the two the file is stored on
+		joined int
+
+		wantSent   int64
+		wantDone   bool
+		wantCopies [][]int
+	}{
+		{name: "no server joined", wantCopies: [][]int{{0}, {1}, {0}, {1}}},
+		{name: "a server joined", joined: 1, wantSent: 6, wantCopies: [][]int{{0}, {1}, {2}, {1}}},
+		{name: "spread", joined: 2, wantSent: 12, wantDone: true, wantCopies: [][]int{{0}, {1}, {2}, {3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms, fs := newFakeMeta(), newFakeFiles()
+			ms.servers = newServers(2 + tt.joined)
+			file := &database.File{User: "user", Name: "file", BlobID: uuid.New(), ChunkCount: 4, Degraded: true}
+			for number := uint(0); number < 4; number++ {
+				server := ms.servers[number%2]
+				ms.addChunk("user", file.BlobID, number, 6, []*database.Server{server})
+				file.Chunks = append(file.Chunks, &database.Chunk{ServerID: server.ID, Server: server, Number: number, StoredSize: 6})
+				fs.chunks[chunkPath(server.ID, file.BlobID, number)] = []byte(fmt.Sprintf("chunk%d", number))
+			}
+			saved := *file
+			ms.files = append(ms.files, &saved)
+
+			s := NewServer(ms, fs, nil, nil, LeastLoaded{}, Spread{}, getLogger())
+			sent, done, err := s.spreadFile(context.Background(), file, ChunkPolicy{Servers: 4})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSent, sent)
+			assert.Equal(t, tt.wantDone, done)
+			assert.Equal(t, !tt.wantDone, ms.files[0].Degraded)
+			for number, want := range tt.wantCopies {
+				assert.Equal(t, want, healthyCopies(ms, ms.servers, file.BlobID, uint(number)), "chunk %d", number)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+	"github.com/konorlevich/test_task_s3/internal/throttle"
+)
+
+var ErrCantDrain = errors.New("can't drain server")
+
+// DrainStatus is the progress of a draining server in the current pass of the repair or the last one
+type DrainStatus struct {
+	ServerID uuid.UUID `json:"server_id"`
+	Url      string    `json:"url"`
+	// Chunks is how many chunks the server kept when the pass started
+	Chunks  int64 `json:"chunks"`
+	Moved   int64 `json:"moved"`
+	Failed  int64 `json:"failed"`
+	Removed bool  `json:"removed"`
+}
+
+// drainServers moves the chunks of the draining servers to the active ones,
+// a server is removed once it keeps no chunk and the garbage is deleted from it
+func (s *Server) drainServers(ctx context.Context, rate int64) {
+	l := s.logger(ctx)
+	servers, err := s.ms.GetServersByState(database.ServerDraining)
+	if err != nil {
+		l.WithError(err).Error(ErrCantDrain)
+		return
+	}
+	usage := map[uuid.UUID]int64{}
+	if len(servers) > 0 {
+		all, err := s.ms.GetServerUsage()
+		if err != nil {
+			l.WithError(err).Error(ErrCantDrain)
+			return
+		}
+		for _, u := range all {
+			usage[u.ID] = u.Chunks
+		}
+	}
+	drains := make([]DrainStatus, len(servers))
+	for i, server := range servers {
+		drains[i] = DrainStatus{ServerID: server.ID, Url: server.GetUrl(), Chunks: usage[server.ID]}
+	}
+	s.updateRepair(func(st *RepairStatus) { st.Draining = drains })
+
+	for i, server := range servers {
+		if ctx.Err() != nil {
+			return
+		}
+		s.drainServer(ctx, i, server, rate)
+	}
+}
+
+// drainServer moves the chunks of the i-th draining server of the pass, see drainServers
+func (s *Server) drainServer(ctx context.Context, i int, server *database.Server, rate int64) {
+	l := s.logger(ctx).WithField("server", server.ID)
+	l.Warning("draining server")
+	start := time.Now()
+	var sent, moved int64
+	afterBlob, afterNumber := uuid.Nil, uint(0)
+	for ctx.Err() == nil {
+		chunks, err := s.ms.GetServerChunks(server.ID, afterBlob, afterNumber, repairBatch)
+		if err != nil {
+			l.WithError(err).Error(ErrCantDrain)
+			return
+		}
+		for _, c := range chunks {
+			if ctx.Err() != nil {
+				return
+			}
+			n, err := s.moveChunk(ctx, server, c)
+			sent += n
+			s.updateRepair(func(st *RepairStatus) {
+				st.Bytes += n
+				if err != nil {
+					st.Draining[i].Failed++
+				} else {
+					st.Draining[i].Moved++
+				}
+			})
+			if err != nil {
+				l.WithError(err).WithFields(log.Fields{"blob_id": c.BlobID, "chunk": c.Number}).Error(ErrCantDrain)
+			} else {
+				moved++
+			}
+			throttle.Wait(ctx, start, sent, rate)
+		}
+		if len(chunks) < repairBatch {
+			break
+		}
+		last := chunks[len(chunks)-1]
+		afterBlob, afterNumber = last.BlobID, last.Number
+	}
+	if ctx.Err() != nil || s.placing.busy(server.ID) {
+		return
+	}
+	if moved > 0 {
+		// the moved chunks are garbage on the server, it's removed on a later pass once they are deleted
+		s.wakeUp()
+		return
+	}
+	if err := s.ms.RemoveServer(server.ID); err != nil {
+		if !errors.Is(err, database.ErrServerNotEmpty) {
+			l.WithError(err).Error(ErrCantDrain)
+		}
+		return
+	}
+	s.updateRepair(func(st *RepairStatus) { st.Draining[i].Removed = true })
+	l.Warning("drained server removed")
+}
+
+// moveChunk copies the chunk from the draining server to an active one and forgets the copy on the draining server,
+// it returns the bytes sent
+func (s *Server) moveChunk(ctx context.Context, server *database.Server, c *database.StoredChunk) (int64, error) {
+	copies, err := s.ms.GetChunkCopies(c.BlobID, c.Number)
+	if err != nil {
+		return 0, err
+	}
+	var sources []*database.Chunk
+	holders := make([]uuid.UUID, len(copies))
+	for i, cc := range copies {
+		holders[i] = cc.Chunk.ServerID
+		if cc.Damaged || cc.Chunk.Server.State == database.ServerDead {
+			continue
+		}
+		// the draining server is read first, the others are left to serve the files
+		if cc.Chunk.ServerID == server.ID {
+			sources = append([]*database.Chunk{cc.Chunk}, sources...)
+		} else {
+			sources = append(sources, cc.Chunk)
+		}
+	}
+	data, err := s.readCopy(ctx, c, sources)
+	if err != nil {
+		return 0, err
+	}
+	garbage, err := s.ms.GetBlobGarbage(c.BlobID)
+	if err != nil {
+		return 0, err
+	}
+	holders = append(holders, garbage...)
+	var kept []*database.Server
+	for _, src := range sources {
+		if src.ServerID != server.ID {
+			kept = append(kept, src.Server)
+		}
+	}
+	targets, release, err := s.getServers(ctx, c.BlobID, 1, 1, reservation{chunks: 1, bytes: int64(len(data))}, kept, holders...)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrNoRepairServers, err)
+	}
+	defer release()
+	return s.relocate(ctx, c, data, server.ID, targets[0])
+}
+
+// relocate stores the chunk read as data on the target and forgets its copy on the server with the id from, it returns the bytes sent
+func (s *Server) relocate(ctx context.Context, c *database.StoredChunk, data []byte, from uuid.UUID, target files.ServerMeta) (int64, error) {
+	if err := s.sendCopy(ctx, c, target, data); err != nil {
+		return 0, err
+	}
+	sent := int64(len(data))
+	added := []uuid.UUID{target.GetID()}
+	if err := s.ms.ReplaceChunkCopies(c.BlobID, c.Number, added, []uuid.UUID{from}); err != nil {
+		if errors.Is(err, database.ErrRecordNotFound) {
+			// the files were removed meanwhile, the new copy is garbage
+			if err := s.ms.AddGarbage(c.User, c.BlobID, added); err != nil {
+				s.logger(ctx).WithError(err).Error(ErrCantCollectGarbage)
+			}
+			return sent, nil
+		}
+		return sent, err
+	}
+	return sent, nil
+}
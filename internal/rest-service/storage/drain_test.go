@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+)
+
+func TestServer_DrainServers(t *testing.T) {
+	ms, fs := newFakeMeta(), newFakeFiles()
+	ms.servers = newServers(4)
+	drained := ms.servers[0]
+	drained.State = database.ServerDraining
+	blobID := uuid.New()
+	ms.addChunk("user", blobID, 0, 5, ms.servers[:2])
+	ms.addChunk("user", blobID, 1, 5, ms.servers[:1])
+	for number, data := range []string{"first", "secnd"} {
+		fs.chunks[chunkPath(drained.ID, blobID, uint(number))] = []byte(data)
+	}
+	// the blob is still to be deleted from the third server
+	ms.garbage = append(ms.garbage, &database.Garbage{ServerID: ms.servers[2].ID, User: "user", BlobID: blobID})
+	s := NewServer(ms, fs, nil, nil, LeastLoaded{}, Spread{}, getLogger())
+	ctx := context.Background()
+
+	s.drainServers(ctx, 0)
+	assert.Equal(t, []string{chunkPath(ms.servers[3].ID, blobID, 0), chunkPath(ms.servers[1].ID, blobID, 1)}, fs.sent)
+	assert.Equal(t, []int{1, 3}, healthyCopies(ms, ms.servers, blobID, 0))
+	assert.Equal(t, []int{1}, healthyCopies(ms, ms.servers, blobID, 1))
+	assert.Equal(t, []DrainStatus{{ServerID: drained.ID, Url: drained.GetUrl(), Chunks: 2, Moved: 2}}, s.RepairStatus().Draining)
+	assert.Len(t, ms.servers, 4, "the moved chunks are garbage on the server")
+
+	ms.garbage = nil
+	s.placing.mu.Lock()
+	release := s.placing.hold([]files.ServerMeta{drained}, reservation{chunks: 1, bytes: 5})
+	s.placing.mu.Unlock()
+	s.drainServers(ctx, 0)
+	assert.Len(t, ms.servers, 4, "an upload still refers to the server")
+	assert.False(t, s.RepairStatus().Draining[0].Removed)
+
+	release()
+	s.drainServers(ctx, 0)
+	assert.Len(t, ms.servers, 3)
+	assert.NotContains(t, ms.servers, drained)
+	assert.Equal(t, []DrainStatus{{ServerID: drained.ID, Url: drained.GetUrl(), Removed: true}}, s.RepairStatus().Draining)
+}
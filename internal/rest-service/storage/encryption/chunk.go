@@ -0,0 +1,64 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+var ErrCantDecrypt = errors.New("can't decrypt data")
+
+// SealChunk encrypts a chunk with the file data key.
+// The chunk is bound to the file content it belongs to and its position, so chunks can't be swapped on a storage server unnoticed
+func SealChunk(dataKey []byte, blobID uuid.UUID, number uint, chunk []byte) ([]byte, error) {
+	return seal(dataKey, chunkAAD(blobID, number), chunk)
+}
+
+func OpenChunk(dataKey []byte, blobID uuid.UUID, number uint, stored []byte) ([]byte, error) {
+	return open(dataKey, chunkAAD(blobID, number), stored)
+}
+
+func chunkAAD(blobID uuid.UUID, number uint) []byte {
+	return binary.BigEndian.AppendUint64(blobID[:], uint64(number))
+}
+
+// seal returns nonce followed by the AES-GCM ciphertext
+func seal(key, aad, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, aad, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrCantDecrypt
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrCantDecrypt
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,138 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const keySize = 32 // AES-256
+
+var (
+	ErrCantReadKeyFile = errors.New("can't read key file")
+	ErrNoMasterKeys    = errors.New("key file has no master keys")
+	ErrUnknownKey      = errors.New("unknown master key")
+	ErrBadKey          = errors.New("master key must be 32 bytes hex encoded")
+	ErrDuplicatedKey   = errors.New("master key id is duplicated")
+)
+
+// Keyring keeps the master keys used to wrap per-file data keys.
+//
+// The key file has a key per line: "<key id> <hex encoded 32 bytes>", empty lines and lines starting with # are skipped.
+// The last key in the file is the current one, new data keys are wrapped with it.
+// Older keys are kept to unwrap data keys that haven't been rotated yet
+type Keyring struct {
+	path string
+
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the key file again, it is used to pick up a new master key
+func (k *Keyring) Reload() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCantReadKeyFile, err)
+	}
+	defer f.Close()
+
+	keys := map[string][]byte{}
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrBadKey, id)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != keySize {
+			return fmt.Errorf("%w: %q", ErrBadKey, id)
+		}
+		if _, ok := keys[id]; ok {
+			return fmt.Errorf("%w: %q", ErrDuplicatedKey, id)
+		}
+		keys[id] = key
+		current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrCantReadKeyFile, err)
+	}
+	if current == "" {
+		return ErrNoMasterKeys
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.current = keys, current
+	return nil
+}
+
+func (k *Keyring) CurrentID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// NewDataKey generates a random data key and returns it together with its wrapped form
+func (k *Keyring) NewDataKey() (key []byte, keyID string, wrapped []byte, err error) {
+	key = make([]byte, keySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, "", nil, err
+	}
+	keyID, wrapped, err = k.wrap(key)
+	return key, keyID, wrapped, err
+}
+
+func (k *Keyring) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	master, err := k.get(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(master, []byte(keyID), wrapped)
+}
+
+// Rewrap unwraps the data key with its old master key and wraps it with the current one
+func (k *Keyring) Rewrap(keyID string, wrapped []byte) (string, []byte, error) {
+	key, err := k.Unwrap(keyID, wrapped)
+	if err != nil {
+		return "", nil, err
+	}
+	return k.wrap(key)
+}
+
+func (k *Keyring) wrap(key []byte) (string, []byte, error) {
+	k.mu.RLock()
+	keyID, master := k.current, k.keys[k.current]
+	k.mu.RUnlock()
+
+	wrapped, err := seal(master, []byte(keyID), key)
+	return keyID, wrapped, err
+}
+
+func (k *Keyring) get(keyID string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	master, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	return master, nil
+}
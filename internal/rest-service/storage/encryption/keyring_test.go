@@ -0,0 +1,85 @@
+package encryption
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKey1 = "key1 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "key2 1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func writeKeyFile(t *testing.T, lines ...string) string {
+	p := path.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(p, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatalf("can't write key file: %s", err)
+	}
+	return p
+}
+
+func TestLoadKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		want    string
+		wantErr error
+	}{
+		{name: "single", lines: []string{testKey1}, want: "key1"},
+		{name: "last is current", lines: []string{"# old one", testKey1, "", testKey2}, want: "key2"},
+		{name: "empty", lines: []string{"# nothing"}, wantErr: ErrNoMasterKeys},
+		{name: "short key", lines: []string{"key1 0001"}, wantErr: ErrBadKey},
+		{name: "no key", lines: []string{"key1"}, wantErr: ErrBadKey},
+		{name: "duplicated", lines: []string{testKey1, testKey1}, wantErr: ErrDuplicatedKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := LoadKeyring(writeKeyFile(t, tt.lines...))
+			assert.ErrorIs(t, err, tt.wantErr)
+			if tt.wantErr == nil {
+				assert.Equal(t, tt.want, k.CurrentID())
+			}
+		})
+	}
+	_, err := LoadKeyring(path.Join(t.TempDir(), "missing"))
+	assert.ErrorIs(t, err, ErrCantReadKeyFile)
+}
+
+func TestKeyring_Rewrap(t *testing.T) {
+	p := writeKeyFile(t, testKey1)
+	k, err := LoadKeyring(p)
+	if err != nil {
+		t.Fatalf("can't load keyring: %s", err)
+	}
+	key, keyID, wrapped, err := k.NewDataKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "key1", keyID)
+
+	fileID := uuid.New()
+	sealed, err := SealChunk(key, fileID, 3, []byte("chunk data"))
+	assert.NoError(t, err)
+
+	if err := os.WriteFile(p, []byte(testKey1+"\n"+testKey2), 0600); err != nil {
+		t.Fatalf("can't write key file: %s", err)
+	}
+	assert.NoError(t, k.Reload())
+	newID, rewrapped, err := k.Rewrap(keyID, wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, "key2", newID)
+
+	unwrapped, err := k.Unwrap(newID, rewrapped)
+	assert.NoError(t, err)
+	got, err := OpenChunk(unwrapped, fileID, 3, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "chunk data", string(got))
+
+	_, err = OpenChunk(unwrapped, fileID, 4, sealed)
+	assert.ErrorIs(t, err, ErrCantDecrypt)
+	_, err = k.Unwrap("key3", rewrapped)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
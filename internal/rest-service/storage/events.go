@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+const (
+	// deliveryBatch is how many deliveries are taken from the outbox at a time, deliveryWorkers of them are sent at once
+	deliveryBatch   = 100
+	deliveryWorkers = 8
+	// a failed delivery is tried again after minRetryDelay, the delay doubles up to maxRetryDelay.
+	// After maxDeliveryAttempts it's dead
+	minRetryDelay       = 10 * time.Second
+	maxRetryDelay       = time.Hour
+	maxDeliveryAttempts = 10
+)
+
+var (
+	ErrCantDeliverEvents = errors.New("can't deliver events")
+	errWebhookNotFound   = errors.New("webhook not found")
+)
+
+// emit makes the background worker deliver the events a change queued without waiting for the interval.
+// The events are put into the outbox by MetaStorage in the transaction of the change
+func (s *Server) emit() {
+	select {
+	case s.events <- struct{}{}:
+	default:
+	}
+}
+
+// deliverEvents sends the deliveries that are due, a failed one is tried again later or becomes dead
+func (s *Server) deliverEvents(ctx context.Context) {
+	l := s.logger(ctx)
+	for ctx.Err() == nil {
+		due, err := s.ms.GetDueDeliveries(time.Now(), deliveryBatch)
+		if err != nil {
+			l.WithError(err).Error(ErrCantDeliverEvents)
+			return
+		}
+		var (
+			mu     sync.Mutex
+			sent   []uuid.UUID
+			failed []*database.Delivery
+		)
+		eg := &errgroup.Group{}
+		eg.SetLimit(deliveryWorkers)
+		for _, d := range due {
+			eg.Go(func() error {
+				err := s.deliver(ctx, d)
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil {
+					sent = append(sent, d.ID)
+					return nil
+				}
+				d.Attempts++
+				d.LastError = err.Error()
+				d.NextAttemptAt = time.Now().Add(retryDelay(d.Attempts))
+				d.Dead = d.Attempts >= maxDeliveryAttempts
+				failed = append(failed, d)
+				return nil
+			})
+		}
+		_ = eg.Wait()
+
+		if err := s.ms.RemoveDeliveries(sent); err != nil {
+			l.WithError(err).Error(ErrCantDeliverEvents)
+			return
+		}
+		for _, d := range failed {
+			dl := l.WithFields(log.Fields{"delivery": d.ID, "webhook": d.WebhookID, "attempts": d.Attempts, "error": d.LastError})
+			if d.Dead {
+				dl.Error("webhook delivery is dead")
+			} else {
+				dl.Warning("webhook delivery failed")
+			}
+			if err := s.ms.UpdateDelivery(d); err != nil {
+				l.WithError(err).Error(ErrCantDeliverEvents)
+				return
+			}
+		}
+		if len(due) < deliveryBatch || len(sent) == 0 {
+			return
+		}
+	}
+}
+
+func (s *Server) deliver(ctx context.Context, d *database.Delivery) error {
+	if d.Webhook == nil {
+		return errWebhookNotFound
+	}
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+	return s.hooks.Send(ctx, d.Webhook.URL, d.Webhook.Secret, d.Event.ID.String(), body)
+}
+
+// retryDelay is the delay after the attempts failed
+func retryDelay(attempts int) time.Duration {
+	if attempts > 12 {
+		return maxRetryDelay
+	}
+	return min(minRetryDelay<<(attempts-1), maxRetryDelay)
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: minRetryDelay},
+		{attempts: 2, want: 2 * minRetryDelay},
+		{attempts: 5, want: 16 * minRetryDelay},
+		{attempts: 9, want: 256 * minRetryDelay},
+		{attempts: 10, want: maxRetryDelay},
+		{attempts: 100, want: maxRetryDelay},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, retryDelay(tt.attempts), tt.attempts)
+	}
+}
+
+func TestServer_DeliverEvents(t *testing.T) {
+	up := &database.Webhook{ID: uuid.New(), URL: "http://up/"}
+	down := &database.Webhook{ID: uuid.New(), URL: "http://down/"}
+	newDelivery := func(w *database.Webhook, attempts int) *database.Delivery {
+		return &database.Delivery{ID: uuid.New(), WebhookID: w.ID, Webhook: w, Event: &database.Event{ID: uuid.New()}, Attempts: attempts}
+	}
+	sent, retried, dying := newDelivery(up, 0), newDelivery(down, 0), newDelivery(down, maxDeliveryAttempts-1)
+	later := newDelivery(up, 1)
+	later.NextAttemptAt = time.Now().Add(time.Hour)
+	orphan := newDelivery(up, 0)
+	orphan.Webhook = nil
+
+	ms := newFakeMeta()
+	ms.deliveries = []*database.Delivery{sent, retried, dying, later, orphan}
+	hooks := &fakeHooks{down: map[string]bool{down.URL: true}}
+	s := NewServer(ms, nil, hooks, nil, LeastLoaded{}, Spread{}, getLogger())
+	s.deliverEvents(context.Background())
+
+	assert.Equal(t, []string{"http://up/ " + sent.Event.ID.String()}, hooks.sent)
+	got := map[uuid.UUID]*database.Delivery{}
+	for _, d := range ms.deliveries {
+		got[d.ID] = d
+	}
+	assert.NotContains(t, got, sent.ID, "a sent delivery is removed")
+	assert.Contains(t, got, later.ID, "a delivery that isn't due waits")
+	if d := got[retried.ID]; assert.NotNil(t, d) {
+		assert.Equal(t, 1, d.Attempts)
+		assert.False(t, d.Dead)
+		assert.Equal(t, "connection refused", d.LastError)
+		assert.WithinDuration(t, time.Now().Add(minRetryDelay), d.NextAttemptAt, time.Second)
+	}
+	if d := got[dying.ID]; assert.NotNil(t, d) {
+		assert.Equal(t, maxDeliveryAttempts, d.Attempts)
+		assert.True(t, d.Dead, "a delivery that failed too many times is dead")
+	}
+	if d := got[orphan.ID]; assert.NotNil(t, d) {
+		assert.Equal(t, errWebhookNotFound.Error(), d.LastError)
+	}
+
+	// the dead delivery isn't tried again, the other failed ones wait for the retry delay
+	hooks.down = nil
+	s.deliverEvents(context.Background())
+	assert.Len(t, hooks.sent, 1)
+}
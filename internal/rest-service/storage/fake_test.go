@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+)
+
+// fakeMeta keeps the files in memory, the methods it doesn't implement panic
+type fakeMeta struct {
+	MetaStorage
+	mu         sync.Mutex
+	files      []*database.File
+	deliveries []*database.Delivery
+
+	servers []*database.Server
+	// copies are the copies of the chunks, a chunk is named by its blob and number
+	copies  map[chunkKey][]*database.ChunkCopy
+	locked  map[uuid.UUID]bool
+	garbage []*database.Garbage
+}
+
+type chunkKey struct {
+	blobID uuid.UUID
+	number uint
+}
+
+func newFakeMeta() *fakeMeta {
+	return &fakeMeta{copies: map[chunkKey][]*database.ChunkCopy{}, locked: map[uuid.UUID]bool{}}
+}
+
+// addChunk keeps a copy of the chunk on every server, the damaged ones as reported
+func (m *fakeMeta) addChunk(user string, blobID uuid.UUID, number uint, size int64, servers []*database.Server, damaged ...uuid.UUID) {
+	for _, server := range servers {
+		chunk := &database.Chunk{File: database.File{User: user, BlobID: blobID}, ServerID: server.ID, Server: server, Number: number, StoredSize: size}
+		m.copies[chunkKey{blobID, number}] = append(m.copies[chunkKey{blobID, number}], &database.ChunkCopy{Chunk: chunk, Damaged: slices.Contains(damaged, server.ID)})
+	}
+}
+
+func (m *fakeMeta) healthy(copies []*database.ChunkCopy) int {
+	n := 0
+	for _, cc := range copies {
+		if !cc.Damaged && cc.Chunk.Server.State != database.ServerDead {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *fakeMeta) find(username, dir, name string) int {
+	for i, f := range m.files {
+		if f.User == username && f.Dir == dir && f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *fakeMeta) GetFile(username, dir, name string) (*database.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.find(username, dir, name)
+	if i < 0 {
+		return nil, database.ErrRecordNotFound
+	}
+	got := *m.files[i]
+	return &got, nil
+}
+
+func (m *fakeMeta) PutFile(f *database.File, check func(old *database.File) error) (*database.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var old *database.File
+	i := m.find(f.User, f.Dir, f.Name)
+	if i >= 0 {
+		old = m.files[i]
+	}
+	if check != nil {
+		if err := check(old); err != nil {
+			return nil, err
+		}
+	}
+	saved := *f
+	if i >= 0 {
+		m.files[i] = &saved
+	} else {
+		m.files = append(m.files, &saved)
+	}
+	return old, nil
+}
+
+func (m *fakeMeta) ClearDegraded(blobID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.files {
+		if f.BlobID == blobID {
+			f.Degraded = false
+		}
+	}
+	return nil
+}
+
+func (m *fakeMeta) GetDueDeliveries(now time.Time, limit int) ([]*database.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []*database.Delivery
+	for _, d := range m.deliveries {
+		if !d.Dead && !d.NextAttemptAt.After(now) && len(due) < limit {
+			got := *d
+			due = append(due, &got)
+		}
+	}
+	return due, nil
+}
+
+func (m *fakeMeta) UpdateDelivery(d *database.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, saved := range m.deliveries {
+		if saved.ID == d.ID {
+			saved.Attempts, saved.NextAttemptAt, saved.LastError, saved.Dead = d.Attempts, d.NextAttemptAt, d.LastError, d.Dead
+		}
+	}
+	return nil
+}
+
+func (m *fakeMeta) RemoveDeliveries(ids []uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries = slices.DeleteFunc(m.deliveries, func(d *database.Delivery) bool { return slices.Contains(ids, d.ID) })
+	return nil
+}
+
+func (m *fakeMeta) GetActiveServers(exclude ...uuid.UUID) ([]*database.ServerUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var servers []*database.ServerUsage
+	for _, server := range m.servers {
+		if server.State == database.ServerActive && !slices.Contains(exclude, server.ID) {
+			servers = append(servers, m.usage(server))
+		}
+	}
+	return servers, nil
+}
+
+// usage counts the copies the server keeps
+func (m *fakeMeta) usage(server *database.Server) *database.ServerUsage {
+	usage := &database.ServerUsage{Server: *server}
+	for _, copies := range m.copies {
+		for _, cc := range copies {
+			if cc.Chunk.ServerID == server.ID {
+				usage.Chunks++
+				usage.Bytes += cc.Chunk.StoredSize
+			}
+		}
+	}
+	return usage
+}
+
+func (m *fakeMeta) GetBlobLock(blobID uuid.UUID) (*time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return nil, m.locked[blobID], nil
+}
+
+func (m *fakeMeta) AddGarbage(user string, blobID uuid.UUID, servers []uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, server := range servers {
+		m.garbage = append(m.garbage, &database.Garbage{ServerID: server, User: user, BlobID: blobID})
+	}
+	return nil
+}
+
+func (m *fakeMeta) GetBlobGarbage(blobID uuid.UUID) ([]uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var servers []uuid.UUID
+	for _, g := range m.garbage {
+		if g.BlobID == blobID && !slices.Contains(servers, g.ServerID) {
+			servers = append(servers, g.ServerID)
+		}
+	}
+	return servers, nil
+}
+
+func (m *fakeMeta) CountAtRiskChunks(replicas int) (map[int]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	atRisk := map[int]int64{}
+	for _, copies := range m.copies {
+		if n := m.healthy(copies); n < replicas {
+			atRisk[n]++
+		}
+	}
+	return atRisk, nil
+}
+
+func (m *fakeMeta) GetAtRiskChunks(healthy int, afterBlob uuid.UUID, afterNumber uint, limit int) ([]*database.AtRiskChunk, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var chunks []*database.AtRiskChunk
+	for key, copies := range m.copies {
+		c := bytes.Compare(key.blobID[:], afterBlob[:])
+		if (c > 0 || c == 0 && key.number > afterNumber) && m.healthy(copies) == healthy {
+			chunks = append(chunks, &database.AtRiskChunk{StoredChunk: database.StoredChunk{User: copies[0].Chunk.File.User, BlobID: key.blobID, Number: key.number}, Healthy: healthy})
+		}
+	}
+	slices.SortFunc(chunks, func(a, b *database.AtRiskChunk) int {
+		if c := bytes.Compare(a.BlobID[:], b.BlobID[:]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Number, b.Number)
+	})
+	return chunks[:min(limit, len(chunks))], nil
+}
+
+func (m *fakeMeta) GetChunkCopies(blobID uuid.UUID, number uint) ([]*database.ChunkCopy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copies := m.copies[chunkKey{blobID, number}]
+	if len(copies) == 0 {
+		return nil, database.ErrRecordNotFound
+	}
+	return slices.Clone(copies), nil
+}
+
+func (m *fakeMeta) ReplaceChunkCopies(blobID uuid.UUID, number uint, added, dropped []uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := chunkKey{blobID, number}
+	copies := m.copies[key]
+	if len(copies) == 0 {
+		return database.ErrRecordNotFound
+	}
+	for _, id := range added {
+		i := slices.IndexFunc(m.servers, func(s *database.Server) bool { return s.ID == id })
+		chunk := *copies[0].Chunk
+		chunk.ServerID, chunk.Server = id, m.servers[i]
+		copies = append(copies, &database.ChunkCopy{Chunk: &chunk})
+	}
+	m.copies[key] = slices.DeleteFunc(copies, func(cc *database.ChunkCopy) bool { return slices.Contains(dropped, cc.Chunk.ServerID) })
+	for _, id := range dropped {
+		m.garbage = append(m.garbage, &database.Garbage{ServerID: id, User: copies[0].Chunk.File.User, BlobID: blobID, Number: &number})
+	}
+	return nil
+}
+
+func (m *fakeMeta) GetServersByState(state string) ([]*database.Server, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var servers []*database.Server
+	for _, server := range m.servers {
+		if server.State == state {
+			servers = append(servers, server)
+		}
+	}
+	return servers, nil
+}
+
+func (m *fakeMeta) GetServerUsage() ([]*database.ServerUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := make([]*database.ServerUsage, len(m.servers))
+	for i, server := range m.servers {
+		usage[i] = m.usage(server)
+	}
+	return usage, nil
+}
+
+func (m *fakeMeta) GetServerChunks(serverID, afterBlob uuid.UUID, afterNumber uint, limit int) ([]*database.StoredChunk, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var chunks []*database.StoredChunk
+	for key, copies := range m.copies {
+		c := bytes.Compare(key.blobID[:], afterBlob[:])
+		on := slices.ContainsFunc(copies, func(cc *database.ChunkCopy) bool { return cc.Chunk.ServerID == serverID })
+		if (c > 0 || c == 0 && key.number > afterNumber) && on {
+			chunks = append(chunks, &database.StoredChunk{User: copies[0].Chunk.File.User, BlobID: key.blobID, Number: key.number})
+		}
+	}
+	slices.SortFunc(chunks, func(a, b *database.StoredChunk) int {
+		if c := bytes.Compare(a.BlobID[:], b.BlobID[:]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Number, b.Number)
+	})
+	return chunks[:min(limit, len(chunks))], nil
+}
+
+func (m *fakeMeta) RemoveServer(id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, copies := range m.copies {
+		if slices.ContainsFunc(copies, func(cc *database.ChunkCopy) bool { return cc.Chunk.ServerID == id }) {
+			return database.ErrServerNotEmpty
+		}
+	}
+	if slices.ContainsFunc(m.garbage, func(g *database.Garbage) bool { return g.ServerID == id }) {
+		return database.ErrServerNotEmpty
+	}
+	m.servers = slices.DeleteFunc(m.servers, func(s *database.Server) bool { return s.ID == id })
+	return nil
+}
+
+func (m *fakeMeta) RemoveDamagedChunk(serverID, blobID uuid.UUID, number uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cc := range m.copies[chunkKey{blobID, number}] {
+		if cc.Chunk.ServerID == serverID {
+			cc.Damaged = false
+		}
+	}
+	return nil
+}
+
+// fakeFiles keeps the chunks of the storage servers in memory, the servers in down fail every call
+type fakeFiles struct {
+	FileStorage
+	mu     sync.Mutex
+	down   map[uuid.UUID]bool
+	chunks map[string][]byte
+	locked map[string]bool
+	// sent are the chunks sent in order
+	sent []string
+}
+
+func newFakeFiles() *fakeFiles {
+	return &fakeFiles{down: map[uuid.UUID]bool{}, chunks: map[string][]byte{}, locked: map[string]bool{}}
+}
+
+func chunkPath(server uuid.UUID, fileId uuid.UUID, number uint) string {
+	return fmt.Sprintf("%s/%s/%d", server, fileId, number)
+}
+
+func (f *fakeFiles) SendFile(_ context.Context, servers []files.ServerMeta, _ string, fileId uuid.UUID, first uint, chunks [][]byte) ([]uuid.UUID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]uuid.UUID, len(servers))
+	for i, server := range servers {
+		if f.down[server.GetID()] {
+			return nil, errors.New("connection refused")
+		}
+		p := chunkPath(server.GetID(), fileId, first+uint(i))
+		f.chunks[p] = slices.Clone(chunks[i])
+		f.sent = append(f.sent, p)
+		ids[i] = server.GetID()
+	}
+	return ids, nil
+}
+
+func (f *fakeFiles) GetFile(_ context.Context, servers []files.ServerMeta, _ string, fileId uuid.UUID, first uint) ([]io.Reader, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	readers := make([]io.Reader, len(servers))
+	for i, server := range servers {
+		data, ok := f.chunks[chunkPath(server.GetID(), fileId, first+uint(i))]
+		if f.down[server.GetID()] || !ok {
+			return nil, errors.New("chunk not found")
+		}
+		readers[i] = bytes.NewReader(data)
+	}
+	return readers, nil
+}
+
+func (f *fakeFiles) LockFile(_ context.Context, server files.ServerMeta, blob files.Blob, _ *files.Lock) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.locked[server.GetID().String()+"/"+blob.FileId.String()] = true
+	return nil
+}
+
+// fakeHooks fails to send to the urls in down
+type fakeHooks struct {
+	mu   sync.Mutex
+	down map[string]bool
+	sent []string
+}
+
+func (h *fakeHooks) Send(_ context.Context, url, _, eventID string, _ []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.down[url] {
+		return errors.New("connection refused")
+	}
+	h.sent = append(h.sent, url+" "+eventID)
+	return nil
+}
@@ -2,7 +2,9 @@ package files
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -14,12 +16,19 @@ import (
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/metrics"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
 )
 
 var (
 	ErrCantGetChunks       = errors.New("can't get chunks from storage")
 	ErrCantCreateFileField = errors.New("can't create a file field")
-	ErrCantReadFileChunk   = errors.New("can't read file chunk")
+	ErrCantWriteFileChunk  = errors.New("can't write file chunk")
+	ErrChunkCountMismatch  = errors.New("chunk count doesn't match server count")
+	ErrServerNotReady      = errors.New("storage server is not ready")
+	ErrCantDeleteFiles     = errors.New("can't delete files from storage")
+	ErrCantLockFile        = errors.New("can't lock file on storage")
 )
 
 type ServerMeta interface {
@@ -27,9 +36,21 @@ type ServerMeta interface {
 	GetID() uuid.UUID
 }
 
+// Blob names the chunks of a file on a storage server, ChunkId names a single one of them
+type Blob struct {
+	Username string    `json:"username"`
+	FileId   uuid.UUID `json:"file_id"`
+	ChunkId  string    `json:"chunk_id,omitempty"`
+}
+
+// Lock keeps the chunks of a file on a storage server from being removed before RetainUntil or while LegalHold is set
+type Lock struct {
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+	LegalHold   bool       `json:"legal_hold"`
+}
+
 type requester interface {
-	Get(url string) (resp *http.Response, err error)
-	Post(url, contentType string, body io.Reader) (resp *http.Response, err error)
+	Do(req *http.Request) (*http.Response, error)
 }
 type Files struct {
 	r requester
@@ -40,12 +61,13 @@ func NewFiles(l *log.Entry) *Files {
 	return &Files{r: getHTTPClient(), l: l}
 }
 
-func (f *Files) GetFile(servers []ServerMeta, username string, fileId uuid.UUID) (io.Reader, error) {
+// GetFile returns chunks first, first+1... of the file from servers[0], servers[1]..., as they are stored on the servers
+func (f *Files) GetFile(ctx context.Context, servers []ServerMeta, username string, fileId uuid.UUID, first uint) ([]io.Reader, error) {
 	eg := &errgroup.Group{}
 	eg.SetLimit(len(servers))
 	chunkReaders := make([]io.Reader, len(servers))
 	for i := range servers {
-		chunkNumber := i
+		chunkNumber := first + uint(i)
 		server := servers[i]
 		eg.Go(func() error {
 			urlString, err := url.JoinPath(
@@ -54,54 +76,66 @@ func (f *Files) GetFile(servers []ServerMeta, username string, fileId uuid.UUID)
 				return err
 			}
 
-			res, err := f.r.Get(urlString)
+			ctx, span := startChunkSpan(ctx, "chunk.fetch", server, chunkNumber)
+			defer span.End()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlString, nil)
+			if err != nil {
+				return err
+			}
+			tracing.Inject(ctx, req.Header)
+
+			start := time.Now()
+			res, err := f.r.Do(req)
 			if err != nil {
 				return fmt.Errorf("can't get chunk from %s: %w", server.GetID().String(), err)
 			}
+			defer func() {
+				metrics.ChunkDuration.WithLabelValues(server.GetUrl(), metrics.OperationFetch).Observe(time.Since(start).Seconds())
+			}()
 			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("can't get chunk from %s: status %d", server.GetID().String(), res.StatusCode)
+			}
 			c := &bytes.Buffer{}
 
 			if _, err = io.Copy(c, res.Body); err != nil {
 				return fmt.Errorf("can't read chunk from %s: %w", server.GetID().String(), err)
 			}
-			chunkReaders[chunkNumber] = c
+			chunkReaders[i] = c
 
 			return nil
 		})
 	}
 	if err := eg.Wait(); err != nil {
-		f.l.WithError(err).Error(ErrCantGetChunks)
+		tracing.Logger(ctx, f.l).WithError(err).Error(ErrCantGetChunks)
 
 		return nil, ErrCantGetChunks
 	}
-	return io.MultiReader(chunkReaders...), nil
+	return chunkReaders, nil
 }
 
-func (f *Files) SendFile(servers []ServerMeta, username string, file io.Reader, fileId uuid.UUID, fileSize int64) ([]uuid.UUID, error) {
-	var chunkNum = int64(len(servers))
-	chunkTailSize := fileSize % chunkNum
-	chunkSize := fileSize / chunkNum
-
-	var saved = make([]uuid.UUID, chunkNum)
+// SendFile sends chunks[i] to servers[i] as chunk first+i, the chunks are sent as is
+func (f *Files) SendFile(ctx context.Context, servers []ServerMeta, username string, fileId uuid.UUID, first uint, chunks [][]byte) ([]uuid.UUID, error) {
+	if len(chunks) != len(servers) {
+		return nil, ErrChunkCountMismatch
+	}
+	var saved = make([]uuid.UUID, len(servers))
 	eg := &errgroup.Group{}
 	eg.SetLimit(len(servers))
 	for i := range servers {
 		server := servers[i]
 		saved[i] = server.GetID()
 
-		chunkLen := chunkSize
-		if i == len(servers)-1 {
-			chunkLen = chunkSize + chunkTailSize
-		}
-
-		ct, r, err := f.prepareRequest(fmt.Sprintf("%d", i), file, chunkLen)
+		chunkNumber := first + uint(i)
+		ct, r, err := f.prepareRequest(fmt.Sprintf("%d", chunkNumber), chunks[i])
 		if err != nil {
 			return nil, err
 		}
 		eg.Go(func() error {
 			urlString, err := url.JoinPath(server.GetUrl(), "object", username, fileId.String())
 			if err != nil {
-				f.l.
+				tracing.Logger(ctx, f.l).
 					WithFields(log.Fields{
 						"server_id": server.GetID(),
 						"base_url":  server.GetUrl(),
@@ -113,10 +147,22 @@ func (f *Files) SendFile(servers []ServerMeta, username string, file io.Reader,
 				return err
 			}
 
-			res, err := f.r.Post(urlString, ct, r)
+			ctx, span := startChunkSpan(ctx, "chunk.store", server, chunkNumber)
+			defer span.End()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlString, r)
 			if err != nil {
 				return err
 			}
+			req.Header.Set("Content-Type", ct)
+			tracing.Inject(ctx, req.Header)
+
+			start := time.Now()
+			res, err := f.r.Do(req)
+			if err != nil {
+				return err
+			}
+			metrics.ChunkDuration.WithLabelValues(server.GetUrl(), metrics.OperationStore).Observe(time.Since(start).Seconds())
 			defer res.Body.Close()
 
 			if res.StatusCode != http.StatusOK {
@@ -134,7 +180,94 @@ func (f *Files) SendFile(servers []ServerMeta, username string, file io.Reader,
 	return saved, eg.Wait()
 }
 
-func (f *Files) prepareRequest(chunkName string, file io.Reader, chunkLen int64) (string, io.Reader, error) {
+// DeleteFiles removes all the chunks of the files, or the single chunks named, from the server in one request.
+// It returns the files the server keeps as they are locked there
+func (f *Files) DeleteFiles(ctx context.Context, server ServerMeta, blobs []Blob) ([]Blob, error) {
+	urlString, err := url.JoinPath(server.GetUrl(), "delete")
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string][]Blob{"files": blobs})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlString, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+
+	start := time.Now()
+	res, err := f.r.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCantDeleteFiles, server.GetID(), err)
+	}
+	metrics.ChunkDuration.WithLabelValues(server.GetUrl(), metrics.OperationDelete).Observe(time.Since(start).Seconds())
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s returned %d", ErrCantDeleteFiles, server.GetID(), res.StatusCode)
+	}
+	var deleted struct {
+		Locked []Blob `json:"locked"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&deleted); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCantDeleteFiles, server.GetID(), err)
+	}
+	return deleted.Locked, nil
+}
+
+// LockFile sets the lock of the chunks of the file on the server, a lock that isn't active removes it
+func (f *Files) LockFile(ctx context.Context, server ServerMeta, blob Blob, lock *Lock) error {
+	urlString, err := url.JoinPath(server.GetUrl(), "lock", blob.Username, blob.FileId.String())
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, urlString, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+
+	res, err := f.r.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrCantLockFile, server.GetID(), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%w: %s returned %d", ErrCantLockFile, server.GetID(), res.StatusCode)
+	}
+	return nil
+}
+
+// Ping checks that the server is ready to store chunks
+func (f *Files) Ping(ctx context.Context, server ServerMeta) error {
+	urlString, err := url.JoinPath(server.GetUrl(), "readyz")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlString, nil)
+	if err != nil {
+		return err
+	}
+	tracing.Inject(ctx, req.Header)
+	res, err := f.r.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %d", ErrServerNotReady, server.GetID(), res.StatusCode)
+	}
+	return nil
+}
+
+func (f *Files) prepareRequest(chunkName string, chunk []byte) (string, io.Reader, error) {
 	body := &bytes.Buffer{}
 
 	writer := multipart.NewWriter(body)
@@ -145,9 +278,9 @@ func (f *Files) prepareRequest(chunkName string, file io.Reader, chunkLen int64)
 		return "", nil, ErrCantCreateFileField
 	}
 
-	if n, err := io.CopyN(formFile, file, chunkLen); err != nil && errors.Is(err, io.EOF) {
-		f.l.WithError(err).Error(ErrCantReadFileChunk)
-		return "", nil, ErrCantReadFileChunk
+	if n, err := formFile.Write(chunk); err != nil {
+		f.l.WithError(err).Error(ErrCantWriteFileChunk)
+		return "", nil, ErrCantWriteFileChunk
 	} else {
 		f.l.WithField("size", n).Debug("chunk file written")
 	}
@@ -156,6 +289,13 @@ func (f *Files) prepareRequest(chunkName string, file io.Reader, chunkLen int64)
 	return writer.FormDataContentType(), body, nil
 }
 
+func startChunkSpan(ctx context.Context, name string, server ServerMeta, number uint) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartSpan(ctx, name)
+	span.SetField("server", server.GetUrl())
+	span.SetField("chunk", number)
+	return ctx, span
+}
+
 func getHTTPClient() *http.Client {
 	return &http.Client{
 		Timeout: 30 * time.Second,
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+const (
+	DefaultMinChunkSize = 64 << 10 // 64Kb
+	DefaultMaxChunkSize = 64 << 20 // 64Mb
+	DefaultInlineSize   = 4 << 10  // 4Kb
+)
+
+var ErrBadLayout = errors.New("file chunks don't match its layout")
+
+// ChunkPolicy decides how a file is cut into chunks.
+// A file is spread over Servers chunks when they fit between MinSize and MaxSize,
+// a smaller file gets fewer chunks and a bigger one gets more, several per server
+type ChunkPolicy struct {
+	// Servers is the number of servers the chunks of a file are spread over
+	Servers int
+	MinSize int64
+	MaxSize int64
+	// InlineSize is the size files are kept in the metadata below, they have no chunks then. 0 disables it
+	InlineSize int64
+	// Replicas is the number of copies of every chunk, they are kept on different servers. 0 means 1
+	Replicas int
+	// Degraded is what an upload does when fewer servers are active than it needs, DegradedReject when empty
+	Degraded string
+}
+
+// Copies is the number of copies of a chunk
+func (p ChunkPolicy) Copies() int {
+	return max(1, p.Replicas)
+}
+
+// servers is the number of servers the chunks of a file are spread over, the copies of a chunk need a server each
+func (p ChunkPolicy) servers(chunks int) int {
+	return max(min(chunks, p.Servers), p.Copies())
+}
+
+func (p ChunkPolicy) Inline(size int64) bool {
+	return size < p.InlineSize
+}
+
+// ChunkSpan is a part of a file stored as a chunk
+type ChunkSpan struct {
+	Offset int64
+	Size   int64
+}
+
+// Layout cuts a file of the given size into chunks of nearly equal size. An empty file has no chunks
+func (p ChunkPolicy) Layout(size int64) []ChunkSpan {
+	if size <= 0 {
+		return nil
+	}
+	n := int64(p.Servers)
+	if p.MinSize > 0 && size/n < p.MinSize {
+		n = max(1, size/p.MinSize)
+	}
+	if p.MaxSize > 0 && (size+n-1)/n > p.MaxSize {
+		n = (size + p.MaxSize - 1) / p.MaxSize
+	}
+
+	spans := make([]ChunkSpan, n)
+	chunkSize, rest := size/n, size%n
+	offset := int64(0)
+	for i := range spans {
+		spans[i] = ChunkSpan{Offset: offset, Size: chunkSize}
+		// the remainder is spread over the first chunks, so no chunk exceeds MaxSize
+		if int64(i) < rest {
+			spans[i].Size++
+		}
+		offset += spans[i].Size
+	}
+	return spans
+}
+
+// checkLayout makes sure the file chunks cover it from the start to the end without gaps, it returns the copies of every chunk.
+// The chunks are expected to be sorted by number
+func checkLayout(file *database.File) ([][]*database.Chunk, error) {
+	var copies [][]*database.Chunk
+	for _, c := range file.Chunks {
+		if n := len(copies); n > 0 && copies[n-1][0].Number == c.Number {
+			copies[n-1] = append(copies[n-1], c)
+			continue
+		}
+		copies = append(copies, []*database.Chunk{c})
+	}
+	if len(copies) != file.ChunkCount {
+		return nil, fmt.Errorf("%w: %d chunks of %d", ErrBadLayout, len(copies), file.ChunkCount)
+	}
+	offset := int64(0)
+	for i, cc := range copies {
+		for _, c := range cc {
+			if c.Number != uint(i) || c.Offset != offset || c.Size != cc[0].Size {
+				return nil, fmt.Errorf("%w: chunk %d at %d, expected %d at %d", ErrBadLayout, c.Number, c.Offset, i, offset)
+			}
+		}
+		offset += cc[0].Size
+	}
+	if offset != file.Size {
+		return nil, fmt.Errorf("%w: chunks have %d bytes of %d", ErrBadLayout, offset, file.Size)
+	}
+	return copies, nil
+}
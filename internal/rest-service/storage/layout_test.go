@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+func TestChunkPolicy_Layout(t *testing.T) {
+	p := ChunkPolicy{Servers: 6, MinSize: 10, MaxSize: 100}
+	tests := []struct {
+		name  string
+		size  int64
+		sizes []int64
+	}{
+		{name: "empty", size: 0},
+		{name: "smaller than min", size: 5, sizes: []int64{5}},
+		{name: "a few chunks", size: 25, sizes: []int64{13, 12}},
+		{name: "a chunk per server", size: 62, sizes: []int64{11, 11, 10, 10, 10, 10}},
+		{name: "max per server", size: 600, sizes: []int64{100, 100, 100, 100, 100, 100}},
+		{name: "more than servers", size: 601, sizes: []int64{86, 86, 86, 86, 86, 86, 85}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout := p.Layout(tt.size)
+			var sizes []int64
+			offset := int64(0)
+			for _, span := range layout {
+				assert.Equal(t, offset, span.Offset)
+				offset += span.Size
+				sizes = append(sizes, span.Size)
+			}
+			assert.Equal(t, tt.sizes, sizes)
+			assert.Equal(t, tt.size, offset)
+		})
+	}
+}
+
+func TestCheckLayout(t *testing.T) {
+	file := &database.File{Size: 10, ChunkCount: 2, Chunks: []*database.Chunk{
+		{Number: 0, Offset: 0, Size: 6},
+		{Number: 1, Offset: 6, Size: 4},
+	}}
+	copies, err := checkLayout(file)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]*database.Chunk{file.Chunks[:1], file.Chunks[1:]}, copies)
+	_, err = checkLayout(&database.File{})
+	assert.NoError(t, err)
+
+	file.ChunkCount = 3
+	_, err = checkLayout(file)
+	assert.ErrorIs(t, err, ErrBadLayout)
+	file.ChunkCount = 2
+	file.Chunks[1].Offset = 5
+	_, err = checkLayout(file)
+	assert.ErrorIs(t, err, ErrBadLayout)
+	file.Chunks[1].Offset = 6
+	file.Size = 11
+	_, err = checkLayout(file)
+	assert.ErrorIs(t, err, ErrBadLayout)
+	file.Size = 10
+
+	// the copies of a chunk are kept together
+	file.Chunks = append(file.Chunks[:1], &database.Chunk{Number: 0, Offset: 0, Size: 6}, file.Chunks[1])
+	copies, err = checkLayout(file)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]*database.Chunk{file.Chunks[:2], file.Chunks[2:]}, copies)
+	file.Chunks[1].Size = 5
+	_, err = checkLayout(file)
+	assert.ErrorIs(t, err, ErrBadLayout)
+}
+
+func TestChunkPolicy_Inline(t *testing.T) {
+	p := ChunkPolicy{InlineSize: 10}
+	assert.True(t, p.Inline(0))
+	assert.True(t, p.Inline(9))
+	assert.False(t, p.Inline(10))
+	assert.False(t, ChunkPolicy{}.Inline(0))
+}
+
+func TestChunkPolicy_servers(t *testing.T) {
+	assert.Equal(t, 6, ChunkPolicy{Servers: 6}.servers(10))
+	assert.Equal(t, 2, ChunkPolicy{Servers: 6}.servers(2))
+	assert.Equal(t, 3, ChunkPolicy{Servers: 6, Replicas: 3}.servers(1), "the copies need a server each")
+}
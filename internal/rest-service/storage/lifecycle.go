@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+var ErrCantExpireFiles = errors.New("can't expire files")
+
+// LifecycleReport is what a lifecycle rule would remove now
+type LifecycleReport struct {
+	Rule    *database.LifecycleRule `json:"rule"`
+	Objects int64                   `json:"objects"`
+	Bytes   int64                   `json:"bytes"`
+	// Keys are the first expired objects, ordered by dir, then name
+	Keys []string `json:"keys"`
+}
+
+// expireFiles removes the files the lifecycle rules expire, their content is left as garbage
+func (s *Server) expireFiles(ctx context.Context) {
+	rules, err := s.ms.GetLifecycleRules("")
+	if err != nil {
+		s.logger(ctx).WithError(err).Error(ErrCantExpireFiles)
+		return
+	}
+	now := time.Now()
+	for _, rule := range rules {
+		l := s.logger(ctx).WithFields(log.Fields{"rule": rule.ID, "username": rule.User, "prefix": rule.Prefix})
+		expired := 0
+		for ctx.Err() == nil {
+			removed, err := s.ms.ExpireFiles(rule.User, rule.Prefix, rule.ExpiredBefore(now), deleteBatch)
+			if err != nil {
+				l.WithError(err).Error(ErrCantExpireFiles)
+				break
+			}
+			expired += len(removed)
+			if len(removed) < deleteBatch {
+				break
+			}
+		}
+		if expired > 0 {
+			l.WithField("files", expired).Info("files expired")
+		}
+	}
+}
+
+// LifecycleReport reports what the rules of the user would remove now, with up to limit keys per rule.
+// A file several rules expire is in the report of each
+func (s *Server) LifecycleReport(ctx context.Context, username string, limit int) ([]*LifecycleReport, error) {
+	rules, err := s.ms.GetLifecycleRules(username)
+	if err != nil {
+		s.logger(ctx).WithError(err).Error(ErrCantGetFile)
+		return nil, ErrCantGetFile
+	}
+	now := time.Now()
+	reports := make([]*LifecycleReport, 0, len(rules))
+	for _, rule := range rules {
+		before := rule.ExpiredBefore(now)
+		count, err := s.ms.CountExpiredFiles(username, rule.Prefix, before)
+		if err != nil {
+			s.logger(ctx).WithError(err).Error(ErrCantGetFile)
+			return nil, ErrCantGetFile
+		}
+		files, err := s.ms.ExpiredFiles(username, rule.Prefix, before, "", "", limit)
+		if err != nil {
+			s.logger(ctx).WithError(err).Error(ErrCantGetFile)
+			return nil, ErrCantGetFile
+		}
+		report := &LifecycleReport{Rule: rule, Objects: count.Objects, Bytes: count.Bytes, Keys: make([]string, len(files))}
+		for i, f := range files {
+			report.Keys[i] = database.JoinKey(f.Dir, f.Name)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+)
+
+var ErrCantLockFile = errors.New("can't lock file")
+
+// SetLock sets the retention and the legal hold of the file, see MetaStorage.SetFileLock.
+// The storage servers keep the lock of the content too, it's locked while any file sharing it is
+func (s *Server) SetLock(ctx context.Context, username, dir, filename string, retainUntil *time.Time, legalHold bool) (*database.File, error) {
+	file, err := s.ms.SetFileLock(username, dir, filename, retainUntil, legalHold)
+	switch {
+	case errors.Is(err, database.ErrRecordNotFound):
+		return nil, ErrFileNotFound
+	case errors.Is(err, database.ErrRetentionShortened):
+		return nil, err
+	case err != nil:
+		s.logger(ctx).WithError(err).Error(ErrCantLockFile)
+		return nil, ErrCantLockFile
+	}
+	if len(file.Chunks) == 0 {
+		return file, nil
+	}
+
+	lock := &files.Lock{}
+	if lock.RetainUntil, lock.LegalHold, err = s.ms.GetBlobLock(file.BlobID); err != nil {
+		s.logger(ctx).WithError(err).Error(ErrCantLockFile)
+		return nil, ErrCantLockFile
+	}
+	blob := files.Blob{Username: file.User, FileId: file.BlobID}
+	servers := map[uuid.UUID]bool{}
+	for _, chunk := range file.Chunks {
+		// a dead server is replaced by the repair, the new copies get the lock then
+		if servers[chunk.ServerID] || chunk.Server.State == database.ServerDead {
+			continue
+		}
+		servers[chunk.ServerID] = true
+		if err := s.fs.LockFile(ctx, chunk.Server, blob, lock); err != nil {
+			// the lock is kept here anyway, setting it again retries the servers
+			s.logger(ctx).WithError(err).WithField("blob_id", file.BlobID).Error(ErrCantLockFile)
+			return nil, ErrCantLockFile
+		}
+	}
+	return file, nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+// deleteBatch is how many files an operation removes in a transaction
+const deleteBatch = 100
+
+var (
+	ErrOperationNotFound  = errors.New("operation not found")
+	ErrCantGetOperation   = errors.New("can't get operation")
+	ErrCantStartOperation = errors.New("can't start operation")
+)
+
+// StartDelete queues an operation removing the keys, or everything under the prefix dir. It runs in the background
+func (s *Server) StartDelete(ctx context.Context, username string, req *database.OperationRequest) (*database.Operation, error) {
+	op := &database.Operation{
+		User:    username,
+		Kind:    database.OperationDelete,
+		Status:  database.OperationPending,
+		Request: req,
+		Report:  &database.OperationReport{},
+	}
+	if err := s.ms.CreateOperation(op); err != nil {
+		s.logger(ctx).WithError(err).Error(ErrCantStartOperation)
+		return nil, ErrCantStartOperation
+	}
+	s.wakeUp()
+	return op, nil
+}
+
+// GetOperation returns the operation of the user with its report
+func (s *Server) GetOperation(ctx context.Context, username string, id uuid.UUID) (*database.Operation, error) {
+	op, err := s.ms.GetOperation(username, id)
+	if err != nil {
+		if errors.Is(err, database.ErrRecordNotFound) {
+			return nil, ErrOperationNotFound
+		}
+		s.logger(ctx).WithError(err).Error(ErrCantGetOperation)
+		return nil, ErrCantGetOperation
+	}
+	return op, nil
+}
+
+// runOperations runs the queued operations one by one.
+// An operation interrupted by a shutdown stays running and is resumed first on the next start
+func (s *Server) runOperations(ctx context.Context) {
+	for ctx.Err() == nil {
+		op, err := s.ms.NextOperation()
+		if errors.Is(err, database.ErrRecordNotFound) {
+			return
+		}
+		if err != nil {
+			s.logger(ctx).WithError(err).Error(ErrCantGetOperation)
+			return
+		}
+		l := s.logger(ctx).WithFields(log.Fields{"operation": op.ID, "kind": op.Kind, "username": op.User})
+		op.Status = database.OperationRunning
+		if op.Report == nil {
+			op.Report = &database.OperationReport{}
+		}
+		if err := s.ms.UpdateOperation(op); err != nil {
+			l.WithError(err).Error(ErrCantStartOperation)
+			return
+		}
+
+		switch op.Kind {
+		case database.OperationDelete:
+			err = s.runDelete(ctx, op)
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Kind)
+		}
+		if ctx.Err() != nil {
+			l.Info("operation interrupted")
+			return
+		}
+		op.Status = database.OperationDone
+		if err != nil {
+			op.Status, op.Error = database.OperationFailed, err.Error()
+			l.WithError(err).Error("operation failed")
+		} else {
+			l.WithField("deleted", op.Report.Deleted).Info("operation done")
+		}
+		if err := s.ms.UpdateOperation(op); err != nil {
+			l.WithError(err).Error("can't save operation")
+			return
+		}
+	}
+}
+
+// runDelete removes the files of the operation in batches, the report is saved after every batch.
+// A resumed operation skips the keys already in the report
+func (s *Server) runDelete(ctx context.Context, op *database.Operation) error {
+	report := op.Report
+	if len(op.Request.Keys) > 0 {
+		keys := op.Request.Keys[min(len(op.Request.Keys), report.Deleted+len(report.Missing)+len(report.Failed)):]
+		for len(keys) > 0 && ctx.Err() == nil {
+			batch := keys[:min(deleteBatch, len(keys))]
+			keys = keys[len(batch):]
+			files := make([]*database.File, len(batch))
+			for i, key := range batch {
+				files[i] = &database.File{}
+				files[i].Dir, files[i].Name = database.SplitKey(key)
+			}
+			s.deleteFiles(ctx, op, files)
+			if err := s.ms.UpdateOperation(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var afterDir, afterName string
+	for ctx.Err() == nil {
+		files, err := s.ms.ListFiles(op.User, op.Request.Prefix, true, afterDir, afterName, deleteBatch)
+		if err != nil || len(files) == 0 {
+			return err
+		}
+		s.deleteFiles(ctx, op, files)
+		if err := s.ms.UpdateOperation(op); err != nil {
+			return err
+		}
+		afterDir, afterName = files[len(files)-1].Dir, files[len(files)-1].Name
+	}
+	return nil
+}
+
+// deleteFiles removes the files in a transaction and counts them in the report of the operation
+func (s *Server) deleteFiles(ctx context.Context, op *database.Operation, files []*database.File) {
+	report := op.Report
+	removed, locked, err := s.ms.DeleteFiles(op.User, files)
+	if err != nil {
+		s.logger(ctx).WithError(err).WithField("operation", op.ID).Error(ErrCantRemoveFile)
+		if report.Failed == nil {
+			report.Failed = map[string]string{}
+		}
+		for _, f := range files {
+			report.Failed[database.JoinKey(f.Dir, f.Name)] = ErrCantRemoveFile.Error()
+		}
+		return
+	}
+	done := make(map[string]bool, len(removed)+len(locked))
+	for _, f := range removed {
+		done[database.JoinKey(f.Dir, f.Name)] = true
+	}
+	report.Deleted += len(removed)
+	if len(locked) > 0 && report.Failed == nil {
+		report.Failed = map[string]string{}
+	}
+	for _, f := range locked {
+		key := database.JoinKey(f.Dir, f.Name)
+		done[key] = true
+		report.Failed[key] = database.ErrObjectLocked.Error()
+	}
+	for _, f := range files {
+		if key := database.JoinKey(f.Dir, f.Name); !done[key] {
+			report.Missing = append(report.Missing, key)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+)
+
+const (
+	PlacementLeastLoaded    = "least-loaded"
+	PlacementWeightedRandom = "weighted-random"
+	PlacementRoundRobin     = "round-robin"
+	PlacementRendezvous     = "rendezvous"
+)
+
+// Placement orders the servers for the chunks of a blob, they are taken from the first one.
+// The candidates are left as they are
+type Placement interface {
+	Order(blobID uuid.UUID, candidates []*database.ServerUsage) []*database.Server
+}
+
+// ParsePlacement returns the placement by its name, PlacementLeastLoaded by default
+func ParsePlacement(name string) (Placement, error) {
+	switch name {
+	case "", PlacementLeastLoaded:
+		return LeastLoaded{}, nil
+	case PlacementWeightedRandom:
+		return NewWeightedRandom(uint64(time.Now().UnixNano())), nil
+	case PlacementRoundRobin:
+		return &RoundRobin{}, nil
+	case PlacementRendezvous:
+		return Rendezvous{}, nil
+	}
+	return nil, fmt.Errorf("unknown placement %q, must be %s, %s, %s or %s",
+		name, PlacementLeastLoaded, PlacementWeightedRandom, PlacementRoundRobin, PlacementRendezvous)
+}
+
+// LeastLoaded takes the servers keeping the fewest bytes first, then the ones with fewer chunks
+type LeastLoaded struct{}
+
+func (LeastLoaded) Order(_ uuid.UUID, candidates []*database.ServerUsage) []*database.Server {
+	ordered := slices.Clone(candidates)
+	slices.SortStableFunc(ordered, func(a, b *database.ServerUsage) int {
+		if a.Bytes != b.Bytes {
+			return cmp.Compare(a.Bytes, b.Bytes)
+		}
+		return cmp.Compare(a.Chunks, b.Chunks)
+	})
+	return usageServers(ordered)
+}
+
+// WeightedRandom takes the servers at random, a server keeping less is taken more likely.
+// The weight of a server is what it keeps less than the fullest one plus the mean, so the fullest one is still taken
+type WeightedRandom struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func NewWeightedRandom(seed uint64) *WeightedRandom {
+	return &WeightedRandom{rnd: rand.New(rand.NewPCG(seed, seed))}
+}
+
+func (w *WeightedRandom) Order(_ uuid.UUID, candidates []*database.ServerUsage) []*database.Server {
+	if len(candidates) == 0 {
+		return nil
+	}
+	var most, total int64
+	for _, c := range candidates {
+		most, total = max(most, c.Bytes), total+c.Bytes
+	}
+	mean := float64(total) / float64(len(candidates))
+	// a weighted sample without replacement, the server with the highest log(u)/weight goes first,
+	// the order of u^(1/weight) without rounding it to 1 for the heavy servers
+	keys := make(map[uuid.UUID]float64, len(candidates))
+	w.mu.Lock()
+	for _, c := range candidates {
+		weight := float64(most-c.Bytes) + mean + 1
+		keys[c.ID] = math.Log(1-w.rnd.Float64()) / weight
+	}
+	w.mu.Unlock()
+	ordered := slices.Clone(candidates)
+	slices.SortFunc(ordered, func(a, b *database.ServerUsage) int {
+		return cmp.Compare(keys[b.ID], keys[a.ID])
+	})
+	return usageServers(ordered)
+}
+
+// RoundRobin takes the servers in turn, a blob starts with the server after the one the previous blob started with
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+func (r *RoundRobin) Order(_ uuid.UUID, candidates []*database.ServerUsage) []*database.Server {
+	if len(candidates) == 0 {
+		return nil
+	}
+	ordered := slices.Clone(candidates)
+	slices.SortFunc(ordered, func(a, b *database.ServerUsage) int {
+		return slices.Compare(a.ID[:], b.ID[:])
+	})
+	first := int((r.next.Add(1) - 1) % uint64(len(ordered)))
+	return usageServers(append(ordered[first:], ordered[:first]...))
+}
+
+// Rendezvous takes the servers with the highest hash of the blob and the server first.
+// A blob gets the same servers while the others come and go, the load isn't looked at
+type Rendezvous struct{}
+
+func (Rendezvous) Order(blobID uuid.UUID, candidates []*database.ServerUsage) []*database.Server {
+	scores := make(map[uuid.UUID]uint64, len(candidates))
+	for _, c := range candidates {
+		sum := sha256.Sum256(append(blobID[:], c.ID[:]...))
+		scores[c.ID] = binary.BigEndian.Uint64(sum[:8])
+	}
+	ordered := slices.Clone(candidates)
+	slices.SortFunc(ordered, func(a, b *database.ServerUsage) int {
+		return cmp.Compare(scores[b.ID], scores[a.ID])
+	})
+	return usageServers(ordered)
+}
+
+func usageServers(usage []*database.ServerUsage) []*database.Server {
+	res := make([]*database.Server, len(usage))
+	for i, u := range usage {
+		res[i] = &u.Server
+	}
+	return res
+}
+
+// reservation is the load an upload puts on a server before its chunks are saved
+type reservation struct {
+	chunks int64
+	bytes  int64
+}
+
+// placements counts the uploads storing chunks on every server before the files are saved and the load they reserve.
+// The reserved load counts as kept by the servers, so concurrent uploads don't take the same servers,
+// and a drained server isn't removed while an upload still refers to it
+type placements struct {
+	mu       sync.Mutex
+	n        map[uuid.UUID]int
+	reserved map[uuid.UUID]reservation
+}
+
+func newPlacements() placements {
+	return placements{n: map[uuid.UUID]int{}, reserved: map[uuid.UUID]reservation{}}
+}
+
+// withReserved returns copies of the candidates with the reserved load added, p.mu must be held
+func (p *placements) withReserved(candidates []*database.ServerUsage) []*database.ServerUsage {
+	res := make([]*database.ServerUsage, len(candidates))
+	for i, c := range candidates {
+		u := *c
+		r := p.reserved[c.ID]
+		u.Chunks, u.Bytes = u.Chunks+r.chunks, u.Bytes+r.bytes
+		res[i] = &u
+	}
+	return res
+}
+
+// hold reserves the load on every server until the returned func is called, p.mu must be held
+func (p *placements) hold(servers []files.ServerMeta, r reservation) func() {
+	for _, server := range servers {
+		p.add(server.GetID(), 1, r.chunks, r.bytes)
+	}
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, server := range servers {
+			p.add(server.GetID(), -1, -r.chunks, -r.bytes)
+		}
+	}
+}
+
+func (p *placements) add(id uuid.UUID, n int, chunks, bytes int64) {
+	if p.n[id] += n; p.n[id] <= 0 {
+		delete(p.n, id)
+		delete(p.reserved, id)
+		return
+	}
+	r := p.reserved[id]
+	p.reserved[id] = reservation{chunks: r.chunks + chunks, bytes: r.bytes + bytes}
+}
+
+func (p *placements) busy(id uuid.UUID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.n[id] > 0
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+)
+
+// fill is a simulation of the placement: it stores files of random sizes on the nodes, a file is cut into chunks
+// of equal size on different nodes. More nodes join after half of the files. It returns the bytes every node keeps
+func fill(p Placement, nodes, joined, files, chunks int, seed uint64) []int64 {
+	rnd := rand.New(rand.NewPCG(seed, seed))
+	newID := func() uuid.UUID {
+		var id uuid.UUID
+		binary.BigEndian.PutUint64(id[:8], rnd.Uint64())
+		binary.BigEndian.PutUint64(id[8:], rnd.Uint64())
+		return id
+	}
+	var usage []*database.ServerUsage
+	index := map[uuid.UUID]int{}
+	join := func(n int) {
+		for i := 0; i < n; i++ {
+			id := newID()
+			index[id] = len(usage)
+			usage = append(usage, &database.ServerUsage{Server: database.Server{ID: id, State: database.ServerActive}})
+		}
+	}
+	join(nodes)
+	for i := 0; i < files; i++ {
+		if i == files/2 {
+			join(joined)
+		}
+		// most files are small, a few are much bigger
+		size := int64(rnd.ExpFloat64()*(1<<20)) + 1
+		for _, server := range p.Order(newID(), usage)[:chunks] {
+			u := usage[index[server.ID]]
+			u.Bytes += size / int64(chunks)
+			u.Chunks++
+		}
+	}
+	res := make([]int64, len(usage))
+	for i, u := range usage {
+		res[i] = u.Bytes
+	}
+	return res
+}
+
+// evenness returns how much the fullest node keeps over the mean and the coefficient of variation
+func evenness(bytes []int64) (float64, float64) {
+	var total, most float64
+	for _, b := range bytes {
+		total, most = total+float64(b), max(most, float64(b))
+	}
+	mean := total / float64(len(bytes))
+	var variance float64
+	for _, b := range bytes {
+		variance += (float64(b) - mean) * (float64(b) - mean)
+	}
+	return most / mean, math.Sqrt(variance/float64(len(bytes))) / mean
+}
+
+func TestPlacement_Simulation(t *testing.T) {
+	const (
+		nodes  = 10
+		files  = 5000
+		chunks = 6
+	)
+	tests := []struct {
+		name      string
+		placement Placement
+		joined    int
+		// maxOverMean bounds the fullest node, the nodes that join late can't catch up without the load being looked at
+		maxOverMean float64
+	}{
+		{name: PlacementLeastLoaded, placement: LeastLoaded{}, maxOverMean: 1.01},
+		{name: PlacementWeightedRandom, placement: NewWeightedRandom(1), maxOverMean: 1.1},
+		{name: PlacementRoundRobin, placement: &RoundRobin{}, maxOverMean: 1.1},
+		{name: PlacementRendezvous, placement: Rendezvous{}, maxOverMean: 1.1},
+		{name: PlacementLeastLoaded + " with nodes joined", placement: LeastLoaded{}, joined: 5, maxOverMean: 1.01},
+		{name: PlacementWeightedRandom + " with nodes joined", placement: NewWeightedRandom(1), joined: 5, maxOverMean: 1.25},
+		{name: PlacementRoundRobin + " with nodes joined", placement: &RoundRobin{}, joined: 5, maxOverMean: 1.4},
+		{name: PlacementRendezvous + " with nodes joined", placement: Rendezvous{}, joined: 5, maxOverMean: 1.4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bytes := fill(tt.placement, nodes, tt.joined, files, chunks, 1)
+			maxOverMean, cv := evenness(bytes)
+			t.Logf("%-40s max/mean %.3f, cv %.3f", tt.name, maxOverMean, cv)
+			assert.LessOrEqual(t, maxOverMean, tt.maxOverMean)
+		})
+	}
+}
+
+func TestPlacement_Order(t *testing.T) {
+	var candidates []*database.ServerUsage
+	for i, bytes := range []int64{30, 10, 20, 10} {
+		id := uuid.UUID{byte(i + 1)}
+		candidates = append(candidates, &database.ServerUsage{Server: database.Server{ID: id}, Bytes: bytes, Chunks: int64(4 - i)})
+	}
+	ids := func(servers []*database.Server) []byte {
+		var res []byte
+		for _, s := range servers {
+			res = append(res, s.ID[0])
+		}
+		return res
+	}
+	blob := uuid.New()
+
+	assert.Equal(t, []byte{4, 2, 3, 1}, ids(LeastLoaded{}.Order(blob, candidates)), "fewer bytes first, then fewer chunks")
+
+	rr := &RoundRobin{}
+	assert.Equal(t, []byte{1, 2, 3, 4}, ids(rr.Order(blob, candidates)))
+	assert.Equal(t, []byte{2, 3, 4, 1}, ids(rr.Order(blob, candidates)))
+
+	rendezvous := ids(Rendezvous{}.Order(blob, candidates))
+	assert.ElementsMatch(t, []byte{1, 2, 3, 4}, rendezvous)
+	reversed := []*database.ServerUsage{candidates[3], candidates[2], candidates[1], candidates[0]}
+	assert.Equal(t, rendezvous, ids(Rendezvous{}.Order(blob, reversed)))
+	var left []*database.ServerUsage
+	for _, c := range candidates {
+		if c.ID[0] != rendezvous[3] {
+			left = append(left, c)
+		}
+	}
+	assert.Equal(t, rendezvous[:3], ids(Rendezvous{}.Order(blob, left)), "a blob keeps its servers when another one leaves")
+
+	assert.ElementsMatch(t, []byte{1, 2, 3, 4}, ids(NewWeightedRandom(1).Order(blob, candidates)))
+	assert.Equal(t, []byte{1, 2, 3, 4}, ids(usageServers(candidates)), "the candidates are left as they are")
+}
+
+func TestPlacements_hold(t *testing.T) {
+	var candidates []*database.ServerUsage
+	for i := 0; i < 6; i++ {
+		candidates = append(candidates, &database.ServerUsage{Server: database.Server{ID: uuid.UUID{byte(i + 1)}}})
+	}
+	p := newPlacements()
+	// the uploads run at once, none of them is saved yet
+	taken := map[uuid.UUID]int{}
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		p.mu.Lock()
+		servers := LeastLoaded{}.Order(uuid.New(), p.withReserved(candidates))[:2]
+		held := make([]files.ServerMeta, len(servers))
+		for j, s := range servers {
+			held[j] = s
+			taken[s.ID]++
+		}
+		releases = append(releases, p.hold(held, reservation{chunks: 3, bytes: 300}))
+		p.mu.Unlock()
+	}
+	assert.Len(t, taken, 6, "the uploads take different servers")
+	assert.True(t, p.busy(uuid.UUID{1}))
+	assert.Zero(t, candidates[0].Bytes, "the candidates are left as they are")
+
+	for _, release := range releases {
+		release()
+	}
+	assert.False(t, p.busy(uuid.UUID{1}))
+	assert.Empty(t, p.reserved)
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+	"github.com/konorlevich/test_task_s3/internal/throttle"
+)
+
+const (
+	DefaultRepairInterval = time.Minute
+	// repairBatch is how many chunks are taken at a time
+	repairBatch = 100
+)
+
+var (
+	ErrCantRepair      = errors.New("can't repair chunks")
+	ErrChunkLost       = errors.New("no healthy copy of the chunk is left")
+	ErrNoRepairServers = errors.New("not enough servers to place the copies")
+)
+
+// RepairStatus is the progress of the repair, the counters are of the current pass or the last one
+type RepairStatus struct {
+	Replicas int  `json:"replicas"`
+	Running  bool `json:"running"`
+	// AtRisk counts the chunks with fewer healthy copies than Replicas by the number of the healthy ones when the pass started.
+	// The chunks with no healthy copy are lost, they can't be repaired
+	AtRisk   map[int]int64 `json:"at_risk"`
+	Repaired int64         `json:"repaired"`
+	Failed   int64         `json:"failed"`
+	Bytes    int64         `json:"bytes"`
+	Draining []DrainStatus `json:"draining,omitempty"`
+	// Degraded counts the degraded files checked, a file for every blob, Spread counts the ones spread over enough servers
+	Degraded   int64      `json:"degraded"`
+	Spread     int64      `json:"spread"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// repairState keeps the status of the repair and wakes it up when a server is declared dead
+type repairState struct {
+	mu     sync.Mutex
+	status RepairStatus
+	wake   chan struct{}
+}
+
+// RepairStatus returns the progress of the repair
+func (s *Server) RepairStatus() RepairStatus {
+	s.repair.mu.Lock()
+	defer s.repair.mu.Unlock()
+	st := s.repair.status
+	st.AtRisk = make(map[int]int64, len(s.repair.status.AtRisk))
+	for k, v := range s.repair.status.AtRisk {
+		st.AtRisk[k] = v
+	}
+	st.Draining = append([]DrainStatus(nil), s.repair.status.Draining...)
+	return st
+}
+
+func (s *Server) updateRepair(update func(st *RepairStatus)) {
+	s.repair.mu.Lock()
+	defer s.repair.mu.Unlock()
+	update(&s.repair.status)
+}
+
+// SetServerState sets the state of the storage server,
+// the chunks of a dead server are repaired and the ones of a draining server are moved right away
+func (s *Server) SetServerState(ctx context.Context, id uuid.UUID, state string) error {
+	if err := s.ms.SetServerState(id, state); err != nil {
+		if errors.Is(err, database.ErrRecordNotFound) {
+			return err
+		}
+		s.logger(ctx).WithError(err).Error(ErrCantGetServers)
+		return ErrCantGetServers
+	}
+	s.logger(ctx).WithFields(log.Fields{"server": id, "state": state}).Warning("server state set")
+	select {
+	case s.repair.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// RunRepair restores the copies of the chunks every interval until ctx is done.
+// A chunk should have replicas healthy copies, see database.AtRiskChunk. The chunks with fewer copies are repaired first.
+// A damaged copy is stored again on its server, a copy on a dead server is moved to another one chosen like for a new file.
+// The chunks of the draining servers are moved after that, see drainServers, then the degraded files are spread, see spreadFiles.
+// The chunking policy gives the number of copies and the servers a file is spread over.
+// The repair sends no more than rate bytes a second, 0 means no limit
+func (s *Server) RunRepair(ctx context.Context, interval time.Duration, chunking ChunkPolicy, rate int64) {
+	s.updateRepair(func(st *RepairStatus) { st.Replicas = chunking.Copies() })
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.repairPass(ctx, chunking, rate)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.repair.wake:
+		}
+	}
+}
+
+// repairPass repairs the chunks at risk, drains the servers and spreads the degraded files, the status is reset for it
+func (s *Server) repairPass(ctx context.Context, chunking ChunkPolicy, rate int64) {
+	replicas := chunking.Copies()
+	start := time.Now()
+	s.updateRepair(func(st *RepairStatus) {
+		*st = RepairStatus{Replicas: replicas, Running: true, StartedAt: &start}
+	})
+	defer func() {
+		finished := time.Now()
+		s.updateRepair(func(st *RepairStatus) { st.Running, st.FinishedAt = false, &finished })
+	}()
+	s.repairChunks(ctx, replicas, rate)
+	s.drainServers(ctx, rate)
+	s.spreadFiles(ctx, chunking, rate)
+}
+
+// repairChunks goes over the chunks at risk, the ones with fewer healthy copies first.
+// A chunk that fails is tried again on the next pass
+func (s *Server) repairChunks(ctx context.Context, replicas int, rate int64) {
+	l := s.logger(ctx)
+	atRisk, err := s.ms.CountAtRiskChunks(replicas)
+	if err != nil {
+		l.WithError(err).Error(ErrCantRepair)
+		return
+	}
+	start := time.Now()
+	s.updateRepair(func(st *RepairStatus) { st.AtRisk = atRisk })
+	repairable := int64(0)
+	for healthy, n := range atRisk {
+		if healthy > 0 {
+			repairable += n
+		}
+	}
+	if atRisk[0] > 0 {
+		l.WithField("chunks", atRisk[0]).Error(ErrChunkLost)
+	}
+	if repairable == 0 {
+		return
+	}
+	l.WithField("at_risk", atRisk).Warning("repairing chunks")
+
+	var sent int64
+	for healthy := 1; healthy < replicas; healthy++ {
+		afterBlob, afterNumber := uuid.Nil, uint(0)
+		for ctx.Err() == nil {
+			chunks, err := s.ms.GetAtRiskChunks(healthy, afterBlob, afterNumber, repairBatch)
+			if err != nil {
+				l.WithError(err).Error(ErrCantRepair)
+				return
+			}
+			for _, c := range chunks {
+				if ctx.Err() != nil {
+					return
+				}
+				n, err := s.repairChunk(ctx, c, replicas)
+				sent += n
+				s.updateRepair(func(st *RepairStatus) {
+					st.Bytes += n
+					if err != nil {
+						st.Failed++
+					} else {
+						st.Repaired++
+					}
+				})
+				if err != nil {
+					l.WithError(err).WithFields(log.Fields{"blob_id": c.BlobID, "chunk": c.Number}).Error(ErrCantRepair)
+				}
+				throttle.Wait(ctx, start, sent, rate)
+			}
+			if len(chunks) < repairBatch {
+				break
+			}
+			last := chunks[len(chunks)-1]
+			afterBlob, afterNumber = last.BlobID, last.Number
+		}
+	}
+	st := s.RepairStatus()
+	l.WithFields(log.Fields{"repaired": st.Repaired, "failed": st.Failed, "bytes": st.Bytes}).Info("chunks repaired")
+}
+
+// repairChunk restores the copies of the chunk from a healthy one, it returns the bytes sent
+func (s *Server) repairChunk(ctx context.Context, c *database.AtRiskChunk, replicas int) (int64, error) {
+	copies, err := s.ms.GetChunkCopies(c.BlobID, c.Number)
+	if err != nil {
+		return 0, err
+	}
+	var healthy, damaged, dead []*database.Chunk
+	holders := make([]uuid.UUID, len(copies))
+	for i, cc := range copies {
+		holders[i] = cc.Chunk.ServerID
+		switch {
+		// a draining server takes no chunk, its damaged copy is replaced like a dead one
+		case cc.Chunk.Server.State == database.ServerDead, cc.Damaged && cc.Chunk.Server.State == database.ServerDraining:
+			dead = append(dead, cc.Chunk)
+		case cc.Damaged:
+			damaged = append(damaged, cc.Chunk)
+		default:
+			healthy = append(healthy, cc.Chunk)
+		}
+	}
+	data, err := s.readCopy(ctx, &c.StoredChunk, healthy)
+	if err != nil {
+		return 0, err
+	}
+	sent := int64(0)
+	stored := len(healthy)
+	for _, d := range damaged {
+		if err := s.sendCopy(ctx, &c.StoredChunk, d.Server, data); err != nil {
+			s.logger(ctx).WithError(err).WithField("server", d.ServerID).Warning("damaged copy isn't stored again")
+			continue
+		}
+		sent += int64(len(data))
+		stored++
+		if err := s.ms.RemoveDamagedChunk(d.ServerID, c.BlobID, c.Number); err != nil {
+			return sent, err
+		}
+	}
+	if stored >= replicas {
+		return sent, nil
+	}
+
+	// a new copy on a server the blob is still to be deleted from could be deleted with the garbage
+	garbage, err := s.ms.GetBlobGarbage(c.BlobID)
+	if err != nil {
+		return sent, err
+	}
+	holders = append(holders, garbage...)
+	kept := make([]*database.Server, 0, len(healthy)+len(damaged))
+	for _, cc := range append(healthy, damaged...) {
+		kept = append(kept, cc.Server)
+	}
+	targets, release, err := s.getServers(ctx, c.BlobID, replicas-stored, replicas-stored, reservation{chunks: 1, bytes: int64(len(data))}, kept, holders...)
+	if err != nil {
+		return sent, fmt.Errorf("%w: %w", ErrNoRepairServers, err)
+	}
+	defer release()
+	added := make([]uuid.UUID, 0, len(targets))
+	for _, server := range targets {
+		if err := s.sendCopy(ctx, &c.StoredChunk, server, data); err != nil {
+			s.logger(ctx).WithError(err).WithField("server", server.GetID()).Warning("copy isn't stored")
+			continue
+		}
+		sent += int64(len(data))
+		added = append(added, server.GetID())
+	}
+	if len(added) == 0 {
+		return sent, ErrNoRepairServers
+	}
+	// a copy on a dead server is forgotten once another copy takes its place
+	dropped := make([]uuid.UUID, 0, len(dead))
+	for _, d := range dead[:min(len(added), len(dead))] {
+		dropped = append(dropped, d.ServerID)
+	}
+	if err := s.ms.ReplaceChunkCopies(c.BlobID, c.Number, added, dropped); err != nil {
+		if errors.Is(err, database.ErrRecordNotFound) {
+			// the files were removed meanwhile, the new copies are garbage
+			if err := s.ms.AddGarbage(c.User, c.BlobID, added); err != nil {
+				s.logger(ctx).WithError(err).Error(ErrCantCollectGarbage)
+			}
+			return sent, nil
+		}
+		return sent, err
+	}
+	if len(added) < replicas-stored {
+		return sent, ErrNoRepairServers
+	}
+	return sent, nil
+}
+
+// readCopy reads the chunk as stored from the first healthy copy that has it whole
+func (s *Server) readCopy(ctx context.Context, c *database.StoredChunk, healthy []*database.Chunk) ([]byte, error) {
+	for _, h := range healthy {
+		got, err := s.fs.GetFile(ctx, []files.ServerMeta{h.Server}, c.User, c.BlobID, c.Number)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(got[0])
+		if err == nil && int64(len(data)) == h.StoredSize {
+			return data, nil
+		}
+	}
+	return nil, ErrChunkLost
+}
+
+// sendCopy stores the chunk on the server, with the lock of the blob if it's locked
+func (s *Server) sendCopy(ctx context.Context, c *database.StoredChunk, server files.ServerMeta, data []byte) error {
+	if _, err := s.fs.SendFile(ctx, []files.ServerMeta{server}, c.User, c.BlobID, c.Number, [][]byte{data}); err != nil {
+		return err
+	}
+	lock := &files.Lock{}
+	var err error
+	if lock.RetainUntil, lock.LegalHold, err = s.ms.GetBlobLock(c.BlobID); err != nil {
+		return err
+	}
+	if lock.LegalHold || lock.RetainUntil != nil && time.Now().Before(*lock.RetainUntil) {
+		return s.fs.LockFile(ctx, server, files.Blob{Username: c.User, FileId: c.BlobID}, lock)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+// newServers returns n active servers
+func newServers(n int) []*database.Server {
+	servers := make([]*database.Server, n)
+	for i := range servers {
+		servers[i] = &database.Server{ID: uuid.New(), Name: "server", Port: "80", State: database.ServerActive}
+	}
+	return servers
+}
+
+// healthyCopies returns the indexes of the servers with a healthy copy of the chunk, in order
+func healthyCopies(ms *fakeMeta, servers []*database.Server, blobID uuid.UUID, number uint) []int {
+	var got []int
+	for i, server := range servers {
+		for _, cc := range ms.copies[chunkKey{blobID, number}] {
+			if cc.Chunk.ServerID == server.ID && !cc.Damaged && server.State != database.ServerDead {
+				got = append(got, i)
+			}
+		}
+	}
+	return got
+}
+
+func TestServer_RepairChunk(t *testing.T) {
+	data := []byte("chunk")
+	tests := []struct {
+		name string
+		// copies, dead, damaged and stored are indexes of 4 servers, stored keep the chunk, short keep a part of it
+		copies  []int
+		dead    []int
+		damaged []int
+		stored  []int
+		short   []int
+		garbage []int
+		locked  bool
+
+		wantSent   int64
+		wantErr    error
+		wantCopies []int
+		wantSentTo []int
+		wantLocked []int
+	}{
+		{
+			name:   "damaged copy stored again",
+			copies: []int{0, 1, 2}, damaged: []int{1}, stored: []int{0, 2},
+			wantSent: 5, wantCopies: []int{0, 1, 2}, wantSentTo: []int{1},
+		},
+		{
+			name:   "dead copy moved",
+			copies: []int{0, 1, 2}, dead: []int{2}, stored: []int{0, 1, 2},
+			wantSent: 5, wantCopies: []int{0, 1, 3}, wantSentTo: []int{3},
+		},
+		{
+			name:   "unreadable copy skipped",
+			copies: []int{0, 1, 2}, dead: []int{2}, stored: []int{1},
+			wantSent: 5, wantCopies: []int{0, 1, 3}, wantSentTo: []int{3},
+		},
+		{
+			name:   "short copy skipped",
+			copies: []int{0, 1, 2}, dead: []int{2}, stored: []int{1}, short: []int{0},
+			wantSent: 5, wantCopies: []int{0, 1, 3}, wantSentTo: []int{3},
+		},
+		{
+			name:   "locked blob",
+			copies: []int{0, 1, 2}, dead: []int{2}, damaged: []int{1}, stored: []int{0}, locked: true,
+			wantSent: 10, wantCopies: []int{0, 1, 3}, wantSentTo: []int{1, 3}, wantLocked: []int{1, 3},
+		},
+		{
+			name:   "server with garbage of the blob skipped",
+			copies: []int{0, 1, 2}, dead: []int{2}, stored: []int{0, 1}, garbage: []int{3},
+			wantErr: ErrNoRepairServers, wantCopies: []int{0, 1},
+		},
+		{
+			name:   "no healthy copy",
+			copies: []int{0, 1, 2}, damaged: []int{0, 1}, dead: []int{2},
+			wantErr: ErrChunkLost, wantCopies: []int{},
+		},
+		{
+			name:   "no server to move to",
+			copies: []int{0, 1, 2}, dead: []int{2, 3}, stored: []int{0, 1},
+			wantErr: ErrNoRepairServers, wantCopies: []int{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms, fs := newFakeMeta(), newFakeFiles()
+			ms.servers = newServers(4)
+			blobID := uuid.New()
+			for _, i := range tt.dead {
+				ms.servers[i].State = database.ServerDead
+			}
+			var copies []*database.Server
+			var damaged []uuid.UUID
+			for _, i := range tt.copies {
+				copies = append(copies, ms.servers[i])
+			}
+			for _, i := range tt.damaged {
+				damaged = append(damaged, ms.servers[i].ID)
+			}
+			ms.addChunk("user", blobID, 0, int64(len(data)), copies, damaged...)
+			for _, i := range tt.stored {
+				fs.chunks[chunkPath(ms.servers[i].ID, blobID, 0)] = data
+			}
+			for _, i := range tt.short {
+				fs.chunks[chunkPath(ms.servers[i].ID, blobID, 0)] = data[:2]
+			}
+			for _, i := range tt.garbage {
+				ms.garbage = append(ms.garbage, &database.Garbage{ServerID: ms.servers[i].ID, User: "user", BlobID: blobID})
+			}
+			ms.locked[blobID] = tt.locked
+
+			s := NewServer(ms, fs, nil, nil, LeastLoaded{}, Spread{}, getLogger())
+			sent, err := s.repairChunk(context.Background(), &database.AtRiskChunk{StoredChunk: database.StoredChunk{User: "user", BlobID: blobID}}, 3)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantSent, sent)
+			if tt.wantCopies != nil {
+				assert.ElementsMatch(t, tt.wantCopies, healthyCopies(ms, ms.servers, blobID, 0))
+			}
+			var sentTo, locked []int
+			for i, server := range ms.servers {
+				p := chunkPath(server.ID, blobID, 0)
+				if slices.Contains(fs.sent, p) {
+					assert.Equal(t, data, fs.chunks[p], "server %d", i)
+					sentTo = append(sentTo, i)
+				}
+				if fs.locked[server.ID.String()+"/"+blobID.String()] {
+					locked = append(locked, i)
+				}
+			}
+			assert.Equal(t, tt.wantSentTo, sentTo)
+			assert.Equal(t, tt.wantLocked, locked)
+		})
+	}
+}
+
+func TestServer_RepairChunks(t *testing.T) {
+	ms, fs := newFakeMeta(), newFakeFiles()
+	ms.servers = newServers(4)
+	ms.servers[2].State = database.ServerDead
+	// two copies of the first blob are healthy, only one of the second
+	first, second := uuid.New(), uuid.New()
+	ms.addChunk("user", first, 0, 5, ms.servers[:3])
+	ms.addChunk("user", second, 0, 5, ms.servers[1:3], ms.servers[1].ID)
+	ms.addChunk("user", second, 0, 5, ms.servers[:1])
+	for _, server := range ms.servers[:2] {
+		fs.chunks[chunkPath(server.ID, first, 0)] = []byte("first")
+	}
+	fs.chunks[chunkPath(ms.servers[0].ID, second, 0)] = []byte("secnd")
+
+	s := NewServer(ms, fs, nil, nil, LeastLoaded{}, Spread{}, getLogger())
+	s.repairChunks(context.Background(), 3, 0)
+
+	// the chunk with fewer healthy copies is repaired first
+	assert.Equal(t, []string{
+		chunkPath(ms.servers[1].ID, second, 0),
+		chunkPath(ms.servers[3].ID, second, 0),
+		chunkPath(ms.servers[3].ID, first, 0),
+	}, fs.sent)
+	st := s.RepairStatus()
+	assert.Equal(t, map[int]int64{1: 1, 2: 1}, st.AtRisk)
+	assert.Equal(t, int64(2), st.Repaired)
+	assert.Equal(t, int64(0), st.Failed)
+	assert.Equal(t, int64(15), st.Bytes)
+	assert.False(t, st.Running)
+	assert.Equal(t, []int{0, 1, 3}, healthyCopies(ms, ms.servers, first, 0))
+	assert.Equal(t, []int{0, 1, 3}, healthyCopies(ms, ms.servers, second, 0))
+}
+
+func TestServer_OpenFileCopies(t *testing.T) {
+	content := []byte("firstsecnd")
+	tests := []struct {
+		name string
+		// dead servers are skipped for another copy, down servers fail to give a chunk
+		dead    []int
+		down    []int
+		want    []byte
+		wantErr bool
+	}{
+		{name: "first copies", want: content},
+		{name: "dead server", dead: []int{0}, want: content},
+		{name: "server down", down: []int{0}, want: content},
+		{name: "every copy dead", dead: []int{0, 1}, want: content},
+		{name: "every copy down", down: []int{0, 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms, fs := newFakeMeta(), newFakeFiles()
+			servers := newServers(2)
+			file := &database.File{User: "user", BlobID: uuid.New(), Size: int64(len(content)), ChunkCount: 2}
+			for number := uint(0); number < 2; number++ {
+				for _, server := range servers {
+					file.Chunks = append(file.Chunks, &database.Chunk{ServerID: server.ID, Server: server, Number: number, Offset: int64(number) * 5, Size: 5})
+					fs.chunks[chunkPath(server.ID, file.BlobID, number)] = content[number*5 : number*5+5]
+				}
+			}
+			for _, i := range tt.dead {
+				servers[i].State = database.ServerDead
+			}
+			for _, i := range tt.down {
+				fs.down[servers[i].ID] = true
+			}
+
+			s := NewServer(ms, fs, nil, nil, LeastLoaded{}, Spread{}, getLogger())
+			r, err := s.OpenFile(context.Background(), file)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				got, err := io.ReadAll(r)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPreferredCopy(t *testing.T) {
+	servers := newServers(3)
+	servers[0].State = database.ServerDead
+	copies := func(idx ...int) []*database.Chunk {
+		var chunks []*database.Chunk
+		for _, i := range idx {
+			chunks = append(chunks, &database.Chunk{ServerID: servers[i].ID, Server: servers[i]})
+		}
+		return chunks
+	}
+	tests := []struct {
+		name   string
+		copies []*database.Chunk
+		want   uuid.UUID
+	}{
+		{name: "first alive", copies: copies(1, 2), want: servers[1].ID},
+		{name: "dead skipped", copies: copies(0, 2), want: servers[2].ID},
+		{name: "all dead", copies: copies(0), want: servers[0].ID},
+		{name: "server unknown", copies: []*database.Chunk{{ServerID: servers[2].ID}}, want: servers[2].ID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, preferredCopy(tt.copies).ServerID)
+		})
+	}
+}
@@ -1,15 +1,24 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
-	"mime/multipart"
+	"time"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/compression"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/encryption"
 	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/files"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
 )
 
 var (
@@ -20,100 +29,635 @@ var (
 	ErrCantGetServers = errors.New("can't get servers")
 	ErrCantSaveFile   = errors.New("can't save file")
 
-	ErrSavingFailed = errors.New("file saving failed")
+	ErrSavingFailed    = errors.New("file saving failed")
+	ErrCantRemoveFile  = errors.New("can't remove file")
+	ErrCantReadFile    = errors.New("can't read file")
+	ErrCantDecodeChunk = errors.New("can't decode chunk")
+
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	ErrEncryptionDisabled = errors.New("encryption is not configured")
+	ErrCantGetFileKey     = errors.New("can't get file key")
+	ErrCantRotateKeys     = errors.New("can't rotate keys")
 )
 
 type MetaStorage interface {
-	GetLeastLoadedServers(num int) ([]*database.Server, error)
-	CreateFile(user, dir, name string) (uuid.UUID, error)
+	GetActiveServers(exclude ...uuid.UUID) ([]*database.ServerUsage, error)
+	SetServerState(id uuid.UUID, state string) error
+	GetServersByState(state string) ([]*database.Server, error)
+	GetServerUsage() ([]*database.ServerUsage, error)
+	GetServerChunks(serverID, afterBlob uuid.UUID, afterNumber uint, limit int) ([]*database.StoredChunk, error)
+	RemoveServer(id uuid.UUID) error
 	GetFile(username, dir, name string) (*database.File, error)
-	RemoveFile(id uuid.UUID) error
-	SaveChunk(file uuid.UUID, server uuid.UUID, number uint) (uuid.UUID, error)
+	PutFile(f *database.File, check func(old *database.File) error) (*database.File, error)
+	DeleteFile(user, dir, name string, check func(old *database.File) error) (*database.File, error)
+	DeleteFiles(user string, files []*database.File) ([]*database.File, []*database.File, error)
+	SetFileLock(user, dir, name string, retainUntil *time.Time, legalHold bool) (*database.File, error)
+	GetBlobLock(blobID uuid.UUID) (*time.Time, bool, error)
+
+	GetDueDeliveries(now time.Time, limit int) ([]*database.Delivery, error)
+	UpdateDelivery(d *database.Delivery) error
+	RemoveDeliveries(ids []uuid.UUID) error
+	ListFiles(user, dir string, recursive bool, afterDir, afterName string, limit int) ([]*database.File, error)
+	CopyFile(user, dir, name, toDir, toName string, check func(old *database.File) error) (*database.File, error)
+	MoveFile(user, dir, name, toDir, toName string, check func(old *database.File) error) (*database.File, error)
+	UpdateFileMeta(user, dir, name, contentType string, metadata map[string]string) (*database.File, error)
+	RewrapFileKeys(currentKeyID string, rewrap func(keyID string, wrappedKey []byte) (string, []byte, error)) (int, error)
+	CheckQuota(user, dir string, bytes, objects int64) error
+
+	AddGarbage(user string, blobID uuid.UUID, servers []uuid.UUID) error
+	GetGarbage(limit int) ([]*database.Garbage, error)
+	RemoveGarbage(ids []uuid.UUID) error
+	RetryGarbage(ids []uuid.UUID) error
+	GetBlobGarbage(blobID uuid.UUID) ([]uuid.UUID, error)
+
+	GetLifecycleRules(user string) ([]*database.LifecycleRule, error)
+	ExpiredFiles(user, dir string, before time.Time, afterDir, afterName string, limit int) ([]*database.File, error)
+	CountExpiredFiles(user, dir string, before time.Time) (*database.Usage, error)
+	ExpireFiles(user, dir string, before time.Time, limit int) ([]*database.File, error)
+
+	CreateOperation(op *database.Operation) error
+	UpdateOperation(op *database.Operation) error
+	GetOperation(user string, id uuid.UUID) (*database.Operation, error)
+	NextOperation() (*database.Operation, error)
+
+	CountAtRiskChunks(replicas int) (map[int]int64, error)
+	GetAtRiskChunks(healthy int, afterBlob uuid.UUID, afterNumber uint, limit int) ([]*database.AtRiskChunk, error)
+	GetChunkCopies(blobID uuid.UUID, number uint) ([]*database.ChunkCopy, error)
+	ReplaceChunkCopies(blobID uuid.UUID, number uint, added, dropped []uuid.UUID) error
+	GetDegradedFiles(afterBlob uuid.UUID, limit int) ([]*database.File, error)
+	ClearDegraded(blobID uuid.UUID) error
+	RemoveDamagedChunk(serverID, blobID uuid.UUID, number uint) error
 }
 
 type FileStorage interface {
-	SendFile(servers []files.ServerMeta, username string, file io.Reader, fileId uuid.UUID, fileSize int64) ([]uuid.UUID, error)
-	GetFile(servers []files.ServerMeta, username string, fileId uuid.UUID) (io.Reader, error)
+	SendFile(ctx context.Context, servers []files.ServerMeta, username string, fileId uuid.UUID, first uint, chunks [][]byte) ([]uuid.UUID, error)
+	GetFile(ctx context.Context, servers []files.ServerMeta, username string, fileId uuid.UUID, first uint) ([]io.Reader, error)
+	DeleteFiles(ctx context.Context, server files.ServerMeta, blobs []files.Blob) ([]files.Blob, error)
+	LockFile(ctx context.Context, server files.ServerMeta, blob files.Blob, lock *files.Lock) error
+}
+
+// EventSender sends the events to the webhooks, see webhooks.Sender
+type EventSender interface {
+	Send(ctx context.Context, url, secret, eventID string, body []byte) error
 }
 
 type Server struct {
-	ms MetaStorage
-	fs FileStorage
-	l  *log.Entry
+	ms    MetaStorage
+	fs    FileStorage
+	hooks EventSender
+	// keys is nil when encryption at rest is disabled
+	keys *encryption.Keyring
+	// placement orders the servers for new chunks, spread places them into different failure domains
+	placement Placement
+	spread    Spread
+	l         *log.Entry
+	// wake starts the background work right away, events only the delivery of the queued events
+	wake   chan struct{}
+	events chan struct{}
+	repair repairState
+	// placing keeps the load the uploads reserve on the servers
+	placing placements
 }
 
-func NewServer(ms MetaStorage, fs FileStorage, l *log.Entry) *Server {
+func NewServer(ms MetaStorage, fs FileStorage, hooks EventSender, keys *encryption.Keyring, placement Placement, spread Spread, l *log.Entry) *Server {
 	return &Server{
-		ms: ms,
-		fs: fs,
-		l:  l,
+		ms:        ms,
+		fs:        fs,
+		hooks:     hooks,
+		keys:      keys,
+		placement: placement,
+		spread:    spread,
+		l:         l,
+		wake:      make(chan struct{}, 1),
+		events:    make(chan struct{}, 1),
+		repair: repairState{
+			wake: make(chan struct{}, 1),
+		},
+		placing: newPlacements(),
 	}
 }
 
-func (s *Server) GetFile(username, dir, filename string) (io.Reader, error) {
+// StatFile returns the file record without its content
+func (s *Server) StatFile(ctx context.Context, username, dir, filename string) (*database.File, error) {
 	file, err := s.ms.GetFile(username, dir, filename)
 	if err != nil {
 		if errors.Is(err, database.ErrRecordNotFound) {
 			return nil, ErrFileNotFound
 		}
-		s.l.WithError(err).Error(ErrCantGetFile)
+		s.logger(ctx).WithError(err).Error(ErrCantGetFile)
 		return nil, ErrCantGetFile
 	}
-	if len(file.Chunks) == 0 {
-		s.l.WithError(err).Error(ErrNoChunks)
+	return file, nil
+}
+
+// OpenFile returns the content of the file got with StatFile
+func (s *Server) OpenFile(ctx context.Context, file *database.File) (io.Reader, error) {
+	if file.Inline {
+		return s.getInlineFile(ctx, file)
+	}
+	copies, err := checkLayout(file)
+	if err != nil {
+		s.logger(ctx).WithError(err).Error(ErrNoChunks)
 		return nil, ErrNoChunks
 	}
-	servers := make([]files.ServerMeta, len(file.Chunks))
-	for _, chunk := range file.Chunks {
-		servers[chunk.Number] = chunk.Server
+	dataKey, err := s.fileKey(ctx, file)
+	if err != nil {
+		return nil, err
 	}
-	return s.fs.GetFile(servers, username, file.ID)
+	r := &chunkReader{s: s, ctx: ctx, username: file.User, file: file, copies: copies, dataKey: dataKey, batch: countServers(file.Chunks)}
+	// the first chunks are fetched right away, so a broken file is reported before the response starts
+	if len(copies) > 0 {
+		if err := r.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
 }
 
-func (s *Server) SaveFile(username string, dir string, filename string, chunkNum int, fileSize int64, f multipart.File) (err error) {
-	servers, err := s.getServers(chunkNum)
+// UpdateMetadata sets the content type if it's not empty and merges the user metadata, an empty value removes the key.
+// A locked file isn't changed, database.ErrObjectLocked is returned
+func (s *Server) UpdateMetadata(ctx context.Context, username, dir, filename, contentType string, metadata map[string]string) (*database.File, error) {
+	file, err := s.ms.UpdateFileMeta(username, dir, filename, contentType, metadata)
+	switch {
+	case err == nil:
+		return file, nil
+	case errors.Is(err, database.ErrRecordNotFound):
+		return nil, ErrFileNotFound
+	case errors.Is(err, database.ErrObjectLocked):
+		return nil, err
+	default:
+		s.logger(ctx).WithError(err).Error(ErrCantSaveFile)
+		return nil, ErrCantSaveFile
+	}
+}
+
+// getInlineFile decodes a file kept in the metadata, it's stored as chunk 0 would be
+func (s *Server) getInlineFile(ctx context.Context, file *database.File) (io.Reader, error) {
+	dataKey, err := s.fileKey(ctx, file)
 	if err != nil {
-		s.l.WithError(err).Error(ErrCantGetServers)
-		return ErrCantGetServers
+		return nil, err
 	}
-	fileId, err := s.ms.CreateFile(username, dir, filename)
+	chunk := &database.Chunk{Number: 0, Compression: file.InlineCompression}
+	r, err := s.decodeChunk(dataKey, file.BlobID, chunk, bytes.NewReader(file.InlineData))
 	if err != nil {
-		s.l.WithError(err).Error(ErrCantSaveFile)
-		return ErrCantSaveFile
+		s.logger(ctx).WithError(err).Error(ErrCantDecodeChunk)
+		return nil, ErrCantDecodeChunk
+	}
+	return r, nil
+}
+
+// chunkReader reads the file fetching a batch of chunks at a time, a chunk from every server of the file.
+// A chunk that can't be fetched is fetched from its other copies
+type chunkReader struct {
+	s        *Server
+	ctx      context.Context
+	username string
+	file     *database.File
+	copies   [][]*database.Chunk
+	dataKey  []byte
+	batch    int
+
+	// next is the first chunk that isn't fetched yet
+	next int
+	cur  io.Reader
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			if err == io.EOF {
+				// the end of the batch isn't the end of the file
+				r.cur, err = nil, nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+		}
+		if r.next >= len(r.copies) {
+			return 0, io.EOF
+		}
+		if err := r.fetch(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *chunkReader) fetch() error {
+	copies := r.copies[r.next:min(r.next+r.batch, len(r.copies))]
+	chunks := make([]*database.Chunk, len(copies))
+	servers := make([]files.ServerMeta, len(copies))
+	for i, cc := range copies {
+		chunks[i] = preferredCopy(cc)
+		servers[i] = chunks[i].Server
+	}
+	stored, err := r.s.fs.GetFile(r.ctx, servers, r.username, r.file.BlobID, chunks[0].Number)
+	if err != nil {
+		if stored, err = r.fetchCopies(copies); err != nil {
+			return err
+		}
+	}
+	readers := make([]io.Reader, len(chunks))
+	for i, chunk := range chunks {
+		if readers[i], err = r.s.decodeChunk(r.dataKey, r.file.BlobID, chunk, stored[i]); err != nil {
+			r.s.logger(r.ctx).WithError(err).WithField("chunk", chunk.Number).Error(ErrCantDecodeChunk)
+			return ErrCantDecodeChunk
+		}
+	}
+	r.cur = io.MultiReader(readers...)
+	r.next += len(chunks)
+	return nil
+}
+
+// fetchCopies fetches the chunks one by one trying every copy of a chunk
+func (r *chunkReader) fetchCopies(copies [][]*database.Chunk) ([]io.Reader, error) {
+	stored := make([]io.Reader, len(copies))
+	for i, cc := range copies {
+		var err error
+		for _, c := range cc {
+			var got []io.Reader
+			if got, err = r.s.fs.GetFile(r.ctx, []files.ServerMeta{c.Server}, r.username, r.file.BlobID, c.Number); err == nil {
+				stored[i] = got[0]
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
+	return stored, nil
+}
+
+// preferredCopy is the copy of a chunk to read first, one on a server that isn't dead
+func preferredCopy(copies []*database.Chunk) *database.Chunk {
+	for _, c := range copies {
+		if c.Server == nil || c.Server.State != database.ServerDead {
+			return c
+		}
+	}
+	return copies[0]
+}
+
+// decodeChunk decrypts and decompresses a chunk as it was stored
+func (s *Server) decodeChunk(dataKey []byte, blobId uuid.UUID, chunk *database.Chunk, r io.Reader) (io.Reader, error) {
+	if dataKey != nil {
+		var err error
+		if r, err = decryptChunk(dataKey, blobId, chunk.Number, r); err != nil {
+			return nil, err
+		}
+	}
+	return compression.NewReader(compression.Algorithm(chunk.Compression), r)
+}
 
-	var savedTo []uuid.UUID
-	savedTo, err = s.fs.SendFile(servers, username, f, fileId, fileSize)
+func countServers(chunks []*database.Chunk) int {
+	servers := map[uuid.UUID]struct{}{}
+	for _, c := range chunks {
+		servers[c.ServerID] = struct{}{}
+	}
+	return len(servers)
+}
+
+// SaveFile saves file with the content read from f, file.Size bytes, replacing the file with the same name.
+// The content is cut as the chunking policy says and the chunks are sent to the servers in the order of the placement.
+// When there are more chunks than servers, they are sent in batches, a chunk to every server at a time.
+// With fewer active servers than the policy wants the upload fails with ErrNotEnoughServers,
+// unless the policy accepts degraded files, see DegradedAccept.
+// Every chunk is sent to as many servers as the policy has copies, the copies of a chunk go to different servers.
+// Small files are kept in the metadata instead.
+// The metadata is saved when all the chunks are stored, check is called then with the replaced file, see MetaStorage.PutFile.
+// The chunks of a file that isn't saved are left as garbage
+func (s *Server) SaveFile(ctx context.Context, file *database.File, chunking ChunkPolicy, alg compression.Algorithm, f io.Reader, check func(old *database.File) error) (err error) {
+	file.ID = uuid.New()
+	file.BlobID = file.ID
+	hash := sha256.New()
+	f = io.TeeReader(f, hash)
+
+	dataKey, err := s.newFileKey(ctx, file)
 	if err != nil {
-		s.l.WithError(err).Error(ErrSavingFailed)
-		return ErrSavingFailed
+		return err
+	}
+	if chunking.Inline(file.Size) {
+		c, err := s.prepareChunk(ctx, f, file.BlobID, 0, ChunkSpan{Size: file.Size}, dataKey, alg)
+		if err != nil {
+			return err
+		}
+		file.Inline, file.InlineData, file.InlineCompression = true, c.data, string(c.compression)
+	} else if layout := chunking.Layout(file.Size); len(layout) > 0 {
+		// an empty file has no chunks, it needs no servers
+		num := chunking.servers(len(layout))
+		least := num
+		if chunking.Degraded == DegradedAccept {
+			least = 1
+		}
+		// the chunks and their copies are spread evenly over the servers
+		load := reservation{
+			chunks: ceilDiv(int64(len(layout)*chunking.Copies()), int64(num)),
+			bytes:  ceilDiv(file.Size*int64(chunking.Copies()), int64(num)),
+		}
+		servers, release, err := s.getServers(ctx, file.BlobID, num, least, load, nil)
+		if err != nil {
+			s.logger(ctx).WithError(err).Error(ErrCantGetServers)
+			switch {
+			case errors.Is(err, ErrSpreadNotMet):
+				return ErrSpreadNotMet
+			case errors.Is(err, ErrNotEnoughServers):
+				return ErrNotEnoughServers
+			}
+			return ErrCantGetServers
+		}
+		defer release()
+		defer func() {
+			if err != nil {
+				s.addGarbage(ctx, file, servers)
+			}
+		}()
+		copies := chunking.Copies()
+		if len(servers) < num {
+			// the copies of a chunk still go to different servers, the repair adds the missing ones later
+			file.Degraded, copies = true, min(copies, len(servers))
+			s.logger(ctx).WithFields(log.Fields{"servers": len(servers), "wanted": num}).Warning("file is stored degraded")
+		}
+		file.ChunkCount = len(layout)
+		for first := 0; first < len(layout); first += len(servers) {
+			batch := layout[first:min(first+len(servers), len(layout))]
+			chunks, err := s.saveChunks(ctx, file.User, file.BlobID, servers, copies, uint(first), batch, dataKey, alg, f)
+			if err != nil {
+				return err
+			}
+			file.Chunks = append(file.Chunks, chunks...)
+		}
+	}
+	file.ETag = hex.EncodeToString(hash.Sum(nil))
+
+	if _, err = s.ms.PutFile(file, check); err != nil {
+		if isQuotaError(err) || errors.Is(err, ErrPreconditionFailed) || errors.Is(err, database.ErrObjectLocked) {
+			return err
+		}
+		s.logger(ctx).WithError(err).Error(ErrCantSaveFile)
+		return ErrCantSaveFile
 	}
-	for i, u := range savedTo {
-		_, err = s.ms.SaveChunk(fileId, u, uint(i))
+	s.emit()
+	return nil
+}
+
+// DeleteFile removes the file, check is called with it before, see MetaStorage.DeleteFile
+func (s *Server) DeleteFile(ctx context.Context, username, dir, filename string, check func(old *database.File) error) error {
+	_, err := s.ms.DeleteFile(username, dir, filename, check)
+	switch {
+	case err == nil:
+		s.emit()
+		return nil
+	case errors.Is(err, database.ErrRecordNotFound):
+		return ErrFileNotFound
+	case errors.Is(err, ErrPreconditionFailed) || errors.Is(err, database.ErrObjectLocked):
+		return err
+	default:
+		s.logger(ctx).WithError(err).Error(ErrCantRemoveFile)
+		return ErrCantRemoveFile
+	}
+}
+
+// CopyFile copies the file to toDir and toName without reading it, the copy shares the chunks of the file.
+// check is called with the file the copy replaces, see MetaStorage.PutFile
+func (s *Server) CopyFile(ctx context.Context, username, dir, filename, toDir, toName string, check func(old *database.File) error) (*database.File, error) {
+	file, err := s.ms.CopyFile(username, dir, filename, toDir, toName, check)
+	if err == nil {
+		s.emit()
+	}
+	return file, s.relinkError(ctx, err)
+}
+
+// MoveFile renames the file, only its record changes. check works as in CopyFile
+func (s *Server) MoveFile(ctx context.Context, username, dir, filename, toDir, toName string, check func(old *database.File) error) (*database.File, error) {
+	file, err := s.ms.MoveFile(username, dir, filename, toDir, toName, check)
+	if err == nil && (dir != toDir || filename != toName) {
+		s.emit()
+	}
+	return file, s.relinkError(ctx, err)
+}
+
+func (s *Server) relinkError(ctx context.Context, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, database.ErrRecordNotFound):
+		return ErrFileNotFound
+	case isQuotaError(err) || errors.Is(err, ErrPreconditionFailed) || errors.Is(err, database.ErrObjectLocked):
+		return err
+	default:
+		s.logger(ctx).WithError(err).Error(ErrCantSaveFile)
+		return ErrCantSaveFile
+	}
+}
+
+// saveChunks reads the spans of the file, copy k of chunk first+i is sent to servers[(i+k)%len(servers)]
+func (s *Server) saveChunks(
+	ctx context.Context,
+	username string,
+	blobId uuid.UUID,
+	servers []files.ServerMeta,
+	copies int,
+	first uint,
+	spans []ChunkSpan,
+	dataKey []byte,
+	alg compression.Algorithm,
+	f io.Reader,
+) ([]*database.Chunk, error) {
+	chunks := make([]*preparedChunk, len(spans))
+	stored := make([][]byte, len(spans))
+	for i, span := range spans {
+		c, err := s.prepareChunk(ctx, f, blobId, first+uint(i), span, dataKey, alg)
 		if err != nil {
-			_ = s.removeFile(fileId, err)
+			return nil, err
 		}
+		chunks[i], stored[i] = c, c.data
+	}
+
+	savedTo := make([][]uuid.UUID, copies)
+	eg, egCtx := errgroup.WithContext(ctx)
+	for k := range savedTo {
+		to := make([]files.ServerMeta, len(spans))
+		for i := range to {
+			to[i] = servers[(i+k)%len(servers)]
+		}
+		eg.Go(func() (err error) {
+			savedTo[k], err = s.fs.SendFile(egCtx, to, username, blobId, first, stored)
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		s.logger(ctx).WithError(err).Error(ErrSavingFailed)
+		return nil, ErrSavingFailed
+	}
+	saved := make([]*database.Chunk, 0, len(spans)*copies)
+	for i := range spans {
+		for k := range savedTo {
+			saved = append(saved, &database.Chunk{
+				ServerID:    savedTo[k][i],
+				Number:      first + uint(i),
+				Compression: string(chunks[i].compression),
+				Offset:      spans[i].Offset,
+				Size:        spans[i].Size,
+				StoredSize:  int64(len(chunks[i].data)),
+			})
+		}
+	}
+	return saved, nil
+}
+
+// CheckQuota checks if the user can upload a file of the declared size, before the file is received.
+// replaced is the file the upload overwrites, nil for a new one
+func (s *Server) CheckQuota(ctx context.Context, username, dir string, size int64, replaced *database.File) error {
+	bytes, objects := size, int64(1)
+	if replaced != nil {
+		bytes, objects = size-replaced.Size, 0
+	}
+	err := s.ms.CheckQuota(username, dir, bytes, objects)
+	if err != nil && !isQuotaError(err) {
+		s.logger(ctx).WithError(err).Error(ErrCantSaveFile)
+		return ErrCantSaveFile
 	}
 	return err
 }
 
-func (s *Server) getServers(num int) ([]files.ServerMeta, error) {
-	serversTemp, err := s.ms.GetLeastLoadedServers(num)
+func isQuotaError(err error) bool {
+	return errors.Is(err, database.ErrBytesQuotaExceeded) || errors.Is(err, database.ErrObjectsQuotaExceeded)
+}
+
+type preparedChunk struct {
+	data        []byte
+	compression compression.Algorithm
+}
+
+// prepareChunk reads the next span of the file and turns it into a chunk as it's stored.
+// Each chunk is compressed and sealed separately, so it can be read back without its neighbours
+func (s *Server) prepareChunk(ctx context.Context, f io.Reader, blobId uuid.UUID, number uint, span ChunkSpan, dataKey []byte, alg compression.Algorithm) (*preparedChunk, error) {
+	l := s.logger(ctx).WithField("chunk", number)
+	buf := &bytes.Buffer{}
+	if _, err := io.CopyN(buf, f, span.Size); err != nil {
+		l.WithError(err).Error(ErrCantReadFile)
+		return nil, ErrCantReadFile
+	}
+	data, applied, err := compression.Compress(alg, buf.Bytes())
+	if err != nil {
+		l.WithError(err).Error(ErrSavingFailed)
+		return nil, fmt.Errorf("%w: %w", ErrSavingFailed, err)
+	}
+	if dataKey != nil {
+		if data, err = encryption.SealChunk(dataKey, blobId, number, data); err != nil {
+			l.WithError(err).Error(ErrSavingFailed)
+			return nil, ErrSavingFailed
+		}
+	}
+	return &preparedChunk{data: data, compression: applied}, nil
+}
+
+// newFileKey generates a data key for the file and keeps it wrapped on the file, it returns nil if encryption is disabled
+func (s *Server) newFileKey(ctx context.Context, file *database.File) ([]byte, error) {
+	if s.keys == nil {
+		return nil, nil
+	}
+	dataKey, keyID, wrapped, err := s.keys.NewDataKey()
+	if err != nil {
+		s.logger(ctx).WithError(err).Error(ErrCantGetFileKey)
+		return nil, ErrCantGetFileKey
+	}
+	file.KeyID, file.WrappedKey = keyID, wrapped
+	return dataKey, nil
+}
+
+// fileKey returns the unwrapped data key of the file, or nil if the file isn't encrypted
+func (s *Server) fileKey(ctx context.Context, file *database.File) ([]byte, error) {
+	if file.KeyID == "" {
+		return nil, nil
+	}
+	if s.keys == nil {
+		s.logger(ctx).WithField("key_id", file.KeyID).Error(ErrEncryptionDisabled)
+		return nil, ErrCantGetFileKey
+	}
+	dataKey, err := s.keys.Unwrap(file.KeyID, file.WrappedKey)
+	if err != nil {
+		s.logger(ctx).WithError(err).WithField("key_id", file.KeyID).Error(ErrCantGetFileKey)
+		return nil, ErrCantGetFileKey
+	}
+	return dataKey, nil
+}
+
+func decryptChunk(dataKey []byte, blobId uuid.UUID, number uint, r io.Reader) (io.Reader, error) {
+	sealed, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	data, err := encryption.OpenChunk(dataKey, blobId, number, sealed)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// RotateKeys reloads the master keys and re-wraps every data key with the current one.
+// Chunks stay as they are, only the wrapped keys in the metadata change
+func (s *Server) RotateKeys(ctx context.Context) (string, int, error) {
+	if s.keys == nil {
+		return "", 0, ErrEncryptionDisabled
+	}
+	if err := s.keys.Reload(); err != nil {
+		s.logger(ctx).WithError(err).Error(ErrCantRotateKeys)
+		return "", 0, ErrCantRotateKeys
+	}
+	current := s.keys.CurrentID()
+	n, err := s.ms.RewrapFileKeys(current, s.keys.Rewrap)
+	if err != nil {
+		s.logger(ctx).WithError(err).WithField("rewrapped", n).Error(ErrCantRotateKeys)
+		return current, n, ErrCantRotateKeys
+	}
+	s.logger(ctx).WithFields(log.Fields{"key_id": current, "rewrapped": n}).Info("keys rotated")
+	return current, n, nil
+}
+
+// logger returns the logger of the request, so log lines can be matched with the storage servers ones
+func (s *Server) logger(ctx context.Context) *log.Entry {
+	return tracing.Logger(ctx, s.l)
+}
+
+// getServers takes num active servers for new chunks of the blob in the order of the placement, no fewer than least when there aren't enough.
+// They are spread over the failure domains apart from the kept servers, the excluded servers aren't taken.
+// The load is reserved on every server taken until the returned func is called, the placement counts it as kept by the server
+func (s *Server) getServers(ctx context.Context, blobID uuid.UUID, num, least int, load reservation, kept []*database.Server, exclude ...uuid.UUID) ([]files.ServerMeta, func(), error) {
+	if num == 0 {
+		return nil, func() {}, nil
+	}
+	// the load is read under the lock, an upload released between the read and the lock would be counted nowhere
+	s.placing.mu.Lock()
+	defer s.placing.mu.Unlock()
+	candidates, err := s.ms.GetActiveServers(exclude...)
+	if err != nil {
+		return nil, nil, err
+	}
+	serversTemp := s.placement.Order(blobID, s.placing.withReserved(candidates))
+	num = min(num, max(least, len(serversTemp)))
+	if s.spread.Domain == "" {
+		if len(serversTemp) < num {
+			return nil, nil, ErrNotEnoughServers
+		}
+		serversTemp = serversTemp[:num]
+	} else {
+		var shared bool
+		if serversTemp, shared, err = s.spread.pick(serversTemp, num, kept); err != nil {
+			return nil, nil, err
+		}
+		if shared {
+			s.logger(ctx).WithFields(log.Fields{"servers": num, "domain": s.spread.Domain}).Warning("chunks share a failure domain")
+		}
+	}
 	servers := make([]files.ServerMeta, len(serversTemp))
 	for i, server := range serversTemp {
 		servers[i] = server
 	}
-	return servers, nil
+	return servers, s.placing.hold(servers, load), nil
 }
 
-func (s *Server) removeFile(fileID uuid.UUID, reason error) error {
-	s.l.WithError(reason).Warning("removing file")
-	if err := s.ms.RemoveFile(fileID); err != nil {
-		s.l.WithError(err).Errorf("can't remove chunks")
-		return err
-	}
-	return nil
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
 }
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/compression"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/storage/encryption"
+)
+
+func getLogger() *log.Entry {
+	logger := log.New()
+	logger.SetLevel(log.FatalLevel)
+	return logger.WithField("in_test", true)
+}
+
+func newKeyring(t *testing.T) *encryption.Keyring {
+	p := path.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(p, []byte("key1 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"), 0600); err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	keys, err := encryption.LoadKeyring(p)
+	if err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	return keys
+}
+
+func TestServer_SaveFileInline(t *testing.T) {
+	chunking := ChunkPolicy{Servers: 3, MinSize: 1, MaxSize: 1000, InlineSize: 1000}
+	content := bytes.Repeat([]byte("inline "), 100)
+	for _, keys := range []*encryption.Keyring{nil, newKeyring(t)} {
+		ms := newFakeMeta()
+		// no storage server is asked, a call to the file storage would panic
+		s := NewServer(ms, nil, nil, keys, LeastLoaded{}, Spread{}, getLogger())
+		ctx := context.Background()
+		assert.NoError(t, s.SaveFile(ctx, &database.File{User: "user", Dir: "dir", Name: "small", Size: int64(len(content))}, chunking, compression.Gzip, bytes.NewReader(content), nil))
+
+		saved, err := ms.GetFile("user", "dir", "small")
+		if assert.NoError(t, err) {
+			assert.True(t, saved.Inline)
+			assert.Empty(t, saved.Chunks)
+			assert.Equal(t, string(compression.Gzip), saved.InlineCompression)
+			assert.NotContains(t, string(saved.InlineData), "inline", "the content is compressed")
+			assert.Equal(t, keys != nil, saved.KeyID != "")
+		}
+		r, err := s.OpenFile(ctx, saved)
+		if assert.NoError(t, err) {
+			got, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, content, got)
+		}
+	}
+}
+
+func TestServer_SaveFileDegraded(t *testing.T) {
+	content := bytes.Repeat([]byte("degraded"), 5)
+	tests := []struct {
+		name     string
+		active   int
+		replicas int
+		policy   string
+
+		wantErr      error
+		wantDegraded bool
+		wantCopies   int
+	}{
+		{name: "enough servers", active: 4, policy: DegradedReject, wantCopies: 1},
+		{name: "rejected", active: 2, policy: DegradedReject, wantErr: ErrNotEnoughServers},
+		{name: "accepted", active: 2, policy: DegradedAccept, wantDegraded: true, wantCopies: 1},
+		{name: "accepted with copies", active: 2, replicas: 2, policy: DegradedAccept, wantDegraded: true, wantCopies: 2},
+		{name: "fewer servers than copies", active: 1, replicas: 2, policy: DegradedAccept, wantDegraded: true, wantCopies: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms, fs := newFakeMeta(), newFakeFiles()
+			ms.servers = newServers(tt.active)
+			s := NewServer(ms, fs, nil, nil, LeastLoaded{}, Spread{}, getLogger())
+			chunking := ChunkPolicy{Servers: 4, MinSize: 1, Replicas: tt.replicas, Degraded: tt.policy}
+			file := &database.File{User: "user", Dir: "dir", Name: "file", Size: int64(len(content))}
+			err := s.SaveFile(context.Background(), file, chunking, compression.None, bytes.NewReader(content), nil)
+			assert.ErrorIs(t, err, tt.wantErr)
+
+			saved, getErr := ms.GetFile("user", "dir", "file")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, getErr, database.ErrRecordNotFound)
+				assert.Empty(t, fs.sent, "no chunk is sent")
+				return
+			}
+			if assert.NoError(t, getErr) {
+				assert.Equal(t, tt.wantDegraded, saved.Degraded)
+				assert.Equal(t, 4, saved.ChunkCount)
+				holders := map[uint][]uuid.UUID{}
+				for _, c := range saved.Chunks {
+					assert.NotContains(t, holders[c.Number], c.ServerID, "the copies of a chunk go to different servers")
+					holders[c.Number] = append(holders[c.Number], c.ServerID)
+				}
+				for number := uint(0); number < 4; number++ {
+					assert.Len(t, holders[number], tt.wantCopies, "chunk %d", number)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+const (
+	SpreadStrict     = "strict"
+	SpreadBestEffort = "best-effort"
+)
+
+var (
+	ErrSpreadNotMet     = errors.New("not enough failure domains to spread the chunks")
+	ErrNotEnoughServers = errors.New("not enough active storage servers")
+)
+
+// Spread decides how the servers of a file are spread over the failure domains
+type Spread struct {
+	// Domain is the level of the failure domains, see database.Server.Domain. Empty doesn't spread the servers
+	Domain string
+	// Policy is what happens when there are fewer domains than servers needed:
+	// SpreadStrict fails, SpreadBestEffort takes several servers from a domain, the domains used the least first
+	Policy string
+}
+
+// ParseSpread reads the spread from the level of the failure domains and the policy, the policy is SpreadBestEffort by default
+func ParseSpread(domain, policy string) (Spread, error) {
+	switch domain {
+	case "", database.DomainZone, database.DomainRack, database.DomainHost:
+	default:
+		return Spread{}, fmt.Errorf("unknown failure domain %q, must be zone, rack, host or empty", domain)
+	}
+	switch policy {
+	case "":
+		policy = SpreadBestEffort
+	case SpreadStrict, SpreadBestEffort:
+	default:
+		return Spread{}, fmt.Errorf("unknown spread policy %q, must be %s or %s", policy, SpreadStrict, SpreadBestEffort)
+	}
+	return Spread{Domain: domain, Policy: policy}, nil
+}
+
+// pick takes num servers from the candidates in their order, each from a domain none of the kept servers and the other picked ones are in.
+// When no such domain is left the domains used the least are taken again, pick tells if it happened
+func (sp Spread) pick(candidates []*database.Server, num int, kept []*database.Server) ([]*database.Server, bool, error) {
+	used := map[string]int{}
+	for _, server := range kept {
+		used[server.Domain(sp.Domain)]++
+	}
+	picked := make([]*database.Server, 0, num)
+	taken := map[uuid.UUID]bool{}
+	shared := false
+	for round := 0; len(picked) < num; round++ {
+		if len(picked) == len(candidates) {
+			return nil, shared, ErrNotEnoughServers
+		}
+		for _, server := range candidates {
+			domain := server.Domain(sp.Domain)
+			if len(picked) == num || taken[server.ID] || used[domain] > round {
+				continue
+			}
+			if used[domain] > 0 {
+				if sp.Policy == SpreadStrict {
+					return nil, true, fmt.Errorf("%w: %d servers needed, %d %s domains available", ErrSpreadNotMet, num+len(kept), len(used), sp.Domain)
+				}
+				shared = true
+			}
+			picked = append(picked, server)
+			taken[server.ID] = true
+			used[domain]++
+		}
+	}
+	return picked, shared, nil
+}
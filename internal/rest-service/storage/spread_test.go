@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+)
+
+func TestSpread_pick(t *testing.T) {
+	// the candidates are ordered by load, two racks have three servers and one has a single one
+	var candidates []*database.Server
+	for i, rack := range []string{"r1", "r1", "r2", "r1", "r2", "r2", "r3"} {
+		candidates = append(candidates, &database.Server{ID: uuid.New(), Name: fmt.Sprintf("s%d", i), Topology: database.Topology{Zone: "eu", Rack: rack}})
+	}
+	tests := []struct {
+		name       string
+		spread     Spread
+		num        int
+		kept       []*database.Server
+		want       []string
+		wantShared bool
+		wantErr    error
+	}{
+		{name: "a single zone", spread: Spread{Domain: database.DomainZone}, num: 3,
+			want: []string{"s0", "s1", "s2"}, wantShared: true},
+		{name: "a server per rack", spread: Spread{Domain: database.DomainRack, Policy: SpreadStrict}, num: 3,
+			want: []string{"s0", "s2", "s6"}},
+		{name: "racks shared evenly", spread: Spread{Domain: database.DomainRack, Policy: SpreadBestEffort}, num: 5,
+			want: []string{"s0", "s2", "s6", "s1", "s4"}, wantShared: true},
+		{name: "not enough racks", spread: Spread{Domain: database.DomainRack, Policy: SpreadStrict}, num: 4,
+			wantShared: true, wantErr: ErrSpreadNotMet},
+		{name: "away from the kept copy", spread: Spread{Domain: database.DomainRack, Policy: SpreadStrict}, num: 2,
+			kept: candidates[6:], want: []string{"s0", "s2"}},
+		{name: "kept copy in every rack", spread: Spread{Domain: database.DomainRack, Policy: SpreadStrict}, num: 1,
+			kept: []*database.Server{candidates[0], candidates[2], candidates[6]}, wantShared: true, wantErr: ErrSpreadNotMet},
+		{name: "not enough servers", spread: Spread{Domain: database.DomainHost, Policy: SpreadBestEffort}, num: 8,
+			wantErr: ErrNotEnoughServers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, shared, err := tt.spread.pick(candidates, tt.num, tt.kept)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantShared, shared)
+			var names []string
+			for _, server := range got {
+				names = append(names, server.Name)
+			}
+			assert.Equal(t, tt.want, names)
+		})
+	}
+}
+
+func TestParseSpread(t *testing.T) {
+	spread, err := ParseSpread(database.DomainRack, "")
+	assert.NoError(t, err)
+	assert.Equal(t, Spread{Domain: database.DomainRack, Policy: SpreadBestEffort}, spread)
+	_, err = ParseSpread("row", SpreadStrict)
+	assert.Error(t, err)
+	_, err = ParseSpread(database.DomainZone, "loose")
+	assert.Error(t, err)
+}
@@ -0,0 +1,134 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// HeaderSignature is "sha256=" and the hex HMAC-SHA256 of the request body with the webhook secret
+	HeaderSignature = "X-Webhook-Signature"
+	// HeaderEventID is the same for every attempt of an event, a receiver can drop a repeated one
+	HeaderEventID = "X-Webhook-Id"
+
+	timeout = 10 * time.Second
+)
+
+var (
+	ErrDeliveryFailed  = errors.New("webhook delivery failed")
+	ErrForbiddenTarget = errors.New("webhook target is an internal address")
+)
+
+// Sign returns the signature of the body sent in HeaderSignature
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Targets tells where the webhooks can be sent: to public addresses and to the allowed hosts.
+// Loopback, link-local, private and other internal addresses are rejected so a user can't reach the internal network
+type Targets struct {
+	allowed map[string]bool
+}
+
+func NewTargets(allowedHosts ...string) *Targets {
+	t := &Targets{allowed: map[string]bool{}}
+	for _, h := range allowedHosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			t.allowed[h] = true
+		}
+	}
+	return t
+}
+
+// CheckURL rejects a url whose host is localhost or an internal ip, unless the host is allowed.
+// A name that resolves to an internal address is rejected when the webhook is sent
+func (t *Targets) CheckURL(u *url.URL) error {
+	host := strings.ToLower(u.Hostname())
+	if t.allowed[host] {
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s", ErrForbiddenTarget, host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !public(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenTarget, host)
+	}
+	return nil
+}
+
+// dial connects to an allowed host as is, to any other host only if it resolves to a public address
+func (t *Targets) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if host, _, err := net.SplitHostPort(address); err != nil || !t.allowed[strings.ToLower(host)] {
+		d.Control = checkAddress
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// checkAddress is called with the resolved address before connecting
+func checkAddress(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrForbiddenTarget, err)
+	}
+	if !public(ap.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenTarget, ap.Addr())
+	}
+	return nil
+}
+
+func public(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// Sender posts events to webhooks, it connects only to the Targets
+type Sender struct {
+	c *http.Client
+}
+
+func NewSender(targets *Targets) *Sender {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would connect to the target instead of the checked dialer
+	transport.Proxy = nil
+	transport.DialContext = targets.dial
+	return &Sender{c: &http.Client{Timeout: timeout, Transport: transport}}
+}
+
+// Send posts the event body to the url, a webhook accepts it with any 2xx status
+func (s *Sender) Send(ctx context.Context, url, secret, eventID string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDeliveryFailed, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderSignature, Sign(secret, body))
+	req.Header.Set(HeaderEventID, eventID)
+
+	res, err := s.c.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDeliveryFailed, err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%w: status %d", ErrDeliveryFailed, res.StatusCode)
+	}
+	return nil
+}
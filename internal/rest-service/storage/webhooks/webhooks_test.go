@@ -0,0 +1,78 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSender_Send(t *testing.T) {
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(HeaderSignature) != Sign("secret", body) || r.Header.Get(HeaderEventID) != "event" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	// the test server listens on the loopback
+	s := NewSender(NewTargets("127.0.0.1"))
+	assert.NoError(t, s.Send(context.Background(), srv.URL, "secret", "event", []byte(`{"type":"ObjectCreated"}`)))
+	assert.ErrorIs(t, s.Send(context.Background(), srv.URL, "other", "event", []byte(`{}`)), ErrDeliveryFailed)
+	status = http.StatusInternalServerError
+	assert.ErrorIs(t, s.Send(context.Background(), srv.URL, "secret", "event", []byte(`{}`)), ErrDeliveryFailed)
+	assert.ErrorIs(t, s.Send(context.Background(), "http://127.0.0.1:1", "secret", "event", []byte(`{}`)), ErrDeliveryFailed)
+
+	status = http.StatusNoContent
+	err := NewSender(NewTargets()).Send(context.Background(), srv.URL, "secret", "event", []byte(`{}`))
+	assert.ErrorIs(t, err, ErrDeliveryFailed)
+	assert.ErrorIs(t, err, ErrForbiddenTarget)
+	u, _ := url.Parse(srv.URL)
+	err = NewSender(NewTargets()).Send(context.Background(), "http://localhost:"+u.Port(), "secret", "event", []byte(`{}`))
+	assert.ErrorIs(t, err, ErrForbiddenTarget, "a name is checked once it's resolved")
+}
+
+func TestTargets_CheckURL(t *testing.T) {
+	targets := NewTargets("hooks.internal", "10.0.0.5")
+	tests := []struct {
+		url     string
+		wantErr error
+	}{
+		{url: "https://ci.example.com/hook"},
+		{url: "http://93.184.216.34:8080/hook"},
+		{url: "http://hooks.internal/hook"},
+		{url: "http://10.0.0.5/hook"},
+		{url: "http://10.0.0.6/hook", wantErr: ErrForbiddenTarget},
+		{url: "http://localhost:9000", wantErr: ErrForbiddenTarget},
+		{url: "http://api.localhost", wantErr: ErrForbiddenTarget},
+		{url: "http://127.0.0.1", wantErr: ErrForbiddenTarget},
+		{url: "http://[::1]:80", wantErr: ErrForbiddenTarget},
+		{url: "http://169.254.169.254/latest/meta-data", wantErr: ErrForbiddenTarget},
+		{url: "http://192.168.1.1", wantErr: ErrForbiddenTarget},
+		{url: "http://[::ffff:172.16.0.1]", wantErr: ErrForbiddenTarget},
+		{url: "http://0.0.0.0", wantErr: ErrForbiddenTarget},
+		{url: "http://[fe80::1]", wantErr: ErrForbiddenTarget},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatalf("can't prepare test: %s", err)
+			}
+			assert.ErrorIs(t, targets.CheckURL(u), tt.wantErr)
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '{}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=77325902caca812dc259733aacd046b73817372c777b8d95b402647474516e13", Sign("secret", []byte(`{}`)))
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxDeleteFiles limits a delete request, the rest-service sends fewer
+const maxDeleteFiles = 10000
+
+var errBadDeleteRequest = errors.New("can't read the files to delete")
+
+// deleteFile names a file to remove, with ChunkId only the chunk of the file is removed
+type deleteFile struct {
+	Username string `json:"username"`
+	FileId   string `json:"file_id"`
+	ChunkId  string `json:"chunk_id,omitempty"`
+}
+
+type deleteRequest struct {
+	Files []*deleteFile `json:"files"`
+}
+
+// deleteResponse counts the removed files, the locked ones are kept and listed
+type deleteResponse struct {
+	Removed int           `json:"removed"`
+	Locked  []*deleteFile `json:"locked"`
+}
+
+// readDeleteRequest returns the dirs of the files to remove, every file keeps its chunks in a dir.
+// A single chunk is named by its path in the dir
+func readDeleteRequest(r *http.Request) ([]string, error) {
+	req := &deleteRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || len(req.Files) > maxDeleteFiles {
+		return nil, errBadDeleteRequest
+	}
+	paths := make([]string, len(req.Files))
+	for i, f := range req.Files {
+		if !isPathElement(f.Username) || !isPathElement(f.FileId) {
+			return nil, errBadDeleteRequest
+		}
+		paths[i] = path.Join(f.Username, f.FileId)
+		if f.ChunkId != "" {
+			if !isPathElement(f.ChunkId) {
+				return nil, errBadDeleteRequest
+			}
+			paths[i] = path.Join(paths[i], f.ChunkId)
+		}
+	}
+	return paths, nil
+}
+
+func isPathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
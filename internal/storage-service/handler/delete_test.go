@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDeleteRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr error
+	}{
+		{name: "files", body: `{"files":[{"username":"u","file_id":"f1"},{"username":"u","file_id":"f2"}]}`, want: []string{"u/f1", "u/f2"}},
+		{name: "chunk", body: `{"files":[{"username":"u","file_id":"f1","chunk_id":"3"},{"username":"u","file_id":"f2","chunk_id":""}]}`, want: []string{"u/f1/3", "u/f2"}},
+		{name: "chunk parent dir", body: `{"files":[{"username":"u","file_id":"f1","chunk_id":".."}]}`, wantErr: errBadDeleteRequest},
+		{name: "empty", body: `{"files":[]}`, want: []string{}},
+		{name: "not json", body: `files`, wantErr: errBadDeleteRequest},
+		{name: "no username", body: `{"files":[{"file_id":"f1"}]}`, wantErr: errBadDeleteRequest},
+		{name: "parent dir", body: `{"files":[{"username":"u","file_id":".."}]}`, wantErr: errBadDeleteRequest},
+		{name: "nested path", body: `{"files":[{"username":"u","file_id":"f/../../x"}]}`, wantErr: errBadDeleteRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readDeleteRequest(httptest.NewRequest("POST", "/delete", strings.NewReader(tt.body)))
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -1,28 +1,42 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"path"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/metrics"
+	chunkStorage "github.com/konorlevich/test_task_s3/internal/storage-service/storage"
+	"github.com/konorlevich/test_task_s3/internal/tracing"
 )
 
 const (
 	urlPatternGetChunk  = "GET /object/{username}/{file_id}/{chunk_id}"
 	urlPatternSaveChunk = "POST /object/{username}/{file_id}"
+	// urlPatternDeleteFiles removes files with all their chunks, many at a time
+	urlPatternDeleteFiles = "POST /delete"
+	// urlPatternLockFile keeps the chunks of a file from being removed, see storage.Lock
+	urlPatternLockFile = "PUT /lock/{username}/{file_id}"
 )
 
 type Storage interface {
 	SaveFile(p string, file io.Reader) error
 	GetFile(filePath string) (io.Reader, error)
+	RemoveFile(p string) error
+	LockFile(p string, lock *chunkStorage.Lock) error
+	CheckWritable() error
 }
 
-func NewHandler(storage Storage) *http.ServeMux {
+func NewHandler(storage Storage, l *log.Entry) *http.ServeMux {
 	handler := http.NewServeMux()
 
 	handler.HandleFunc(urlPatternGetChunk, func(rw http.ResponseWriter, r *http.Request) {
-		l := log.New().WithField("client", r.RemoteAddr)
+		l := tracing.Logger(r.Context(), l).WithField("client", r.RemoteAddr)
 		rd, err := newRequestData(r, l)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusBadRequest)
@@ -55,7 +69,7 @@ func NewHandler(storage Storage) *http.ServeMux {
 	})
 
 	handler.HandleFunc(urlPatternSaveChunk, func(rw http.ResponseWriter, r *http.Request) {
-		l := log.New().WithField("client", r.RemoteAddr)
+		l := tracing.Logger(r.Context(), l).WithField("client", r.RemoteAddr)
 		rd, err := newRequestData(r, l)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusBadRequest)
@@ -84,5 +98,71 @@ func NewHandler(storage Storage) *http.ServeMux {
 		_, _ = rw.Write([]byte("chunk saved"))
 	})
 
+	handler.HandleFunc(urlPatternDeleteFiles, func(rw http.ResponseWriter, r *http.Request) {
+		l := tracing.Logger(r.Context(), l).WithField("client", r.RemoteAddr)
+		paths, err := readDeleteRequest(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res := &deleteResponse{Locked: []*deleteFile{}}
+		for _, p := range paths {
+			err := storage.RemoveFile(p)
+			if errors.Is(err, chunkStorage.ErrFileLocked) {
+				l.WithField("file_path", p).Warning("locked file isn't removed")
+				username, rest, _ := strings.Cut(p, "/")
+				fileId, chunkId, _ := strings.Cut(rest, "/")
+				res.Locked = append(res.Locked, &deleteFile{Username: username, FileId: fileId, ChunkId: chunkId})
+				continue
+			}
+			if err != nil {
+				l.WithError(err).WithField("file_path", p).Error("can't remove file")
+				http.Error(rw, "can't remove file", http.StatusInternalServerError)
+				return
+			}
+			res.Removed++
+			l.WithField("file_path", p).Debug("file removed")
+		}
+		l.WithFields(log.Fields{"files": res.Removed, "locked": len(res.Locked)}).Info("files removed")
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(res)
+	})
+
+	handler.HandleFunc(urlPatternLockFile, func(rw http.ResponseWriter, r *http.Request) {
+		username, fileId := r.PathValue(fieldNameUsername), r.PathValue(fieldNameFileId)
+		lock := &chunkStorage.Lock{}
+		if !isPathElement(username) || !isPathElement(fileId) || json.NewDecoder(r.Body).Decode(lock) != nil {
+			http.Error(rw, "can't read the lock", http.StatusBadRequest)
+			return
+		}
+		l := tracing.Logger(r.Context(), l).WithFields(log.Fields{
+			fieldNameUsername: username,
+			fieldNameFileId:   fileId,
+			"retain_until":    lock.RetainUntil,
+			"legal_hold":      lock.LegalHold,
+		})
+		if err := storage.LockFile(path.Join(username, fileId), lock); err != nil {
+			l.WithError(err).Error("can't lock file")
+			http.Error(rw, "can't lock file", http.StatusInternalServerError)
+			return
+		}
+		l.Info("file lock set")
+		rw.WriteHeader(http.StatusNoContent)
+	})
+
+	handler.Handle("GET /metrics", metrics.Handler())
+	handler.HandleFunc("GET /healthz", func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	})
+	// readyz is polled by the rest-service before it places chunks here
+	handler.HandleFunc("GET /readyz", func(rw http.ResponseWriter, r *http.Request) {
+		if err := storage.CheckWritable(); err != nil {
+			tracing.Logger(r.Context(), l).WithError(err).Warning("storage isn't ready")
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte("ready"))
+	})
+
 	return handler
 }
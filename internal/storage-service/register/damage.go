@@ -0,0 +1,54 @@
+package register
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/konorlevich/test_task_s3/internal/storage-service/storage"
+)
+
+const (
+	// damagePath is where the damaged chunks are reported, next to the register url
+	damagePath = "damaged"
+	// headerNodeToken carries the token the rest-service accepts the reports with
+	headerNodeToken = "X-Node-Token"
+)
+
+type damageReport struct {
+	Hostname string            `json:"hostname"`
+	Port     string            `json:"port"`
+	Chunks   []*storage.Damage `json:"chunks"`
+}
+
+// DamageReporter reports the damaged chunks of the server registered with hostName and port,
+// serverUrl is the register url of rest-service, token is the node token it has
+func DamageReporter(serverUrl *url.URL, hostName, port, token string) storage.DamageReporter {
+	reportUrl := serverUrl.ResolveReference(&url.URL{Path: damagePath})
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(ctx context.Context, damaged []*storage.Damage) error {
+		body, err := json.Marshal(&damageReport{Hostname: hostName, Port: port, Chunks: damaged})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, reportUrl.String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(headerNodeToken, token)
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("returned status code: %d", res.StatusCode)
+		}
+		return nil
+	}
+}
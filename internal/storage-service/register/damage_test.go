@@ -0,0 +1,67 @@
+package register
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/handler"
+	"github.com/konorlevich/test_task_s3/internal/rest-service/handler/middleware"
+	"github.com/konorlevich/test_task_s3/internal/storage-service/storage"
+)
+
+type mockDamageRegistry struct {
+	server string
+	chunks []*database.DamagedChunk
+}
+
+func (m *mockDamageRegistry) AddDamagedChunks(name, port string, chunks []*database.DamagedChunk) (int, error) {
+	if name != "somename" {
+		return 0, database.ErrRecordNotFound
+	}
+	m.server = name + ":" + port
+	m.chunks = append(m.chunks, chunks...)
+	return len(chunks), nil
+}
+
+func (m *mockDamageRegistry) GetDamagedChunks(int) ([]*database.DamagedChunk, error) {
+	return m.chunks, nil
+}
+
+func TestDamageReporter(t *testing.T) {
+	registry := &mockDamageRegistry{}
+	testHandler := http.NewServeMux()
+	testHandler.Handle("POST /storage/damaged", middleware.CheckNode("token", http.HandlerFunc(handler.ReportDamage(registry, log.NewEntry(log.New())))))
+	server := httptest.NewServer(testHandler)
+	defer server.Close()
+	registerUrl, _ := url.Parse(server.URL + "/storage/register")
+
+	blobID := uuid.New()
+	damaged := []*storage.Damage{
+		{Username: "user", FileId: blobID.String(), ChunkId: "2", Reason: storage.DamageCorrupt},
+		{Username: "user", FileId: blobID.String(), ChunkId: "0", Reason: storage.DamageMissing},
+	}
+	assert.NoError(t, DamageReporter(registerUrl, "somename", "8080", "token")(context.Background(), damaged))
+	assert.Equal(t, "somename:8080", registry.server)
+	assert.Equal(t, []*database.DamagedChunk{
+		{User: "user", BlobID: blobID, Number: 2, Reason: database.DamageCorrupt},
+		{User: "user", BlobID: blobID, Number: 0, Reason: database.DamageMissing},
+	}, registry.chunks)
+
+	assert.Error(t, DamageReporter(registerUrl, "unknown", "8080", "token")(context.Background(), damaged))
+	bad := []*storage.Damage{{Username: "user", FileId: "file", ChunkId: "0", Reason: storage.DamageCorrupt}}
+	assert.Error(t, DamageReporter(registerUrl, "somename", "8080", "token")(context.Background(), bad))
+
+	// a report without the node token isn't recorded
+	registry.chunks = nil
+	assert.Error(t, DamageReporter(registerUrl, "somename", "8080", "")(context.Background(), damaged))
+	assert.Error(t, DamageReporter(registerUrl, "somename", "8080", "other")(context.Background(), damaged))
+	assert.Empty(t, registry.chunks)
+}
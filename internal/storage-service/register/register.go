@@ -10,9 +10,19 @@ import (
 const (
 	formParamHostname = "hostname"
 	formParamPort     = "port"
+	formParamZone     = "zone"
+	formParamRack     = "rack"
+	formParamHost     = "host"
 )
 
-func Register(serverUrl *url.URL, hostName, port string) error {
+// Topology places the server in the failure domains, the chunks of a file are spread over them
+type Topology struct {
+	Zone string
+	Rack string
+	Host string
+}
+
+func Register(serverUrl *url.URL, hostName, port string, topology Topology) error {
 	if serverUrl == nil {
 		return fmt.Errorf("register server url is empty")
 	}
@@ -23,6 +33,11 @@ func Register(serverUrl *url.URL, hostName, port string) error {
 	if port != "" {
 		vals.Add(formParamPort, port)
 	}
+	for param, label := range map[string]string{formParamZone: topology.Zone, formParamRack: topology.Rack, formParamHost: topology.Host} {
+		if label != "" {
+			vals.Add(param, label)
+		}
+	}
 	res, err := (&http.Client{Timeout: 5 * time.Second}).
 		PostForm(
 			serverUrl.String(),
@@ -11,27 +11,31 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 
+	"github.com/konorlevich/test_task_s3/internal/rest-service/database"
 	"github.com/konorlevich/test_task_s3/internal/rest-service/handler"
 )
 
 type mockServerRegistry struct {
 	saved       map[string]string
+	topology    map[string]database.Topology
 	returnError error
 }
 
 func newMockServerRegistry() *mockServerRegistry {
-	return &mockServerRegistry{saved: make(map[string]string)}
+	return &mockServerRegistry{saved: make(map[string]string), topology: make(map[string]database.Topology)}
 }
 
 func newMockServerRegistryReturnError() *mockServerRegistry {
 	return &mockServerRegistry{
 		saved:       make(map[string]string),
+		topology:    make(map[string]database.Topology),
 		returnError: errors.New("mock error"),
 	}
 }
 
-func (m *mockServerRegistry) AddServer(name, port string) (uuid.UUID, error) {
+func (m *mockServerRegistry) AddServer(name, port string, topology database.Topology) (uuid.UUID, error) {
 	m.saved[name] = port
+	m.topology[name] = topology
 	return uuid.New(), m.returnError
 }
 
@@ -39,6 +43,7 @@ func TestRegister(t *testing.T) {
 	type data struct {
 		Hostname string
 		Port     string
+		Topology Topology
 	}
 
 	unexistingUrl, _ := url.Parse("http://localhost:432342234/test")
@@ -99,6 +104,20 @@ func TestRegister(t *testing.T) {
 				Hostname: "somename",
 			},
 		},
+		{name: "topology",
+			sendData: data{
+				Port:     "8080",
+				Hostname: "somename",
+				Topology: Topology{Zone: "eu", Rack: "r1"},
+			},
+			registry: newMockServerRegistry(),
+			wantErr:  false,
+			wantData: data{
+				Port:     "8080",
+				Hostname: "somename",
+				Topology: Topology{Zone: "eu", Rack: "r1"},
+			},
+		},
 		{name: "registry return error",
 			sendData: data{
 				Port:     "8080",
@@ -126,7 +145,7 @@ func TestRegister(t *testing.T) {
 		}
 		t.Run(tt.name, func(t *testing.T) {
 			t.Run("check error", func(t *testing.T) {
-				if err := Register(tt.url, tt.sendData.Hostname, tt.sendData.Port); (err != nil) != tt.wantErr {
+				if err := Register(tt.url, tt.sendData.Hostname, tt.sendData.Port, tt.sendData.Topology); (err != nil) != tt.wantErr {
 					t.Errorf("Register() error = %v, wantErr %v", err, tt.wantErr)
 				}
 			})
@@ -137,6 +156,10 @@ func TestRegister(t *testing.T) {
 				if val, ok := tt.registry.saved[tt.wantData.Hostname]; !ok || val != tt.wantData.Port {
 					t.Errorf("data has not being received:\n%s", cmp.Diff(tt.wantData, data{Port: val}))
 				}
+				want := database.Topology(tt.wantData.Topology)
+				if got := tt.registry.topology[tt.wantData.Hostname]; got != want {
+					t.Errorf("topology has not being received:\n%s", cmp.Diff(want, got))
+				}
 			})
 		})
 	}
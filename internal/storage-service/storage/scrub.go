@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/konorlevich/test_task_s3/internal/throttle"
+)
+
+const (
+	DamageCorrupt = "corrupt"
+	// DamageMissing is a chunk that has a checksum but no data
+	DamageMissing = "missing"
+)
+
+// scrubBatch is how many damaged chunks are reported at a time
+const scrubBatch = 100
+
+var (
+	ErrCantScrub        = errors.New("can't scrub chunks")
+	ErrCantReportDamage = errors.New("can't report damaged chunks")
+)
+
+// Damage is a chunk that doesn't match its checksum or is lost
+type Damage struct {
+	Username string `json:"username"`
+	FileId   string `json:"file_id"`
+	ChunkId  string `json:"chunk_id"`
+	Reason   string `json:"reason"`
+}
+
+// ScrubReport sums up a pass of the scrubber
+type ScrubReport struct {
+	Chunks  int
+	Bytes   int64
+	Damaged int
+}
+
+// DamageReporter sends the damaged chunks to rest-service
+type DamageReporter func(ctx context.Context, damaged []*Damage) error
+
+// RunScrubber scrubs the chunks every interval until ctx is done, see Scrub
+func (s *Storage) RunScrubber(ctx context.Context, interval time.Duration, rate int64, report DamageReporter) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		res, err := s.Scrub(ctx, rate, report)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.l.WithError(err).Error(ErrCantScrub)
+			}
+			continue
+		}
+		s.l.WithFields(log.Fields{
+			"chunks":   res.Chunks,
+			"bytes":    res.Bytes,
+			"damaged":  res.Damaged,
+			"duration": time.Since(start).String(),
+		}).Info("chunks scrubbed")
+	}
+}
+
+// Scrub reads every chunk and compares its sha256 with the checksum saved next to it,
+// the corrupt chunks and the ones lost with their checksums left are sent to report.
+// It reads no more than rate bytes a second, 0 means no limit.
+// A chunk saved before the checksums were kept gets its checksum now
+func (s *Storage) Scrub(ctx context.Context, rate int64, report DamageReporter) (*ScrubReport, error) {
+	res := &ScrubReport{}
+	var damaged []*Damage
+	flush := func() error {
+		if len(damaged) == 0 {
+			return nil
+		}
+		if err := report(ctx, damaged); err != nil {
+			s.l.WithError(err).WithField("damaged", len(damaged)).Error(ErrCantReportDamage)
+			return ErrCantReportDamage
+		}
+		res.Damaged += len(damaged)
+		damaged = damaged[:0]
+		return nil
+	}
+
+	start := time.Now()
+	err := filepath.WalkDir(s.path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// the file is removed while it's scrubbed
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.path, p)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		damage := &Damage{Username: parts[0], FileId: parts[1], ChunkId: parts[2]}
+
+		if name := d.Name(); strings.HasPrefix(name, ".") {
+			if !strings.HasSuffix(name, checksumSuffix) {
+				return nil
+			}
+			damage.ChunkId = strings.TrimSuffix(strings.TrimPrefix(name, "."), checksumSuffix)
+			if s.lost(rel, damage.ChunkId) {
+				damage.Reason = DamageMissing
+			}
+		} else {
+			n, reason, err := s.scrubChunk(rel)
+			if err != nil {
+				return err
+			}
+			res.Chunks++
+			res.Bytes += n
+			damage.Reason = reason
+			throttle.Wait(ctx, start, res.Bytes, rate)
+		}
+		if damage.Reason == "" {
+			return nil
+		}
+		s.l.WithFields(log.Fields{"file_path": rel, "reason": damage.Reason}).Warning("damaged chunk found")
+		damaged = append(damaged, damage)
+		if len(damaged) >= scrubBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	return res, flush()
+}
+
+// scrubChunk checks the chunk at p against its checksum, it returns the size of the chunk and the damage found
+func (s *Storage) scrubChunk(p string) (int64, string, error) {
+	sum, err := os.ReadFile(path.Join(s.path, checksumPath(p)))
+	missingSum := errors.Is(err, fs.ErrNotExist)
+	if err != nil && !missingSum {
+		return 0, "", err
+	}
+	f, err := os.Open(path.Join(s.path, p))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return n, DamageCorrupt, nil
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	if missingSum {
+		if err := s.writeFile(checksumPath(p), strings.NewReader(got)); err != nil {
+			return n, "", err
+		}
+		s.l.WithField("file_path", p).Info("chunk checksum saved")
+		return n, "", nil
+	}
+	if got != strings.TrimSpace(string(sum)) {
+		return n, DamageCorrupt, nil
+	}
+	return n, "", nil
+}
+
+// lost tells if the chunk of the checksum at p is gone while the checksum is still there
+func (s *Storage) lost(p, chunkId string) bool {
+	if _, err := os.Lstat(path.Join(s.path, path.Dir(p), chunkId)); !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	// the file could be removed in the meantime, the checksum goes with it
+	_, err := os.Lstat(path.Join(s.path, p))
+	return err == nil
+}
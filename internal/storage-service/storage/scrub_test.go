@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorage_Scrub(t *testing.T) {
+	s, err := NewStorage(t.TempDir(), DurabilityNone, log.NewEntry(getLogger()))
+	if err != nil {
+		t.Fatalf("can't create storage: %s", err)
+	}
+	for _, p := range []string{"user/file/0", "user/file/1", "user/file/2", "user/other/0"} {
+		if err := s.SaveFile(p, strings.NewReader("chunk "+p)); err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+	}
+	assert.NoError(t, s.LockFile("user/other", &Lock{LegalHold: true}))
+	// a chunk saved before the checksums were kept
+	if err := os.MkdirAll(path.Join(s.path, "user/old"), os.ModePerm); err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	assert.NoError(t, os.WriteFile(path.Join(s.path, "user/old/0"), []byte("old chunk"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(path.Join(s.path, "user/file/1"), []byte("chunk user/file/!"), os.ModePerm))
+	assert.NoError(t, os.Remove(path.Join(s.path, "user/file/2")))
+
+	var got []*Damage
+	report := func(_ context.Context, damaged []*Damage) error {
+		got = append(got, damaged...)
+		return nil
+	}
+	res, err := s.Scrub(context.Background(), 0, report)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Damage{
+		{Username: "user", FileId: "file", ChunkId: "2", Reason: DamageMissing},
+		{Username: "user", FileId: "file", ChunkId: "1", Reason: DamageCorrupt},
+	}, got)
+	assert.Equal(t, &ScrubReport{Chunks: 4, Bytes: 61, Damaged: 2}, res)
+	sum, err := os.ReadFile(path.Join(s.path, "user/old/.0"+checksumSuffix))
+	assert.NoError(t, err)
+	assert.Equal(t, "04df0c11c5bb4bcf351b1b026130c20fb723f8da33531a8ffe39a8f2a7348344", string(sum))
+
+	got = nil
+	_, err = s.Scrub(context.Background(), 0, func(context.Context, []*Damage) error { return errors.New("down") })
+	assert.ErrorIs(t, err, ErrCantReportDamage)
+
+	start := time.Now()
+	_, err = s.Scrub(context.Background(), 350, report)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.Len(t, got, 2)
+}
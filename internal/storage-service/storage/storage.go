@@ -1,32 +1,100 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	ErrCantCreateStorage = errors.New("can't create chunk storage dir")
+	ErrCantCleanStorage  = errors.New("can't remove unfinished chunks")
+	ErrUnknownDurability = errors.New("unknown durability mode")
 
 	ErrNothingToSave       = errors.New("empty input file")
 	ErrCantCreateChunkFile = errors.New("can't create chunk file")
 	ErrCantWriteChunkFile  = errors.New("can't write chunk file")
 	ErrCantCloseChunkFile  = errors.New("can't close chunk file")
+	ErrCantSyncChunkFile   = errors.New("can't sync chunk file")
+	ErrCantSyncChunkDir    = errors.New("can't sync chunk dir")
 	ErrCantCreateChunkDir  = errors.New("can't create chunk storage dir")
 
 	ErrIsNotAFile    = errors.New("can't find the chunk")
 	ErrCantFindChunk = errors.New("can't find the chunk")
 	ErrCantReadChunk = errors.New("can't read the chunk file")
+
+	ErrNotWritable = errors.New("chunk storage isn't writable")
+
+	ErrBadPath          = errors.New("bad file path")
+	ErrCantRemoveChunks = errors.New("can't remove file chunks")
+	ErrFileLocked       = errors.New("file is locked")
+	ErrCantLockFile     = errors.New("can't lock file")
+)
+
+// Durability defines how hard SaveFile tries to keep a chunk after a crash
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing to the OS
+	DurabilityNone Durability = iota
+	// DurabilityFile syncs the chunk file before it's renamed into place
+	DurabilityFile
+	// DurabilityFull syncs the chunk file and its dir, so the rename survives a power loss too
+	DurabilityFull
 )
 
+const tempFileSuffix = ".tmp"
+
+// lockFileName keeps the lock of a file in its dir, next to the chunks
+const lockFileName = ".lock"
+
+// checksumSuffix names the file keeping the hex encoded sha256 of a chunk, see checksumPath
+const checksumSuffix = ".sha256"
+
+// checksumPath is the path of the checksum of the chunk at p, it's hidden like the lock
+func checksumPath(p string) string {
+	return path.Join(path.Dir(p), "."+path.Base(p)+checksumSuffix)
+}
+
+// Lock keeps the chunks of a file from being removed before RetainUntil or while LegalHold is set
+type Lock struct {
+	RetainUntil *time.Time `json:"retain_until,omitempty"`
+	LegalHold   bool       `json:"legal_hold"`
+}
+
+func (l *Lock) Active(now time.Time) bool {
+	return l.LegalHold || l.RetainUntil != nil && now.Before(*l.RetainUntil)
+}
+
+func ParseDurability(s string) (Durability, error) {
+	switch s {
+	case "none":
+		return DurabilityNone, nil
+	case "file":
+		return DurabilityFile, nil
+	case "full", "":
+		return DurabilityFull, nil
+	default:
+		return DurabilityFull, fmt.Errorf("%w: %s", ErrUnknownDurability, s)
+	}
+}
+
 type Storage struct {
-	path string
-	l    *log.Entry
+	path       string
+	durability Durability
+	l          *log.Entry
 }
 
 func (s *Storage) GetFile(p string) (io.Reader, error) {
@@ -47,11 +115,20 @@ func (s *Storage) GetFile(p string) (io.Reader, error) {
 	return f, nil
 }
 
+// SaveFile saves the chunk with its checksum next to it, the scrubber checks the chunk against it
 func (s *Storage) SaveFile(p string, file io.Reader) error {
 	if file == nil {
 		return ErrNothingToSave
 	}
+	h := sha256.New()
+	if err := s.writeFile(p, io.TeeReader(file, h)); err != nil {
+		return err
+	}
+	return s.writeFile(checksumPath(p), strings.NewReader(hex.EncodeToString(h.Sum(nil))))
+}
 
+// writeFile writes the file next to its final place and renames it, so readers never see a half-written file
+func (s *Storage) writeFile(p string, file io.Reader) (err error) {
 	chunkFilePath := path.Join(s.path, p)
 	chunkDir := path.Dir(chunkFilePath)
 	if err := os.MkdirAll(chunkDir, fs.ModePerm); err != nil {
@@ -62,11 +139,18 @@ func (s *Storage) SaveFile(p string, file io.Reader) error {
 		return ErrCantCreateChunkDir
 	}
 
-	chunk, err := os.OpenFile(chunkFilePath, os.O_WRONLY|os.O_CREATE, fs.ModePerm)
+	chunk, err := os.CreateTemp(chunkDir, "."+path.Base(chunkFilePath)+".*"+tempFileSuffix)
 	if err != nil {
 		s.l.WithField("chunk_path", chunkFilePath).WithError(err).Error(ErrCantCreateChunkFile)
 		return ErrCantCreateChunkFile
 	}
+	tmpPath := chunk.Name()
+	defer func() {
+		if err != nil {
+			_ = chunk.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
 
 	if n, err := io.Copy(chunk, file); err != nil {
 		s.l.WithError(err).Error(ErrCantWriteChunkFile)
@@ -74,18 +158,151 @@ func (s *Storage) SaveFile(p string, file io.Reader) error {
 	} else {
 		s.l.WithField("size", n).Debug("chunk file written")
 	}
+	if s.durability >= DurabilityFile {
+		if err = chunk.Sync(); err != nil {
+			s.l.WithError(err).Error(ErrCantSyncChunkFile)
+			return ErrCantSyncChunkFile
+		}
+	}
 	if err = chunk.Close(); err != nil {
 		s.l.WithError(err).Error(ErrCantCloseChunkFile)
 		return ErrCantCloseChunkFile
 	}
+	if err = os.Rename(tmpPath, chunkFilePath); err != nil {
+		s.l.WithField("chunk_path", chunkFilePath).WithError(err).Error(ErrCantCreateChunkFile)
+		return ErrCantCreateChunkFile
+	}
+	if s.durability >= DurabilityFull {
+		if err := syncDir(chunkDir); err != nil {
+			s.l.WithField("chunk_dir", chunkDir).WithError(err).Error(ErrCantSyncChunkDir)
+			return ErrCantSyncChunkDir
+		}
+	}
+	return nil
+}
+
+// LockFile sets the lock of the file kept in the dir p, a lock that isn't active is removed
+func (s *Storage) LockFile(p string, lock *Lock) error {
+	if !filepath.IsLocal(p) {
+		return ErrBadPath
+	}
+	lockPath := path.Join(p, lockFileName)
+	if !lock.Active(time.Now()) {
+		if err := os.Remove(path.Join(s.path, lockPath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.l.WithField("file_path", p).WithError(err).Error(ErrCantLockFile)
+			return ErrCantLockFile
+		}
+		return nil
+	}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return ErrCantLockFile
+	}
+	if err := s.writeFile(lockPath, bytes.NewReader(data)); err != nil {
+		return ErrCantLockFile
+	}
 	return nil
 }
 
-func NewStorage(basePath string, l *log.Entry) (*Storage, error) {
+// readLock returns the lock of the file kept in the dir p, an empty one if the file isn't locked
+func (s *Storage) readLock(p string) (*Lock, error) {
+	lock := &Lock{}
+	data, err := os.ReadFile(path.Join(s.path, p, lockFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lock, json.Unmarshal(data, lock)
+}
+
+// RemoveFile removes all the chunks of the file kept in the dir p, a file that isn't here is already removed.
+// A path of a chunk in the dir removes only the chunk with its checksum. A locked file isn't removed, neither are its chunks
+func (s *Storage) RemoveFile(p string) error {
+	if !filepath.IsLocal(p) {
+		return ErrBadPath
+	}
+	dir, remove := p, []string{p}
+	if strings.Count(path.Clean(p), "/") == 2 {
+		dir, remove = path.Dir(p), append(remove, checksumPath(p))
+	}
+	lock, err := s.readLock(dir)
+	if err != nil {
+		s.l.WithField("file_path", p).WithError(err).Error(ErrCantRemoveChunks)
+		return ErrCantRemoveChunks
+	}
+	if lock.Active(time.Now()) {
+		return ErrFileLocked
+	}
+	for _, r := range remove {
+		if err := os.RemoveAll(path.Join(s.path, r)); err != nil {
+			s.l.WithField("file_path", p).WithError(err).Error(ErrCantRemoveChunks)
+			return ErrCantRemoveChunks
+		}
+	}
+	return nil
+}
+
+// CheckWritable writes and removes a probe file, so a full or read-only disk is noticed before chunks fail
+func (s *Storage) CheckWritable() error {
+	f, err := os.CreateTemp(s.path, ".probe.*"+tempFileSuffix)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotWritable, err)
+	}
+	_, err = f.Write([]byte("probe"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotWritable, err)
+	}
+	return nil
+}
+
+// syncDir makes a rename in the dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeTempFiles removes chunks that were being written when the service stopped
+func (s *Storage) removeTempFiles() error {
+	return filepath.WalkDir(s.path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && strings.HasSuffix(d.Name(), tempFileSuffix) {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			s.l.WithField("file_path", p).Warning("unfinished chunk removed")
+		}
+		return nil
+	})
+}
+
+func NewStorage(basePath string, durability Durability, l *log.Entry) (*Storage, error) {
 	storagePath := path.Join(basePath, "chunks")
 	if err := os.MkdirAll(storagePath, fs.ModePerm); err != nil {
 		l.WithError(err).Error(ErrCantCreateStorage)
 		return nil, ErrCantCreateStorage
 	}
-	return &Storage{path: storagePath, l: l.WithField("storage_base_path", storagePath)}, nil
+	s := &Storage{
+		path:       storagePath,
+		durability: durability,
+		l:          l.WithField("storage_base_path", storagePath),
+	}
+	if err := s.removeTempFiles(); err != nil {
+		s.l.WithError(err).Error(ErrCantCleanStorage)
+		return nil, ErrCantCleanStorage
+	}
+	return s, nil
 }
@@ -5,8 +5,10 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp/cmpopts"
 
@@ -137,10 +139,16 @@ func TestStorage_SaveFile(t *testing.T) {
 			file:        io.NopCloser(strings.NewReader("success")),
 			want:        "success",
 		},
+		{name: "overwrite with shorter",
+			storagePath: "./testdata",
+			fileName:    "success.txt",
+			file:        io.NopCloser(strings.NewReader("short")),
+			want:        "short",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s, err := NewStorage(tt.storagePath,
+			s, err := NewStorage(tt.storagePath, DurabilityFull,
 				getLogger().WithField("test", tt.name))
 			if !errors.Is(err, tt.initErr) {
 				t.Errorf("unexpected error:\n%s", cmp.Diff(tt.initErr, err, cmpopts.EquateErrors()))
@@ -157,6 +165,95 @@ func TestStorage_SaveFile(t *testing.T) {
 				assert.NoError(t, err)
 				assert.Equal(t, tt.want, string(got))
 			}
+			temp, _ := filepath.Glob(path.Join(s.path, "*"+tempFileSuffix))
+			assert.Empty(t, temp)
 		})
 	}
 }
+
+func TestNewStorage_RemovesTempFiles(t *testing.T) {
+	base := t.TempDir()
+	chunkDir := path.Join(base, "chunks", "user", "file")
+	if err := os.MkdirAll(chunkDir, os.ModePerm); err != nil {
+		t.Fatalf("can't prepare test: %s", err)
+	}
+	for _, name := range []string{"0", ".1.123" + tempFileSuffix} {
+		if err := os.WriteFile(path.Join(chunkDir, name), []byte("data"), os.ModePerm); err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+	}
+
+	if _, err := NewStorage(base, DurabilityNone, getLogger().WithField("test", t.Name())); err != nil {
+		t.Fatalf("can't init storage: %s", err)
+	}
+	entries, err := os.ReadDir(chunkDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "0", entries[0].Name())
+}
+
+func TestStorage_CheckWritable(t *testing.T) {
+	base := t.TempDir()
+	s, err := NewStorage(base, DurabilityNone, log.NewEntry(getLogger()))
+	if err != nil {
+		t.Fatalf("can't create storage: %s", err)
+	}
+	assert.NoError(t, s.CheckWritable())
+	entries, err := os.ReadDir(path.Join(base, "chunks"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	assert.NoError(t, os.RemoveAll(path.Join(base, "chunks")))
+	assert.ErrorIs(t, s.CheckWritable(), ErrNotWritable)
+}
+
+func TestStorage_RemoveFile(t *testing.T) {
+	s, err := NewStorage(t.TempDir(), DurabilityNone, log.NewEntry(getLogger()))
+	if err != nil {
+		t.Fatalf("can't create storage: %s", err)
+	}
+	for _, p := range []string{"user/file/0", "user/file/3", "user/other/0"} {
+		if err := s.SaveFile(p, strings.NewReader("chunk")); err != nil {
+			t.Fatalf("can't prepare test: %s", err)
+		}
+	}
+	assert.NoError(t, s.RemoveFile("user/file/3"))
+	_, err = s.GetFile("user/file/3")
+	assert.ErrorIs(t, err, ErrCantFindChunk)
+	_, err = os.Stat(path.Join(s.path, checksumPath("user/file/3")))
+	assert.ErrorIs(t, err, os.ErrNotExist, "the checksum goes with the chunk")
+	_, err = s.GetFile("user/file/0")
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.RemoveFile("user/file"))
+	_, err = s.GetFile("user/file/0")
+	assert.ErrorIs(t, err, ErrCantFindChunk)
+	_, err = s.GetFile("user/other/0")
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.RemoveFile("user/file"))
+	assert.ErrorIs(t, s.RemoveFile("../user"), ErrBadPath)
+
+	until := time.Now().Add(time.Hour)
+	assert.NoError(t, s.LockFile("user/other", &Lock{RetainUntil: &until}))
+	assert.ErrorIs(t, s.RemoveFile("user/other"), ErrFileLocked)
+	assert.ErrorIs(t, s.RemoveFile("user/other/0"), ErrFileLocked)
+	assert.NoError(t, s.LockFile("user/other", &Lock{LegalHold: true}))
+	assert.ErrorIs(t, s.RemoveFile("user/other"), ErrFileLocked)
+	past := time.Now().Add(-time.Hour)
+	assert.NoError(t, s.LockFile("user/other", &Lock{RetainUntil: &past}))
+	assert.NoError(t, s.RemoveFile("user/other"))
+	_, err = s.GetFile("user/other/0")
+	assert.ErrorIs(t, err, ErrCantFindChunk)
+	assert.ErrorIs(t, s.LockFile("../user", &Lock{LegalHold: true}), ErrBadPath)
+}
+
+func TestParseDurability(t *testing.T) {
+	for in, want := range map[string]Durability{"": DurabilityFull, "full": DurabilityFull, "file": DurabilityFile, "none": DurabilityNone} {
+		got, err := ParseDurability(in)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := ParseDurability("fast")
+	assert.ErrorIs(t, err, ErrUnknownDurability)
+}
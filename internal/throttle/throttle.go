@@ -0,0 +1,23 @@
+package throttle
+
+import (
+	"context"
+	"time"
+)
+
+// Wait waits until handling bytes since start fits into rate bytes a second or ctx is done, a rate of 0 is unlimited
+func Wait(ctx context.Context, start time.Time, bytes, rate int64) {
+	if rate <= 0 {
+		return
+	}
+	wait := time.Duration(float64(bytes)/float64(rate)*float64(time.Second)) - time.Since(start)
+	if wait <= 0 {
+		return
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
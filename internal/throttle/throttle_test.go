@@ -0,0 +1,41 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		bytes    int64
+		rate     int64
+		canceled bool
+		wantWait bool
+	}{
+		{name: "unlimited", bytes: 1 << 30, rate: 0},
+		{name: "in rate", elapsed: time.Second, bytes: 100, rate: 1000},
+		{name: "over rate", bytes: 100, rate: 1000, wantWait: true},
+		{name: "canceled", bytes: 1000, rate: 1, canceled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.canceled {
+				cancel()
+			}
+			defer cancel()
+			now := time.Now()
+			Wait(ctx, now.Add(-tt.elapsed), tt.bytes, tt.rate)
+			if tt.wantWait {
+				assert.GreaterOrEqual(t, time.Since(now), 90*time.Millisecond)
+			} else {
+				assert.Less(t, time.Since(now), 50*time.Millisecond)
+			}
+		})
+	}
+}
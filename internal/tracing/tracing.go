@@ -0,0 +1,155 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HeaderRequestID   = "X-Request-ID"
+	HeaderTraceparent = "traceparent"
+
+	maxRequestIDLen = 128
+)
+
+var (
+	traceparentRe = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+	requestIDRe   = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+)
+
+type ctxKey int
+
+const (
+	ctxKeyRequestID ctxKey = iota
+	ctxKeySpan
+	ctxKeyLogger
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+// Span is a timed operation of a trace. Spans are exported to the log when they end
+type Span struct {
+	TraceID  TraceID
+	ID       SpanID
+	ParentID SpanID
+	Name     string
+
+	start  time.Time
+	fields log.Fields
+	l      *log.Entry
+}
+
+// Traceparent formats the span as a W3C trace context header value
+func (s *Span) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.TraceID[:]), hex.EncodeToString(s.ID[:]))
+}
+
+func (s *Span) SetField(key string, value any) {
+	s.fields[key] = value
+}
+
+func (s *Span) End() {
+	fields := log.Fields{
+		"span":      s.Name,
+		"trace_id":  hex.EncodeToString(s.TraceID[:]),
+		"span_id":   hex.EncodeToString(s.ID[:]),
+		"parent_id": hex.EncodeToString(s.ParentID[:]),
+		"duration":  time.Since(s.start).String(),
+	}
+	for k, v := range s.fields {
+		fields[k] = v
+	}
+	s.l.WithFields(fields).Debug("span ended")
+}
+
+// StartSpan starts a child of the span kept in ctx, or a new trace if there is none
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	s := &Span{Name: name, start: time.Now(), fields: log.Fields{}, l: Logger(ctx, log.NewEntry(log.StandardLogger()))}
+	if parent, ok := ctx.Value(ctxKeySpan).(*Span); ok {
+		s.TraceID, s.ParentID = parent.TraceID, parent.ID
+	} else {
+		_, _ = rand.Read(s.TraceID[:])
+	}
+	_, _ = rand.Read(s.ID[:])
+	return context.WithValue(ctx, ctxKeySpan, s), s
+}
+
+// Inject adds the request id and the current span of ctx to outgoing request headers
+func Inject(ctx context.Context, h http.Header) {
+	if id := RequestID(ctx); id != "" {
+		h.Set(HeaderRequestID, id)
+	}
+	if s, ok := ctx.Value(ctxKeySpan).(*Span); ok {
+		h.Set(HeaderTraceparent, s.Traceparent())
+	}
+}
+
+// extract returns a span with the remote parent from the traceparent header, or nil if there is no valid header
+func extract(h http.Header) *Span {
+	m := traceparentRe.FindStringSubmatch(h.Get(HeaderTraceparent))
+	if m == nil {
+		return nil
+	}
+	s := &Span{}
+	if _, err := hex.Decode(s.TraceID[:], []byte(m[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(s.ID[:], []byte(m[2])); err != nil {
+		return nil
+	}
+	if s.TraceID == (TraceID{}) || s.ID == (SpanID{}) {
+		return nil
+	}
+	return s
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyRequestID).(string)
+	return id
+}
+
+// Logger returns the logger of the request kept in ctx, with the request id and the trace id.
+// fallback is returned outside of requests
+func Logger(ctx context.Context, fallback *log.Entry) *log.Entry {
+	if l, ok := ctx.Value(ctxKeyLogger).(*log.Entry); ok {
+		return l
+	}
+	return fallback
+}
+
+// Middleware accepts X-Request-ID and traceparent headers or generates them, and returns them to the client.
+// The request context gets a server span and a logger with the request id
+func Middleware(l *log.Entry, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if len(id) > maxRequestIDLen || !requestIDRe.MatchString(id) {
+			id = newRequestID()
+		}
+		ctx := context.WithValue(r.Context(), ctxKeyRequestID, id)
+		if parent := extract(r.Header); parent != nil {
+			ctx = context.WithValue(ctx, ctxKeySpan, parent)
+		}
+		ctx = context.WithValue(ctx, ctxKeyLogger, l.WithField("request_id", id))
+		ctx, span := StartSpan(ctx, r.Method+" "+r.URL.Path)
+		ctx = context.WithValue(ctx, ctxKeyLogger, Logger(ctx, l).WithField("trace_id", hex.EncodeToString(span.TraceID[:])))
+		defer span.End()
+
+		rw.Header().Set(HeaderRequestID, id)
+		rw.Header().Set(HeaderTraceparent, span.Traceparent())
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
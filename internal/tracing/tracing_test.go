@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getLogger() *log.Entry {
+	logger := log.New()
+	logger.SetLevel(log.FatalLevel)
+	return logger.WithField("in_test", true)
+}
+
+func TestMiddleware(t *testing.T) {
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name          string
+		requestID     string
+		traceparent   string
+		wantRequestID string
+		wantTraceID   string
+	}{
+		{name: "generated"},
+		{name: "accepted", requestID: "abc-123", wantRequestID: "abc-123"},
+		{name: "invalid request id", requestID: "bad id\n"},
+		{name: "remote parent", traceparent: parent, wantTraceID: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{name: "invalid parent", traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var outgoing http.Header
+			h := Middleware(getLogger(), http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				ctx, span := StartSpan(r.Context(), "chunk.fetch")
+				defer span.End()
+				outgoing = http.Header{}
+				Inject(ctx, outgoing)
+			}))
+			req := httptest.NewRequest("GET", "/object/dir/name", nil)
+			if tt.requestID != "" {
+				req.Header.Set(HeaderRequestID, tt.requestID)
+			}
+			if tt.traceparent != "" {
+				req.Header.Set(HeaderTraceparent, tt.traceparent)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			requestID := rec.Header().Get(HeaderRequestID)
+			assert.NotEmpty(t, requestID)
+			if tt.wantRequestID != "" {
+				assert.Equal(t, tt.wantRequestID, requestID)
+			}
+			assert.Equal(t, requestID, outgoing.Get(HeaderRequestID))
+
+			server, chunk := rec.Header().Get(HeaderTraceparent), outgoing.Get(HeaderTraceparent)
+			assert.Regexp(t, traceparentRe, server)
+			assert.Regexp(t, traceparentRe, chunk)
+			traceID := strings.Split(server, "-")[1]
+			assert.Equal(t, traceID, strings.Split(chunk, "-")[1], "chunk span belongs to the request trace")
+			assert.NotEqual(t, strings.Split(server, "-")[2], strings.Split(chunk, "-")[2])
+			if tt.wantTraceID != "" {
+				assert.Equal(t, tt.wantTraceID, traceID)
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	fallback := getLogger()
+	assert.Equal(t, fallback, Logger(context.Background(), fallback))
+}